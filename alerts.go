@@ -0,0 +1,811 @@
+package main
+
+//
+// Alert rules:  -rules horus.rules
+//
+// Evaluated after every poll (watch, exporter).  One rule per line:
+//
+//	# name        severity  condition                               [for 5m] [clear condition]
+//	hot_board     critical  Devs.Temperature > 85 for 5m clear Devs.Temperature < 80
+//	low_hashrate  warning   Summary.MHS5s < 0.8 * Summary.MHSav for 10m
+//	pool_rejects  warning   Summary.PoolRejectedPercentage > 2
+//	hw_errors     warning   rate(Summary.HardwareErrors) > 10/min
+//	fan_stopped   critical  Devs.FanSpeed == 0 for 2m
+//	dead_board    critical  Devs.Status != "Alive"
+//	dead_chain    critical  Chains.Dead == 1
+//	offline       critical  offline for 10m
+//
+// Fields are Summary.X, Devs.X, Pools.X or Chains.X - X is the Go field name
+// or the api name (see cgminer-api/cgminer.go, and chains.go for Chains), any
+// case.  A bare X is looked for in Summary, then Devs, then Pools, then Chains.
+// A rule that uses Devs is checked for every device (Pools - every pool,
+// Chains - every hash chain) of every miner.  rate(X), or "X rate",
+// is the change per second since the last poll; 10/min is 10 per minute.
+//
+// A rule fires once its condition has held for the "for" time and is
+// resolved when the "clear" condition holds (hysteresis) - without a clear
+// condition, as soon as the condition does not hold.  A miner that does not
+// answer leaves its alerts as they were, except for "offline".
+//
+// See ALERTS.md.
+//
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cgminer-api"
+)
+
+// -rules: the rule file ("": no alerting)
+var rules_file string = ""
+
+var alert_severities = []string{"critical", "warning", "info"}
+
+type alertRule struct {
+	Name     string
+	Severity string
+	Text     string // the condition as written
+	cond     *condition
+	clear    *condition // nil: resolve when cond does not hold
+	For      time.Duration
+	scope    string // miner, devs, pools, chains or offline
+	line     int
+}
+
+// A firing or resolved alert - what gets reported (and later notified).
+type Alert struct {
+	Rule      string    `json:"rule"`
+	Severity  string    `json:"severity"`
+	State     string    `json:"state"` // firing or resolved
+	Host      string    `json:"host"`
+	MAC       string    `json:"mac,omitempty"`
+	Instance  string    `json:"instance,omitempty"` // "device 2", "pool 0" ...
+	Condition string    `json:"condition"`
+	Value     float64   `json:"value"`
+	Since     time.Time `json:"since"` // when the condition started to hold
+	Time      time.Time `json:"time"`
+}
+
+/////////////////////////////////////////////////////////////
+// loadRules
+// Read the rule file.  Any mistake is an error with its line
+// number - better to refuse to start than to silently not alert.
+/////////////////////////////////////////////////////////////
+func loadRules(path string) ([]*alertRule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rules []*alertRule
+	names := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		r, err := parseRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %s", path, n, err)
+		}
+		if names[r.Name] {
+			return nil, fmt.Errorf("%s line %d: rule %s is already defined", path, n, r.Name)
+		}
+		names[r.Name] = true
+		r.line = n
+		rules = append(rules, r)
+	}
+	return rules, scanner.Err()
+}
+
+var rule_re = regexp.MustCompile(`^(\S+)\s+(\S+)\s+(.+?)(?:\s+for\s+(\S+))?(?:\s+clear\s+(.+))?$`)
+
+func parseRule(line string) (*alertRule, error) {
+	m := rule_re.FindStringSubmatch(line)
+	if m == nil {
+		return nil, fmt.Errorf("want: name severity condition [for duration] [clear condition]")
+	}
+	r := &alertRule{Name: m[1], Severity: strings.ToLower(m[2]), Text: m[3]}
+
+	known := false
+	for _, s := range alert_severities {
+		if s == r.Severity {
+			known = true
+		}
+	}
+	if !known {
+		return nil, fmt.Errorf("severity (%s) must be one of %s", m[2], strings.Join(alert_severities, ", "))
+	}
+
+	if m[4] != "" {
+		d, err := time.ParseDuration(m[4])
+		if err != nil {
+			return nil, fmt.Errorf("for: %s", err)
+		}
+		r.For = d
+	}
+
+	if strings.TrimSpace(m[3]) == "offline" {
+		r.scope = "offline"
+		if m[5] != "" {
+			return nil, fmt.Errorf("an offline rule clears when the miner answers - no clear condition")
+		}
+		return r, nil
+	}
+
+	var err error
+	var sections []string
+	if r.cond, sections, err = parseCondition(m[3]); err != nil {
+		return nil, err
+	}
+	if m[5] != "" {
+		var more []string
+		if r.clear, more, err = parseCondition(m[5]); err != nil {
+			return nil, fmt.Errorf("clear: %s", err)
+		}
+		sections = append(sections, more...)
+	}
+
+	r.scope = "miner"
+	for _, s := range sections {
+		if s == "summary" {
+			continue
+		}
+		if r.scope != "miner" && r.scope != s {
+			return nil, fmt.Errorf("a rule can look at one of Devs, Pools or Chains, not more")
+		}
+		r.scope = s
+	}
+	return r, nil
+}
+
+/////////////////////////////////////////////////////////////
+// Conditions and expressions
+/////////////////////////////////////////////////////////////
+
+// What an expression is evaluated against: one miner, and one of its devices, pools or chains.
+type alertContext struct {
+	summary *cgminer.Summary
+	dev     *cgminer.Devs
+	pool    *cgminer.Pool
+	chain   *ChainStat
+	prev    *alertContext // the same thing at the last poll (for rate)
+	elapsed time.Duration // since the last poll
+}
+
+// A value is a number or (for == and !=) a string.  ok is false when there is no data.
+type alertValue struct {
+	num   float64
+	str   string
+	isStr bool
+}
+
+type expr interface {
+	eval(ctx *alertContext) (alertValue, bool)
+}
+
+type condition struct {
+	left, right expr
+	op          string
+}
+
+// Holds, and the left hand value (for the message).  ok is false when there is no data.
+func (c *condition) holds(ctx *alertContext) (bool, float64, bool) {
+	l, ok := c.left.eval(ctx)
+	if !ok {
+		return false, 0, false
+	}
+	r, ok := c.right.eval(ctx)
+	if !ok {
+		return false, 0, false
+	}
+
+	if l.isStr || r.isStr {
+		switch c.op {
+		case "==":
+			return l.str == r.str, l.num, true
+		case "!=":
+			return l.str != r.str, l.num, true
+		}
+		return false, 0, false
+	}
+
+	switch c.op {
+	case ">":
+		return l.num > r.num, l.num, true
+	case ">=":
+		return l.num >= r.num, l.num, true
+	case "<":
+		return l.num < r.num, l.num, true
+	case "<=":
+		return l.num <= r.num, l.num, true
+	case "==":
+		return l.num == r.num, l.num, true
+	case "!=":
+		return l.num != r.num, l.num, true
+	}
+	return false, 0, false
+}
+
+type numberExpr float64
+
+func (n numberExpr) eval(ctx *alertContext) (alertValue, bool) {
+	return alertValue{num: float64(n)}, true
+}
+
+type stringExpr string
+
+func (s stringExpr) eval(ctx *alertContext) (alertValue, bool) {
+	return alertValue{str: string(s), isStr: true}, true
+}
+
+type fieldExpr struct {
+	section string // summary, devs, pools, chains
+	index   int    // struct field
+}
+
+func (f fieldExpr) eval(ctx *alertContext) (alertValue, bool) {
+	var v reflect.Value
+	switch {
+	case f.section == "summary" && ctx.summary != nil:
+		v = reflect.ValueOf(ctx.summary).Elem()
+	case f.section == "devs" && ctx.dev != nil:
+		v = reflect.ValueOf(ctx.dev).Elem()
+	case f.section == "pools" && ctx.pool != nil:
+		v = reflect.ValueOf(ctx.pool).Elem()
+	case f.section == "chains" && ctx.chain != nil:
+		v = reflect.ValueOf(ctx.chain).Elem()
+	default:
+		return alertValue{}, false
+	}
+
+	field := v.Field(f.index)
+	switch field.Kind() {
+	case reflect.Int, reflect.Int64:
+		return alertValue{num: float64(field.Int())}, true
+	case reflect.Float64:
+		return alertValue{num: field.Float()}, true
+	case reflect.Bool:
+		return alertValue{num: boolMetric(field.Bool())}, true
+	case reflect.String:
+		return alertValue{str: field.String(), isStr: true}, true
+	}
+	return alertValue{}, false
+}
+
+type rateExpr struct {
+	field fieldExpr
+}
+
+// Per second.  No data on the first poll, or when the counter went backwards (restart).
+func (r rateExpr) eval(ctx *alertContext) (alertValue, bool) {
+	if ctx.prev == nil || ctx.elapsed <= 0 {
+		return alertValue{}, false
+	}
+	now, ok := r.field.eval(ctx)
+	if !ok || now.isStr {
+		return alertValue{}, false
+	}
+	before, ok := r.field.eval(ctx.prev)
+	if !ok || now.num < before.num {
+		return alertValue{}, false
+	}
+	return alertValue{num: (now.num - before.num) / ctx.elapsed.Seconds()}, true
+}
+
+type binaryExpr struct {
+	op          byte
+	left, right expr
+}
+
+func (b binaryExpr) eval(ctx *alertContext) (alertValue, bool) {
+	l, ok := b.left.eval(ctx)
+	if !ok || l.isStr {
+		return alertValue{}, false
+	}
+	r, ok := b.right.eval(ctx)
+	if !ok || r.isStr {
+		return alertValue{}, false
+	}
+	switch b.op {
+	case '+':
+		return alertValue{num: l.num + r.num}, true
+	case '-':
+		return alertValue{num: l.num - r.num}, true
+	case '*':
+		return alertValue{num: l.num * r.num}, true
+	case '/':
+		if r.num == 0 {
+			return alertValue{}, false
+		}
+		return alertValue{num: l.num / r.num}, true
+	}
+	return alertValue{}, false
+}
+
+/////////////////////////////////////////////////////////////
+// parseCondition
+//
+//	condition := sum (> >= < <= == !=) sum
+//	sum       := term ((+ -) term)*
+//	term      := factor ((* /) factor)*
+//	factor    := number | "string" | field [rate] | rate(field) | (sum) | -factor
+//
+// Also returns the sections (summary, devs, pools, chains) it looks at.
+/////////////////////////////////////////////////////////////
+type exprParser struct {
+	tokens   []string
+	pos      int
+	sections []string
+}
+
+var expr_token_re = regexp.MustCompile(`\s*(\d+(?:\.\d+)?(?:/(?:s|sec|min|m|h|hr|hour)\b)?|"[^"]*"|[A-Za-z_][A-Za-z0-9_.%]*|>=|<=|==|!=|[-+*/()<>])`)
+
+func parseCondition(text string) (*condition, []string, error) {
+	p := &exprParser{}
+	rest := text
+	for strings.TrimSpace(rest) != "" {
+		m := expr_token_re.FindStringSubmatchIndex(rest)
+		if m == nil || m[0] != 0 {
+			return nil, nil, fmt.Errorf("can not make sense of %q", strings.TrimSpace(rest))
+		}
+		p.tokens = append(p.tokens, rest[m[2]:m[3]])
+		rest = rest[m[1]:]
+	}
+
+	left, err := p.sum()
+	if err != nil {
+		return nil, nil, err
+	}
+	op := p.next()
+	switch op {
+	case ">", ">=", "<", "<=", "==", "!=":
+	default:
+		return nil, nil, fmt.Errorf("%q: want a comparison (> >= < <= == !=)", text)
+	}
+	right, err := p.sum()
+	if err != nil {
+		return nil, nil, err
+	}
+	if p.peek() != "" {
+		return nil, nil, fmt.Errorf("%q: unexpected %q", text, p.peek())
+	}
+	return &condition{left: left, right: right, op: op}, p.sections, nil
+}
+
+func (p *exprParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *exprParser) next() string {
+	t := p.peek()
+	if t != "" {
+		p.pos++
+	}
+	return t
+}
+
+func (p *exprParser) sum() (expr, error) {
+	left, err := p.term()
+	for err == nil && (p.peek() == "+" || p.peek() == "-") {
+		op := p.next()[0]
+		var right expr
+		if right, err = p.term(); err == nil {
+			left = binaryExpr{op: op, left: left, right: right}
+		}
+	}
+	return left, err
+}
+
+func (p *exprParser) term() (expr, error) {
+	left, err := p.factor()
+	for err == nil && (p.peek() == "*" || p.peek() == "/") {
+		op := p.next()[0]
+		var right expr
+		if right, err = p.factor(); err == nil {
+			left = binaryExpr{op: op, left: left, right: right}
+		}
+	}
+	return left, err
+}
+
+var rate_units = map[string]float64{"s": 1, "sec": 1, "min": 60, "m": 60, "h": 3600, "hr": 3600, "hour": 3600}
+
+func (p *exprParser) factor() (expr, error) {
+	t := p.next()
+	switch {
+	case t == "":
+		return nil, fmt.Errorf("the condition ends too soon")
+
+	case t == "(":
+		e, err := p.sum()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, fmt.Errorf("missing )")
+		}
+		return e, nil
+
+	case t == "-":
+		e, err := p.factor()
+		if err != nil {
+			return nil, err
+		}
+		return binaryExpr{op: '-', left: numberExpr(0), right: e}, nil
+
+	case t[0] == '"':
+		return stringExpr(strings.Trim(t, `"`)), nil
+
+	case t[0] >= '0' && t[0] <= '9':
+		num, per := t, ""
+		if i := strings.Index(t, "/"); i >= 0 {
+			num, per = t[:i], t[i+1:]
+		}
+		v, err := strconv.ParseFloat(num, 64)
+		if err != nil {
+			return nil, err
+		}
+		if per != "" {
+			v /= rate_units[per] // 10/min is 10 per 60 seconds
+		}
+		return numberExpr(v), nil
+
+	case t == "rate" && p.peek() == "(":
+		p.next()
+		f, err := p.field(p.next())
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, fmt.Errorf("rate: missing )")
+		}
+		return rateExpr{field: f}, nil
+	}
+
+	f, err := p.field(t)
+	if err != nil {
+		return nil, err
+	}
+	if p.peek() == "rate" {
+		p.next()
+		return rateExpr{field: f}, nil
+	}
+	return f, nil
+}
+
+var alert_sections = []struct {
+	name  string
+	names []string
+	typ   reflect.Type
+}{
+	{"summary", []string{"summary"}, reflect.TypeOf(cgminer.Summary{})},
+	{"devs", []string{"devs", "dev", "devices", "device"}, reflect.TypeOf(cgminer.Devs{})},
+	{"pools", []string{"pools", "pool"}, reflect.TypeOf(cgminer.Pool{})},
+	{"chains", []string{"chains", "chain"}, reflect.TypeOf(ChainStat{})},
+}
+
+// Summary.MHS5s, devs.temperature, Pools."Pool Rejected%" (as PoolRejected%), MHSav ...
+func (p *exprParser) field(name string) (fieldExpr, error) {
+	section, field := "", name
+	if i := strings.Index(name, "."); i >= 0 {
+		section, field = strings.ToLower(name[:i]), name[i+1:]
+	}
+
+	for _, s := range alert_sections {
+		if section != "" && !containsString(s.names, section) {
+			continue
+		}
+		if i, ok := findAlertField(s.typ, field); ok {
+			p.sections = append(p.sections, s.name)
+			return fieldExpr{section: s.name, index: i}, nil
+		}
+		if section != "" {
+			return fieldExpr{}, fmt.Errorf("%s: no field %s", s.name, field)
+		}
+	}
+	if section != "" {
+		return fieldExpr{}, fmt.Errorf("%s: unknown section (Summary, Devs, Pools or Chains)", name)
+	}
+	return fieldExpr{}, fmt.Errorf("unknown field %s", name)
+}
+
+var alert_name_cleaner = strings.NewReplacer(" ", "", "_", "", "-", "")
+
+func findAlertField(t reflect.Type, name string) (int, bool) {
+	want := strings.ToLower(alert_name_cleaner.Replace(name))
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := strings.Split(f.Tag.Get("json"), ",")[0]
+		if strings.ToLower(f.Name) == want || strings.ToLower(alert_name_cleaner.Replace(tag)) == want {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+/////////////////////////////////////////////////////////////
+// alertEngine
+// The rules and the state of every rule / miner / device.
+/////////////////////////////////////////////////////////////
+type alertState struct {
+	pending time.Time // when the condition started to hold (zero: it does not)
+	firing  bool
+	value   float64
+}
+
+type alertEngine struct {
+	mu     sync.Mutex // the exporter reads firing() while the poll loop evaluates
+	rules  []*alertRule
+	states map[string]*alertState   // rule|host|instance
+	prev   map[string]*alertContext // host|instance - the last poll, for rate
+	polled time.Time
+	known  map[string]HostRecord // every miner we have seen (for offline)
+}
+
+var alert_engine *alertEngine
+
+// Load -rules (if given).  Called once the options are parsed.
+func startAlerts() error {
+	if rules_file == "" {
+		return nil
+	}
+	rules, err := loadRules(rules_file)
+	if err != nil {
+		return fmt.Errorf("-rules: %s", err)
+	}
+	alert_engine = &alertEngine{
+		rules:  rules,
+		states: make(map[string]*alertState),
+		prev:   make(map[string]*alertContext),
+		known:  make(map[string]HostRecord),
+	}
+	fmt.Printf("Alert rules: %d loaded from %s\n", len(rules), rules_file)
+	return nil
+}
+
+/////////////////////////////////////////////////////////////
+// evaluate
+// Check every rule against this poll, return what started
+// firing or was resolved.
+/////////////////////////////////////////////////////////////
+func (e *alertEngine) evaluate(records []HostRecord, now time.Time) []Alert {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var changes []Alert
+
+	elapsed := time.Duration(0)
+	if !e.polled.IsZero() {
+		elapsed = now.Sub(e.polled)
+	}
+	e.polled = now
+
+	present := make(map[string]bool)
+	contexts := make(map[string]*alertContext)
+
+	for _, rec := range records {
+		present[rec.Host] = true
+		e.known[rec.Host] = rec
+
+		miner := &alertContext{summary: rec.Summary, elapsed: elapsed}
+		devs := make([]*alertContext, len(rec.Devs))
+		for i := range rec.Devs {
+			devs[i] = &alertContext{summary: rec.Summary, dev: &rec.Devs[i], elapsed: elapsed}
+		}
+		pools := make([]*alertContext, len(rec.Pools))
+		for i := range rec.Pools {
+			pools[i] = &alertContext{summary: rec.Summary, pool: &rec.Pools[i], elapsed: elapsed}
+		}
+		chains := make([]*alertContext, len(rec.Chains))
+		for i := range rec.Chains {
+			chains[i] = &alertContext{summary: rec.Summary, chain: &rec.Chains[i], elapsed: elapsed}
+		}
+
+		check := func(r *alertRule, instance string, ctx *alertContext) {
+			key := rec.Host + "|" + instance
+			ctx.prev = e.prev[key]
+			contexts[key] = ctx
+
+			holds, value, ok := r.cond.holds(ctx)
+			if !ok {
+				return // no data - leave it as it is
+			}
+			cleared := !holds
+			if r.clear != nil {
+				c, _, ok := r.clear.holds(ctx)
+				cleared = ok && c
+			}
+			if a, changed := e.step(r, rec, instance, holds, cleared, value, now); changed {
+				changes = append(changes, a)
+			}
+		}
+
+		for _, r := range e.rules {
+			switch r.scope {
+			case "miner":
+				check(r, "", miner)
+			case "devs":
+				for i, ctx := range devs {
+					check(r, fmt.Sprintf("device %d", i), ctx)
+				}
+			case "pools":
+				for i, ctx := range pools {
+					check(r, fmt.Sprintf("pool %d", rec.Pools[i].Pool), ctx)
+				}
+			case "chains":
+				for i, ctx := range chains {
+					check(r, fmt.Sprintf("chain %d", rec.Chains[i].Chain), ctx)
+				}
+			case "offline":
+				down := rec.Summary == nil && rec.Version == nil
+				if a, changed := e.step(r, rec, "", down, !down, 0, now); changed {
+					changes = append(changes, a)
+				}
+			}
+		}
+	}
+
+	// The miners the scan did not find at all are offline.
+	for host, rec := range e.known {
+		if present[host] {
+			continue
+		}
+		for _, r := range e.rules {
+			if r.scope == "offline" {
+				if a, changed := e.step(r, rec, "", true, false, 0, now); changed {
+					changes = append(changes, a)
+				}
+			}
+		}
+	}
+
+	e.prev = contexts
+	for key := range contexts {
+		// The previous poll should not keep pointing at the one before it.
+		contexts[key].prev = nil
+	}
+	return changes
+}
+
+// Move one rule / instance along.  Returns the alert if it started firing or was resolved.
+func (e *alertEngine) step(r *alertRule, rec HostRecord, instance string, holds bool, cleared bool, value float64, now time.Time) (Alert, bool) {
+	key := r.Name + "|" + rec.Host + "|" + instance
+	s := e.states[key]
+	if s == nil {
+		s = &alertState{}
+		e.states[key] = s
+	}
+
+	if holds {
+		if s.pending.IsZero() {
+			s.pending = now
+		}
+		s.value = value
+	} else {
+		s.pending = time.Time{}
+	}
+
+	alert := Alert{
+		Rule:      r.Name,
+		Severity:  r.Severity,
+		Host:      rec.Host,
+		MAC:       rec.MAC,
+		Instance:  instance,
+		Condition: r.Text,
+		Value:     s.value,
+		Time:      now,
+	}
+
+	switch {
+	case !s.firing && holds && now.Sub(s.pending) >= r.For:
+		s.firing = true
+		alert.State = "firing"
+		alert.Since = s.pending
+		return alert, true
+
+	case s.firing && cleared:
+		s.firing = false
+		alert.State = "resolved"
+		alert.Value = value
+		return alert, true
+	}
+	return alert, false
+}
+
+// What is firing now, for the exporter.
+func (e *alertEngine) firing() []Alert {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var list []Alert
+	for key, s := range e.states {
+		if !s.firing {
+			continue
+		}
+		parts := strings.SplitN(key, "|", 3)
+		for _, r := range e.rules {
+			if r.Name == parts[0] {
+				list = append(list, Alert{Rule: r.Name, Severity: r.Severity, State: "firing", Host: parts[1],
+					Instance: parts[2], Condition: r.Text, Value: s.value, Since: s.pending})
+			}
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Rule != list[j].Rule {
+			return list[i].Rule < list[j].Rule
+		}
+		return list[i].Host+list[i].Instance < list[j].Host+list[j].Instance
+	})
+	return list
+}
+
+/////////////////////////////////////////////////////////////
+// checkAlerts
+// Evaluate the rules against a poll (if there are rules) and
+// return the changes as HostRecords (event "alert").
+/////////////////////////////////////////////////////////////
+func checkAlerts(records []HostRecord, now time.Time) []HostRecord {
+	if alert_engine == nil {
+		return nil
+	}
+
+	byHost := make(map[string]HostRecord)
+	for _, rec := range records {
+		byHost[rec.Host] = rec
+	}
+
+	var events []HostRecord
+	for _, a := range alert_engine.evaluate(records, now) {
+		rec, ok := byHost[a.Host]
+		if !ok {
+			rec = newRecord(a.Host)
+			rec.MAC = a.MAC
+		}
+		rec.Time = now.Format(time.RFC3339)
+		rec.Event = "alert"
+		alert := a
+		rec.Alert = &alert
+		events = append(events, rec)
+	}
+	return events
+}
+
+// One line for the table output.
+func alertLine(a *Alert) string {
+	line := fmt.Sprintf("%s %-8s %-8s %s %s", a.Time.Format("15:04:05"), strings.ToUpper(a.State), a.Severity, a.Rule, a.Host)
+	if a.Instance != "" {
+		line += " " + a.Instance
+	}
+	line += fmt.Sprintf(" (%s)", a.Condition)
+	if a.State == "firing" && !a.Since.Equal(a.Time) {
+		line += fmt.Sprintf(" for %s", a.Time.Sub(a.Since).Round(time.Second))
+	}
+	if a.Rule != "" && a.Condition != "offline" {
+		line += fmt.Sprintf(" value %s", strconv.FormatFloat(a.Value, 'g', 6, 64))
+	}
+	return line
+}
@@ -0,0 +1,525 @@
+package main
+
+//
+// horus api:
+// The command line over http, for programs - see API.md and openapi.json.
+//
+//	GET  /miners                          the last poll
+//	GET  /miners/{id}                     ask one miner for everything, now
+//	GET  /miners/{id}/summary             ... or one part: summary, pools, devs, config
+//	POST /miners/{id}/actions/{action}    restart, switchpool, addpool, enablepool
+//	POST /scans                           start a scan: {"targets": ["10.0.0.0/24"]}
+//	GET  /scans, /scans/{id}              how it went, and what it found
+//	GET  /openapi.json                    the description (no token needed)
+//
+// {id} is an ip address or a MAC.  Every other request needs a token from the
+// -tokens file, one per line:
+//
+//	# name     role        token
+//	portal     operator    3f9c1e...
+//	grafana    read        77a0b2...
+//
+// read can GET, operator can also POST (scans and actions).
+//
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"crypto/tls"
+	_ "embed"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//go:embed openapi.json
+var openapi_json []byte
+
+var api_listen string = ":8081"
+var api_tokens string = ""
+var api_tls_cert string = ""
+var api_tls_key string = ""
+var api_interval time.Duration = 30 * time.Second
+var api_rescan time.Duration = 10 * time.Minute
+
+// How many finished scans GET /scans remembers.
+const api_scans_kept = 20
+
+func apiFlags(fs *flag.FlagSet) {
+	fs.StringVar(&api_listen, "listen", api_listen, "Address to serve the api on")
+	fs.StringVar(&api_tokens, "tokens", api_tokens, "File of: name, role (read or operator), token - required")
+	fs.StringVar(&api_tls_cert, "tls-cert", api_tls_cert, "Certificate (PEM) to serve https with")
+	fs.StringVar(&api_tls_key, "tls-key", api_tls_key, "Private key (PEM) for -tls-cert")
+	fs.DurationVar(&api_interval, "interval", api_interval, "Time between polls of the miners (for GET /miners)")
+	fs.DurationVar(&api_rescan, "rescan", api_rescan, "Time between scans for new miners (for GET /miners)")
+}
+
+type apiToken struct {
+	name  string
+	role  string // read, operator
+	token string
+}
+
+type apiServer struct {
+	tokens []apiToken
+	fleet  *fleetState
+
+	mu     sync.Mutex
+	scans  []*apiScan // oldest first
+	nextID int
+}
+
+type apiScan struct {
+	ID       string       `json:"id"`
+	Targets  []string     `json:"targets"`
+	By       string       `json:"by"`
+	State    string       `json:"state"` // running, done
+	Started  time.Time    `json:"started"`
+	Finished *time.Time   `json:"finished,omitempty"`
+	Hosts    []HostRecord `json:"hosts,omitempty"`
+}
+
+type apiAction struct {
+	Pool     *int64 `json:"pool"`     // switchpool, enablepool
+	URL      string `json:"url"`      // addpool
+	User     string `json:"user"`     // addpool
+	Password string `json:"password"` // addpool
+}
+
+/////////////////////////////////////////////////////////////
+// cmdAPI
+// horus api -tokens file [-listen :8081] [-tls-cert f -tls-key f] [targets]
+/////////////////////////////////////////////////////////////
+func cmdAPI(args []string) int {
+	if !Test_Cmdline_IP(args) {
+		return 1
+	}
+	if api_interval <= 0 || api_rescan <= 0 {
+		fmt.Println("Error: -interval and -rescan must be more than zero")
+		return 1
+	}
+	// An api anyone can reach would let anyone restart the miners.
+	if api_tokens == "" {
+		fmt.Println("Error: api needs -tokens (a file of: name, role, token)")
+		return 1
+	}
+	if (api_tls_cert == "") != (api_tls_key == "") {
+		fmt.Println("Error: -tls-cert and -tls-key go together")
+		return 1
+	}
+
+	tokens, err := loadTokens(api_tokens)
+	if err != nil {
+		fmt.Printf("Error: -tokens (%s): %s\n", api_tokens, err)
+		return 1
+	}
+
+	s := &apiServer{
+		tokens: tokens,
+		fleet:  &fleetState{name: "API", interval: api_interval, rescan: api_rescan},
+	}
+	go s.fleet.loop(args)
+
+	server := &http.Server{
+		Addr:      api_listen,
+		Handler:   s,
+		TLSConfig: &tls.Config{MinVersion: tls.VersionTLS12},
+	}
+
+	if api_tls_cert != "" {
+		fmt.Printf("Serving the api on https://%s (%d token(s))\n", api_listen, len(tokens))
+		err = server.ListenAndServeTLS(api_tls_cert, api_tls_key)
+	} else {
+		fmt.Printf("Serving the api on http://%s (%d token(s)) - without -tls-cert the tokens cross the network in the clear\n", api_listen, len(tokens))
+		err = server.ListenAndServe()
+	}
+	if err != nil {
+		fmt.Println("Error: ", err)
+		return 1
+	}
+	return 0
+}
+
+func loadTokens(path string) ([]apiToken, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var tokens []apiToken
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("line %d: want name, role, token", n)
+		}
+		t := apiToken{name: fields[0], role: fields[1], token: fields[2]}
+		if t.role != "read" && t.role != "operator" {
+			return nil, fmt.Errorf("line %d: role (%s) must be read or operator", n, t.role)
+		}
+		if len(t.token) < 16 {
+			return nil, fmt.Errorf("line %d: token for %s is too short (16 characters at least)", n, t.name)
+		}
+		tokens = append(tokens, t)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("no tokens")
+	}
+	return tokens, nil
+}
+
+// The token in "Authorization: Bearer ..." - nil if there is none or it is not ours.
+func (s *apiServer) authenticate(r *http.Request) *apiToken {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return nil
+	}
+	given := []byte(strings.TrimSpace(strings.TrimPrefix(auth, "Bearer ")))
+
+	var found *apiToken
+	for i := range s.tokens {
+		// Check them all, so the time taken does not give anything away.
+		if subtle.ConstantTimeCompare(given, []byte(s.tokens[i].token)) == 1 {
+			found = &s.tokens[i]
+		}
+	}
+	return found
+}
+
+func apiError(w http.ResponseWriter, status int, format string, a ...interface{}) {
+	writeJSON(w, status, map[string]string{"error": fmt.Sprintf(format, a...)})
+}
+
+/////////////////////////////////////////////////////////////
+// ServeHTTP
+// Authenticate, check the role, then route on the path.
+/////////////////////////////////////////////////////////////
+func (s *apiServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/openapi.json" {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(openapi_json)
+		return
+	}
+
+	t := s.authenticate(r)
+	if t == nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="horus"`)
+		apiError(w, http.StatusUnauthorized, "a valid token is needed: Authorization: Bearer <token>")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if t.role != "operator" {
+			apiError(w, http.StatusForbidden, "%s is read only", t.name)
+			return
+		}
+	default:
+		apiError(w, http.StatusMethodNotAllowed, "%s is not supported", r.Method)
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "miners" && r.Method == http.MethodGet:
+		s.listMiners(w)
+	case len(parts) == 2 && parts[0] == "miners" && r.Method == http.MethodGet:
+		s.getMiner(w, parts[1], all_details)
+	case len(parts) == 3 && parts[0] == "miners" && r.Method == http.MethodGet:
+		d, ok := map[string]detailSet{
+			"summary": {summary: true},
+			"pools":   {pools: true},
+			"devs":    {devs: true},
+			"config":  {config: true},
+			"chains":  {stats: true},
+		}[parts[2]]
+		if !ok {
+			apiError(w, http.StatusNotFound, "no such part (%s): summary, pools, devs, config or chains", parts[2])
+			return
+		}
+		s.getMiner(w, parts[1], d)
+	case len(parts) == 4 && parts[0] == "miners" && parts[2] == "actions" && r.Method == http.MethodPost:
+		s.minerAction(w, r, t, parts[1], parts[3])
+	case len(parts) == 1 && parts[0] == "scans" && r.Method == http.MethodGet:
+		s.listScans(w)
+	case len(parts) == 1 && parts[0] == "scans" && r.Method == http.MethodPost:
+		s.startScan(w, r, t)
+	case len(parts) == 2 && parts[0] == "scans" && r.Method == http.MethodGet:
+		s.getScan(w, parts[1])
+	default:
+		apiError(w, http.StatusNotFound, "no such endpoint: %s %s (see /openapi.json)", r.Method, r.URL.Path)
+	}
+}
+
+/////////////////////////////////////////////////////////////
+// Miners
+/////////////////////////////////////////////////////////////
+func (s *apiServer) listMiners(w http.ResponseWriter) {
+	records, polled, _ := s.fleet.snapshot()
+	if records == nil {
+		records = []HostRecord{}
+	}
+	writeJSON(w, http.StatusOK, struct {
+		Polled time.Time    `json:"polled"`
+		Miners []HostRecord `json:"miners"`
+	}{polled, records})
+}
+
+// The ip of a miner, by ip or MAC - "" if we do not know it.
+func (s *apiServer) resolve(id string) string {
+	if ip := net.ParseIP(id); ip.To4() != nil {
+		return ip.To4().String()
+	}
+	mac := normalizeMAC(id)
+	if mac == "" {
+		return ""
+	}
+	records, _, _ := s.fleet.snapshot()
+	for _, rec := range records {
+		if rec.MAC == mac {
+			return rec.Host
+		}
+	}
+	if !inventoryEnabled() {
+		return ""
+	}
+	inventory_mu.Lock()
+	inv, err := loadInventory()
+	inventory_mu.Unlock()
+	if err != nil {
+		return ""
+	}
+	if e := inv.lookup(mac); e != nil {
+		return e.IP
+	}
+	return ""
+}
+
+// What the last poll found on the miner - the api port for one.
+func (s *apiServer) services(ip string) []Service {
+	records, _, _ := s.fleet.snapshot()
+	for _, rec := range records {
+		if rec.Host == ip {
+			return rec.Services
+		}
+	}
+	return nil
+}
+
+func (s *apiServer) getMiner(w http.ResponseWriter, id string, d detailSet) {
+	ip := s.resolve(id)
+	if ip == "" {
+		apiError(w, http.StatusNotFound, "no miner known as %s", id)
+		return
+	}
+	rec := newRecord(ip)
+	rec.Services = s.services(ip)
+	if normalizeMAC(id) != "" {
+		rec.MAC = normalizeMAC(id)
+	}
+	addDetails(&rec, d)
+
+	status := http.StatusOK
+	rec.Miner = true
+	if len(rec.Errors) > 0 {
+		status = http.StatusBadGateway
+		rec.Miner = false
+	}
+	writeJSON(w, status, rec)
+}
+
+/////////////////////////////////////////////////////////////
+// minerAction
+// POST /miners/{id}/actions/{action} - the reply is a record
+// with action and result (ok or failed), as horus restart makes.
+/////////////////////////////////////////////////////////////
+func (s *apiServer) minerAction(w http.ResponseWriter, r *http.Request, t *apiToken, id string, action string) {
+	ip := s.resolve(id)
+	if ip == "" {
+		apiError(w, http.StatusNotFound, "no miner known as %s", id)
+		return
+	}
+
+	var body apiAction
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&body); err != nil {
+			apiError(w, http.StatusBadRequest, "body: %s", err)
+			return
+		}
+	}
+
+	// Sent as horus do sends them, so a STATUS the miner turns down is a failure.
+	command, param := action, ""
+	switch action {
+	case "restart":
+	case "switchpool", "enablepool":
+		if body.Pool == nil || *body.Pool < 0 {
+			apiError(w, http.StatusBadRequest, "%s needs {\"pool\": N}", action)
+			return
+		}
+		param = strconv.FormatInt(*body.Pool, 10)
+	case "addpool":
+		if body.URL == "" || body.User == "" {
+			apiError(w, http.StatusBadRequest, "addpool needs {\"url\": ..., \"user\": ..., \"password\": ...}")
+			return
+		}
+		// The miner api splits its parameter on commas.
+		if strings.ContainsAny(body.URL+body.User+body.Password, ",") {
+			apiError(w, http.StatusBadRequest, "addpool: url, user and password can not have commas in them")
+			return
+		}
+		if err := checkPoolUser(body.User); err != nil {
+			apiError(w, http.StatusBadRequest, "addpool: user: %s", err)
+			return
+		}
+		param = body.URL + "," + body.User + "," + body.Password
+	default:
+		apiError(w, http.StatusNotFound, "no such action (%s): restart, switchpool, addpool or enablepool", action)
+		return
+	}
+
+	rec := newRecord(ip)
+	rec.Services = s.services(ip)
+	rec.Miner = true
+	rec.Action = action
+	rec.Result = "ok"
+	status := http.StatusOK
+	msg, err := minerCommand(ip, apiPort(rec), command, param)
+	rec.Message = msg
+	if err != nil {
+		rec.Result = "failed"
+		rec.Errors = append(rec.Errors, err.Error())
+		status = http.StatusBadGateway
+	}
+
+	// Who did what - the miners do not keep a record of it.
+	detail := ""
+	if body.Pool != nil {
+		detail = " pool " + strconv.FormatInt(*body.Pool, 10)
+	}
+	if body.URL != "" {
+		detail = " " + body.URL
+	}
+	fmt.Printf("%s API: %s %s%s on %s: %s\n", time.Now().Format("15:04:05"), t.name, action, detail, ip, rec.Result)
+
+	writeJSON(w, status, rec)
+}
+
+/////////////////////////////////////////////////////////////
+// Scans
+// A scan can take minutes, so POST /scans answers at once
+// with an id to come back to.
+/////////////////////////////////////////////////////////////
+func (s *apiServer) startScan(w http.ResponseWriter, r *http.Request, t *apiToken) {
+	var body struct {
+		Targets []string `json:"targets"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&body); err != nil {
+			apiError(w, http.StatusBadRequest, "body: %s", err)
+			return
+		}
+	}
+	for _, target := range body.Targets {
+		if net.ParseIP(target).To4() == nil {
+			if ip, _, err := net.ParseCIDR(target); err != nil || ip.To4() == nil {
+				apiError(w, http.StatusBadRequest, "target (%s) is not an IPv4 address or CIDR block", target)
+				return
+			}
+		}
+	}
+
+	s.mu.Lock()
+	s.nextID++
+	scan := &apiScan{
+		ID:      strconv.Itoa(s.nextID),
+		Targets: body.Targets,
+		By:      t.name,
+		State:   "running",
+		Started: time.Now(),
+	}
+	if scan.Targets == nil {
+		scan.Targets = []string{} // the local network
+	}
+	s.scans = append(s.scans, scan)
+	s.forgetOldScans()
+	s.mu.Unlock()
+
+	fmt.Printf("%s API: %s started scan %s of %v\n", time.Now().Format("15:04:05"), t.name, scan.ID, scan.Targets)
+
+	go func() {
+		hosts := scanRecords(scanNetwork(scan.Targets))
+		now := time.Now()
+		s.mu.Lock()
+		scan.Hosts = hosts
+		scan.State = "done"
+		scan.Finished = &now
+		s.mu.Unlock()
+	}()
+
+	w.Header().Set("Location", "/scans/"+scan.ID)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	writeJSON(w, http.StatusAccepted, scan)
+}
+
+// Keep the running ones and the last few finished.  Holding s.mu.
+func (s *apiServer) forgetOldScans() {
+	done := 0
+	for _, scan := range s.scans {
+		if scan.State == "done" {
+			done++
+		}
+	}
+	kept := s.scans[:0]
+	for _, scan := range s.scans {
+		if scan.State == "done" && done > api_scans_kept {
+			done--
+			continue
+		}
+		kept = append(kept, scan)
+	}
+	s.scans = kept
+}
+
+func (s *apiServer) listScans(w http.ResponseWriter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Without the hosts - GET /scans/{id} has those.
+	list := []apiScan{}
+	for _, scan := range s.scans {
+		c := *scan
+		c.Hosts = nil
+		list = append(list, c)
+	}
+	writeJSON(w, http.StatusOK, struct {
+		Scans []apiScan `json:"scans"`
+	}{list})
+}
+
+func (s *apiServer) getScan(w http.ResponseWriter, id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, scan := range s.scans {
+		if scan.ID == id {
+			writeJSON(w, http.StatusOK, scan)
+			return
+		}
+	}
+	apiError(w, http.StatusNotFound, "no scan %s (only the last %d are kept)", id, api_scans_kept)
+}
@@ -0,0 +1,430 @@
+package main
+
+//
+// horus audit:
+// Look at every miner found the way an attacker on the same network would,
+// and list what they would find - worst first.
+//
+//	critical  api-privileged      the api takes privileged commands (addpool,
+//	                              restart, ...) from this host
+//	high      web-default-login   the web UI takes a vendor default login
+//	high      pool-address        a worker starts with a wallet address that
+//	                              is not valid (see wallet.go)
+//	medium    pool-address        ... or is for a coin not in -wallet-coins
+//	medium    stratum-plaintext   a pool is reached over plain stratum+tcp
+//	medium    firmware-outdated   the miner software is older than -min-firmware
+//	medium    ssh-open            port 22 answers
+//
+// The api only says whether *this* host is allowed privileged commands - run
+// the audit from the machine the attacker would be on (a desk, not the
+// management box that is meant to have access).
+//
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var audit_credentials string = "root:root,admin:admin,root:admin"
+var audit_min_firmware string = "cgminer=4.10.0,sgminer=5.6.0"
+var audit_web_ports string = "80"
+var audit_parallel int = 16
+
+func auditFlags(fs *flag.FlagSet) {
+	fs.StringVar(&audit_credentials, "credentials", audit_credentials, "Web UI logins to try, user:password comma separated")
+	fs.StringVar(&audit_min_firmware, "min-firmware", audit_min_firmware, "Oldest miner software that is not reported: cgminer, sgminer, bmminer or miner (the firmware version) = version, comma separated")
+	fs.StringVar(&audit_web_ports, "web-ports", audit_web_ports, "Ports to look for the web UI on (as well as any http service the scan found)")
+	fs.IntVar(&audit_parallel, "parallel", audit_parallel, "How many miners to audit at once")
+}
+
+// Worst first.
+var audit_severities = []string{"critical", "high", "medium", "low"}
+
+type auditFinding struct {
+	severity string
+	check    string
+	detail   string
+}
+
+/////////////////////////////////////////////////////////////
+// cmdAudit
+// horus audit [-credentials u:p,...] [-min-firmware ...]
+//
+//	[-web-ports 80] [-parallel 16] [IP OR CIDR_BLOCK ...]
+//
+// Exits 1 when anything critical or high is found.
+/////////////////////////////////////////////////////////////
+func cmdAudit(args []string) int {
+	creds, err := parseCredentials(audit_credentials)
+	if err != nil {
+		fmt.Printf("Error: -credentials: %s\n", err)
+		return 1
+	}
+	minimum, err := parseMinFirmware(audit_min_firmware)
+	if err != nil {
+		fmt.Printf("Error: -min-firmware (%s): %s\n", audit_min_firmware, err)
+		return 1
+	}
+	if audit_parallel < 1 {
+		fmt.Println("Error: -parallel must be at least 1")
+		return 1
+	}
+
+	m := scanTargets(args)
+	if m == nil {
+		return 1
+	}
+	records := minerRecords(m, detailSet{version: true, pools: true})
+
+	found := make([][]auditFinding, len(records))
+	sem := make(chan struct{}, audit_parallel)
+	var wg sync.WaitGroup
+	for i := range records {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			found[i] = auditMiner(records[i], creds, minimum)
+		}(i)
+	}
+	wg.Wait()
+
+	// One record per finding, worst first - a clean miner gets one "pass" record.
+	var report []HostRecord
+	counts := make(map[string]int)
+	for _, severity := range audit_severities {
+		var these []HostRecord
+		for i, findings := range found {
+			for _, f := range findings {
+				if f.severity != severity {
+					continue
+				}
+				rec := records[i]
+				rec.Action = "audit " + f.check
+				rec.Result = f.severity
+				rec.Message = f.detail
+				these = append(these, rec)
+				counts[severity]++
+			}
+		}
+		sortRecords(these)
+		report = append(report, these...)
+	}
+	var clean []HostRecord
+	for i, findings := range found {
+		if len(findings) == 0 {
+			rec := records[i]
+			rec.Action = "audit"
+			rec.Result = "pass"
+			clean = append(clean, rec)
+		}
+	}
+	sortRecords(clean)
+	report = append(report, clean...)
+
+	if !writeRecords(report) {
+		printAuditReport(report)
+		var totals []string
+		for _, severity := range audit_severities {
+			totals = append(totals, fmt.Sprintf("%d %s", counts[severity], severity))
+		}
+		fmt.Printf("\nAudit: %d miner(s), %d with nothing found - findings: %s\n", len(records), len(clean), strings.Join(totals, ", "))
+	}
+
+	if counts["critical"] > 0 || counts["high"] > 0 {
+		return 1
+	}
+	return 0
+}
+
+func sortRecords(records []HostRecord) {
+	for i := 1; i < len(records); i++ {
+		for j := i; j > 0 && ipLess(records[j].Host, records[j-1].Host); j-- {
+			records[j], records[j-1] = records[j-1], records[j]
+		}
+	}
+}
+
+func printAuditReport(report []HostRecord) {
+	fmt.Printf("\n%-8s  %-15s  %-17s  %-20s  %s\n", "SEVERITY", "IP", "MAC", "CHECK", "DETAIL")
+	for _, rec := range report {
+		check := strings.TrimPrefix(strings.TrimPrefix(rec.Action, "audit"), " ")
+		fmt.Printf("%-8s  %-15s  %-17s  %-20s  %s\n", strings.ToUpper(rec.Result), rec.Host, orDash(rec.MAC), orDash(check), rec.Message)
+	}
+}
+
+/////////////////////////////////////////////////////////////
+// auditMiner
+// Every check against one miner.
+/////////////////////////////////////////////////////////////
+func auditMiner(rec HostRecord, creds [][2]string, minimum map[string]string) []auditFinding {
+	var findings []auditFinding
+	add := func(severity string, check string, detail string) {
+		findings = append(findings, auditFinding{severity, check, detail})
+	}
+
+	if rec.Miner {
+		if msg, err := minerCommand(rec.Host, apiPort(rec), "privileged", ""); err == nil {
+			add("critical", "api-privileged", "privileged api commands are allowed from this host: "+orDash(msg))
+		}
+	}
+
+	for _, port := range auditWebPorts(rec) {
+		if login := auditWebLogin(rec.Host, port, creds); login != "" {
+			add("high", "web-default-login", fmt.Sprintf("http://%s:%s/ takes %s", rec.Host, port, login))
+		}
+	}
+
+	for _, p := range sortedByPriority(rec.Pools) {
+		addr, coin, err := walletAddress(p.User)
+		switch {
+		case err != nil:
+			add("high", "pool-address", fmt.Sprintf("pool %d %s: %s", p.Pool, p.URL, err))
+		case addr != "" && !walletCoinExpected(coin):
+			add("medium", "pool-address", fmt.Sprintf("pool %d %s: %s is a %s address - -wallet-coins is %s", p.Pool, p.URL, addr, coin, wallet_coins))
+		}
+	}
+
+	var plain []string
+	for _, p := range sortedByPriority(rec.Pools) {
+		if plaintextStratum(p.URL) {
+			plain = append(plain, p.URL)
+		}
+	}
+	if len(plain) > 0 {
+		add("medium", "stratum-plaintext", "pool traffic (and worker names) can be read and changed on the way: "+strings.Join(plain, ", "))
+	}
+
+	if rec.Version != nil {
+		if detail := outdatedFirmware(rec, minimum); detail != "" {
+			add("medium", "firmware-outdated", detail)
+		}
+	}
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(rec.Host, "22"), probe_timeout)
+	if err == nil {
+		conn.SetDeadline(time.Now().Add(probe_timeout))
+		banner, _ := probeBanner(conn, rec.Host)
+		conn.Close()
+		add("medium", "ssh-open", "ssh answers on port 22 (check the root password is not the vendor default): "+orDash(banner))
+	}
+	return findings
+}
+
+// -web-ports and the http services the scan found.
+func auditWebPorts(rec HostRecord) []string {
+	var ports []string
+	seen := make(map[string]bool)
+	for _, p := range strings.Split(audit_web_ports, ",") {
+		if p = strings.TrimSpace(p); p != "" && !seen[p] {
+			seen[p] = true
+			ports = append(ports, p)
+		}
+	}
+	for _, s := range rec.Services {
+		if s.Profile == "http" && !seen[s.Port] {
+			seen[s.Port] = true
+			ports = append(ports, s.Port)
+		}
+	}
+	return ports
+}
+
+func plaintextStratum(url string) bool {
+	url = strings.ToLower(url)
+	for _, secure := range []string{"stratum+ssl://", "stratum+tls://", "stratum2+tcp://", "ssl://", "tls://"} {
+		if strings.HasPrefix(url, secure) {
+			return false
+		}
+	}
+	return url != ""
+}
+
+/////////////////////////////////////////////////////////////
+// auditWebLogin
+// Ask for the web UI without a login.  If it wants one (401)
+// try each of -credentials, with basic or digest auth - as
+// the page asks.  Returns the user:password that got in.
+/////////////////////////////////////////////////////////////
+func auditWebLogin(ip string, port string, creds [][2]string) string {
+	client := &http.Client{
+		Timeout:       probe_timeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	url := fmt.Sprintf("http://%s/", net.JoinHostPort(ip, port))
+
+	resp, err := client.Get(url)
+	if err != nil {
+		return ""
+	}
+	resp.Body.Close()
+	challenge := resp.Header.Get("WWW-Authenticate")
+	if resp.StatusCode != http.StatusUnauthorized || challenge == "" {
+		return "" // no http login - a login form is not tried
+	}
+
+	for _, c := range creds {
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			return ""
+		}
+		if strings.HasPrefix(strings.ToLower(challenge), "digest") {
+			req.Header.Set("Authorization", digestAuthorization(challenge, "GET", "/", c[0], c[1]))
+		} else {
+			req.SetBasicAuth(c[0], c[1])
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return ""
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized && resp.StatusCode < 500 {
+			return c[0] + ":" + c[1]
+		}
+	}
+	return ""
+}
+
+var digest_param_re = regexp.MustCompile(`(\w+)=(?:"([^"]*)"|([^,\s]*))`)
+
+/////////////////////////////////////////////////////////////
+// digestAuthorization
+// RFC 2617 digest auth (MD5, qop auth) - what the Antminer
+// web UI asks for.
+/////////////////////////////////////////////////////////////
+func digestAuthorization(challenge string, method string, uri string, user string, password string) string {
+	params := make(map[string]string)
+	for _, m := range digest_param_re.FindAllStringSubmatch(challenge, -1) {
+		params[strings.ToLower(m[1])] = m[2] + m[3]
+	}
+	hash := func(s string) string {
+		sum := md5.Sum([]byte(s))
+		return hex.EncodeToString(sum[:])
+	}
+
+	ha1 := hash(user + ":" + params["realm"] + ":" + password)
+	ha2 := hash(method + ":" + uri)
+	header := fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s"`, user, params["realm"], params["nonce"], uri)
+
+	qop := ""
+	for _, q := range strings.Split(params["qop"], ",") {
+		if strings.TrimSpace(q) == "auth" {
+			qop = "auth"
+		}
+	}
+	if qop == "" {
+		header += fmt.Sprintf(`, response="%s"`, hash(ha1+":"+params["nonce"]+":"+ha2))
+	} else {
+		b := make([]byte, 8)
+		rand.Read(b)
+		cnonce := hex.EncodeToString(b)
+		response := hash(ha1 + ":" + params["nonce"] + ":00000001:" + cnonce + ":auth:" + ha2)
+		header += fmt.Sprintf(`, qop=auth, nc=00000001, cnonce="%s", response="%s"`, cnonce, response)
+	}
+	if params["opaque"] != "" {
+		header += fmt.Sprintf(`, opaque="%s"`, params["opaque"])
+	}
+	if params["algorithm"] != "" {
+		header += ", algorithm=" + params["algorithm"]
+	}
+	return header
+}
+
+func parseCredentials(spec string) ([][2]string, error) {
+	var creds [][2]string
+	for _, c := range strings.Split(spec, ",") {
+		if c = strings.TrimSpace(c); c == "" {
+			continue
+		}
+		i := strings.Index(c, ":")
+		if i < 1 {
+			return nil, fmt.Errorf("%s is not user:password", c)
+		}
+		creds = append(creds, [2]string{c[:i], c[i+1:]})
+	}
+	return creds, nil
+}
+
+func parseMinFirmware(spec string) (map[string]string, error) {
+	minimum := make(map[string]string)
+	for _, item := range strings.Split(spec, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 || versionParts(parts[1]) == nil {
+			return nil, fmt.Errorf("%s is not name=version", item)
+		}
+		switch name := strings.ToLower(parts[0]); name {
+		case "cgminer", "sgminer", "bmminer", "miner":
+			minimum[name] = parts[1]
+		default:
+			return nil, fmt.Errorf("%s: want cgminer, sgminer, bmminer or miner", parts[0])
+		}
+	}
+	return minimum, nil
+}
+
+// Which of the miner's software is older than -min-firmware, "" if none.
+func outdatedFirmware(rec HostRecord, minimum map[string]string) string {
+	v := rec.Version
+	have := map[string]string{"cgminer": v.CGMiner, "sgminer": v.SGMiner, "bmminer": v.BMMiner, "miner": v.Miner}
+
+	var old []string
+	for _, name := range []string{"cgminer", "sgminer", "bmminer", "miner"} {
+		if have[name] == "" || minimum[name] == "" {
+			continue
+		}
+		if versionLess(have[name], minimum[name]) {
+			old = append(old, fmt.Sprintf("%s %s (want %s or later)", name, have[name], minimum[name]))
+		}
+	}
+	return strings.Join(old, ", ")
+}
+
+var version_re = regexp.MustCompile(`\d+(\.\d+)*`)
+
+// The first dotted number in a version string: "4.9.2-abc" -> 4 9 2.
+func versionParts(s string) []int {
+	m := version_re.FindString(s)
+	if m == "" {
+		return nil
+	}
+	var parts []int
+	for _, p := range strings.Split(m, ".") {
+		n, _ := strconv.Atoi(p)
+		parts = append(parts, n)
+	}
+	return parts
+}
+
+func versionLess(a string, b string) bool {
+	pa, pb := versionParts(a), versionParts(b)
+	if pa == nil || pb == nil {
+		return false // can not tell
+	}
+	for i := 0; i < len(pa) || i < len(pb); i++ {
+		x, y := 0, 0
+		if i < len(pa) {
+			x = pa[i]
+		}
+		if i < len(pb) {
+			y = pb[i]
+		}
+		if x != y {
+			return x < y
+		}
+	}
+	return false
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// A web UI that takes root:root and nothing else.  challenge is what it
+// sends with the 401: Basic, or Digest with or without qop=auth.
+func loginStub(t *testing.T, challenge string) (string, string) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if challenge == "" || loginOK(r, challenge) {
+			fmt.Fprint(w, "<title>Miner Status</title>")
+			return
+		}
+		w.Header().Set("WWW-Authenticate", challenge)
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	t.Cleanup(ts.Close)
+
+	ip, port, err := net.SplitHostPort(strings.TrimPrefix(ts.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ip, port
+}
+
+func loginOK(r *http.Request, challenge string) bool {
+	if strings.HasPrefix(challenge, "Basic") {
+		user, password, ok := r.BasicAuth()
+		return ok && user == "root" && password == "root"
+	}
+
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Digest ") {
+		return false
+	}
+	p := make(map[string]string)
+	for _, kv := range strings.Split(strings.TrimPrefix(auth, "Digest "), ", ") {
+		if i := strings.Index(kv, "="); i > 0 {
+			p[kv[:i]] = strings.Trim(kv[i+1:], `"`)
+		}
+	}
+	md5hex := func(s string) string {
+		sum := md5.Sum([]byte(s))
+		return hex.EncodeToString(sum[:])
+	}
+	ha1 := md5hex("root:antMiner Configuration:root")
+	ha2 := md5hex(r.Method + ":" + p["uri"])
+	want := md5hex(ha1 + ":" + p["nonce"] + ":" + ha2)
+	if strings.Contains(challenge, "qop") {
+		if p["qop"] != "auth" || p["nc"] == "" || p["cnonce"] == "" {
+			return false
+		}
+		want = md5hex(ha1 + ":" + p["nonce"] + ":" + p["nc"] + ":" + p["cnonce"] + ":auth:" + ha2)
+	}
+	return p["username"] == "root" && p["realm"] == "antMiner Configuration" &&
+		p["nonce"] == "dcd98b7102dd2f0e8b11d0f600bfb0c0" && p["uri"] == r.URL.Path && p["response"] == want
+}
+
+func TestAuditWebLogin(t *testing.T) {
+	defaults := [][2]string{{"admin", "admin"}, {"root", "admin"}, {"root", "root"}}
+	wrong := [][2]string{{"admin", "admin"}, {"root", "admin"}}
+
+	challenges := map[string]string{
+		"basic":           `Basic realm="antMiner Configuration"`,
+		"digest qop=auth": `Digest realm="antMiner Configuration", nonce="dcd98b7102dd2f0e8b11d0f600bfb0c0", qop="auth", opaque="5ccc069c403ebaf9f0171e9517f40e41"`,
+		"digest, no qop":  `Digest realm="antMiner Configuration", nonce="dcd98b7102dd2f0e8b11d0f600bfb0c0"`,
+		"digest qop list": `Digest realm="antMiner Configuration", nonce="dcd98b7102dd2f0e8b11d0f600bfb0c0", qop="auth,auth-int", algorithm=MD5`,
+	}
+	for name, challenge := range challenges {
+		ip, port := loginStub(t, challenge)
+		if got := auditWebLogin(ip, port, defaults); got != "root:root" {
+			t.Errorf("%s: got %q, want root:root", name, got)
+		}
+		if got := auditWebLogin(ip, port, wrong); got != "" {
+			t.Errorf("%s: got in with %q, want no login", name, got)
+		}
+	}
+
+	// No login at all is not a default login.
+	ip, port := loginStub(t, "")
+	if got := auditWebLogin(ip, port, defaults); got != "" {
+		t.Errorf("no login: got %q, want nothing", got)
+	}
+}
+
+func TestVersionLess(t *testing.T) {
+	tests := []struct {
+		a, b string
+		less bool
+	}{
+		{"4.9.2", "4.10.0", true},
+		{"4.10.0", "4.9.2", false},
+		{"4.10", "4.10.0", false},
+		{"4.10.0", "4.10", false},
+		{"4.10", "4.10.1", true},
+		{"bmminer 2.0.0-abc", "2.0.1", true},
+		{"5.6.0", "5.6.0", false},
+		{"unknown", "4.10.0", false},
+		{"4.9.2", "", false},
+	}
+	for _, tt := range tests {
+		if got := versionLess(tt.a, tt.b); got != tt.less {
+			t.Errorf("versionLess(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.less)
+		}
+	}
+}
+
+func TestParseMinFirmware(t *testing.T) {
+	got, err := parseMinFirmware(" CGMiner=4.10.0, bmminer=2.0.0,,miner=1.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"cgminer": "4.10.0", "bmminer": "2.0.0", "miner": "1.1"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	for _, bad := range []string{"cgminer", "cgminer=new", "xminer=1.0", "=4.10"} {
+		if _, err := parseMinFirmware(bad); err == nil {
+			t.Errorf("%q: want an error", bad)
+		}
+	}
+}
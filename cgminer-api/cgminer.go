@@ -3,6 +3,10 @@ package cgminer
 // Howie's Version. 1.1 - 2018-07-22
 // Version 1.2 - added config struct and a few repairs 
 //				 added debug bool to show debug info from each command. 
+// Version 1.3 - added version command (Antminer puts its model in here)
+// Version 1.4 - RunCommand exported so any api command can be sent (horus exec)
+// Version 1.5 - connect and reply timeouts - a miner that accepts and never answers
+//				 used to hang us forever.
 
 
 import (
@@ -12,13 +16,20 @@ import (
 	"fmt"
 	"net"
 	"strings"
+	"strconv"
 	"bytes"
+	"time"
 )
 
 var debug2 bool = false			// make false to see debug output. 
 
+// How long a command (connect, send, reply) may take before we give up.
+// New miners get this - change it with SetTimeout.
+var DefaultTimeout = 10 * time.Second
+
 type CGMiner struct {
 	server 					string
+	timeout 				time.Duration
 }
 
 /* Original status structure... */
@@ -225,6 +236,18 @@ type Config struct {
 	Expirey 				int64 		`json:"Expiry"`			// =N| <- --expiry setting
 }
 
+// Version - cgminer, sgminer and bmminer all answer "version", but name
+// the miner software field after themselves.  Antminers add the model (Type).
+type Version struct {
+	CGMiner 				string 		`json:"CGMiner"`
+	SGMiner 				string 		`json:"SGMiner"`
+	BMMiner 				string 		`json:"BMMiner"`
+	API 					string 		`json:"API"`
+	Miner 					string 		`json:"Miner"`			// firmware version
+	CompileTime 			string 		`json:"CompileTime"`
+	Type 					string 		`json:"Type"`			// model - "Antminer S9"
+}
+
 type summaryResponse struct {
 	Status  []status  `json:"STATUS"`
 	Summary []Summary `json:"SUMMARY"`
@@ -249,6 +272,19 @@ type configResponse struct {
 	Id     	int64     `json:"id"`
 }
 
+type versionResponse struct {
+	Status  []status  `json:"STATUS"`
+	Version []Version `json:"VERSION"`
+	Id     	int64     `json:"id"`
+}
+
+// STATS objects differ from one firmware to the next, so they are kept as they come.
+type statsResponse struct {
+	Status  []status                 `json:"STATUS"`
+	Stats   []map[string]interface{} `json:"STATS"`
+	Id      int64                    `json:"id"`
+}
+
 type addPoolResponse struct {
 	Status []status `json:"STATUS"`
 	Id     int64    `json:"id"`
@@ -260,18 +296,34 @@ func New(hostname string, port int64) *CGMiner {
 	miner := new(CGMiner)
 	server := fmt.Sprintf("%s:%d", hostname, port)
 	miner.server = server
+	miner.timeout = DefaultTimeout
 
 	return miner
 }
 
+// SetTimeout changes how long each command may take (0 means wait forever).
+func (miner *CGMiner) SetTimeout(timeout time.Duration) {
+	miner.timeout = timeout
+}
+
 // Send a command to the miner and send the response back as a string. 
 func (miner *CGMiner) runCommand(command, argument string) (string, error) {
-	conn, err := net.Dial("tcp", miner.server)
+	var conn net.Conn
+	var err error
+	if miner.timeout > 0 {
+		conn, err = net.DialTimeout("tcp", miner.server, miner.timeout)
+	} else {
+		conn, err = net.Dial("tcp", miner.server)
+	}
 	if err != nil {
 		return "", err
 	}
 	defer conn.Close()
 
+	if miner.timeout > 0 {
+		conn.SetDeadline(time.Now().Add(miner.timeout))
+	}
+
 	type commandRequest struct {
 		Command   string `json:"command"`
 		Parameter string `json:"parameter,omitempty"`
@@ -298,6 +350,12 @@ func (miner *CGMiner) runCommand(command, argument string) (string, error) {
 	return strings.TrimRight(result, "\x00"), nil
 }
 
+// RunCommand sends any api command (with an optional parameter) and returns
+// the raw json reply.  Use the typed calls below when there is one.
+func (miner *CGMiner) RunCommand(command, argument string) (string, error) {
+	return miner.runCommand(command, argument)
+}
+
 // Format the json to be readable - it is hard to read for debugging all jammed together. 
 func prettyprint(b []byte) ([]byte, error) {
 	var out bytes.Buffer
@@ -401,9 +459,35 @@ func (miner *CGMiner) Summary() (*Summary, error) {
 	}
 
 	var summary = summaryResponse.Summary[0]
+
+	// bmminer (Antminers) sends GH/s and no MHS at all - "GHS 5s" as
+	// "13,520.45" as often as a number.
+	if summary.MHS5s == 0 && summary.MHSav == 0 {
+		var ghsResponse struct {
+			Summary []map[string]interface{} `json:"SUMMARY"`
+		}
+		if json.Unmarshal([]byte(result), &ghsResponse) == nil && len(ghsResponse.Summary) == 1 {
+			summary.MHS5s = ghsToMHS(ghsResponse.Summary[0]["GHS 5s"])
+			summary.MHSav = ghsToMHS(ghsResponse.Summary[0]["GHS av"])
+		}
+	}
 	return &summary, err
 }
 
+// A GH/s figure, number or string, in MH/s - 0 when there is none.
+func ghsToMHS(v interface{}) float64 {
+	switch v := v.(type) {
+	case float64:
+		return v * 1000
+	case string:
+		ghs, err := strconv.ParseFloat(strings.Replace(strings.TrimSpace(v), ",", "", -1), 64)
+		if err == nil {
+			return ghs * 1000
+		}
+	}
+	return 0
+}
+
 // 
 // Config returns result of "config" command from the miner. 
 // See the Config struct.
@@ -437,6 +521,39 @@ func (miner *CGMiner) Config() (*Config, error) {
 	return &config, err
 }
 
+// 
+// Version returns result of "version" command from the miner. 
+// See the Version struct.
+//
+func (miner *CGMiner) Version() (*Version, error) {
+	result, err := miner.runCommand("version", "")
+	if err != nil {
+		return nil, err
+	}
+
+	// Lets see the result so we can break it apart. 
+	if debug2 {
+		fmt.Printf("... DEBUG: IN cgminer.version -- Json Result from Version command: \n\n")
+		b := []byte(result)
+		b, _ = prettyprint(b)
+		fmt.Printf("%s", b)
+		fmt.Printf("\n... END OF DEBUG\n\n\n")
+	}
+
+	var versionResponse versionResponse
+	err = json.Unmarshal([]byte(result), &versionResponse)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(versionResponse.Version) != 1 {
+		return nil, errors.New("Received multiple Version objects")
+	}
+
+	var version = versionResponse.Version[0]
+	return &version, err
+}
+
 // 
 // Pools returns result of "pools" command from the miner. 
 // one slice per pool. 
@@ -467,6 +584,38 @@ func (miner *CGMiner) Pools() ([]Pool, error) {
 	return pools, nil
 }
 
+// 
+// Stats returns result of "stats" command from the miner. 
+// one map per STATS object - the keys are whatever the firmware sends
+// (Antminers put their chain_acn, chain_acs, chain_rate ... in the second).
+//
+func (miner *CGMiner) Stats() ([]map[string]interface{}, error) {
+	result, err := miner.runCommand("stats", "")
+	if err != nil {
+		return nil, err
+	}
+
+	// Lets see the result so we can break it apart. 
+	if debug2 {
+		fmt.Printf("... DEBUG: IN cgminer.stats -- Json Result from Stats command: \n\n")
+		b := []byte(result)
+		b, _ = prettyprint(b)
+		fmt.Printf("%s", b)
+		fmt.Printf("\n... END OF DEBUG\n\n\n")
+	}
+
+	// bmminer leaves the comma out between its STATS objects.
+	result = strings.Replace(result, "}{", "},{", -1)
+
+	var statsResponse statsResponse
+	err = json.Unmarshal([]byte(result), &statsResponse)
+	if err != nil {
+		return nil, err
+	}
+
+	return statsResponse.Stats, nil
+}
+
 // AddPool adds the given URL/username/password combination to the miner's
 // pool list.
 func (miner *CGMiner) AddPool(url, username, password string) error {
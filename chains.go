@@ -0,0 +1,334 @@
+package main
+
+//
+// horus chains:
+// An Antminer with a dead hash board keeps answering the api, keeps its
+// devices Alive and just hashes a third slower.  The board detail is only in
+// "stats": for each chain N
+//
+//	chain_acnN     how many chips the chain found
+//	chain_acsN     one letter per chip - o is good, x is bad, - is missing
+//	chain_rateN    what the chain hashes, in GH/s
+//	tempN/temp2_N  board and chip temperature (S9), or
+//	temp_pcbN      "45-44-62-61" - board and chip sensors (S17 and later)
+//	temp_chipN
+//
+// From those each chain gets its chips, the missing and bad ones, dead (no
+// chips, no good chips, or not hashing while the others are) and how much
+// hotter it runs than the coolest chain of the miner.  The chains go into
+// every record that asks for stats, so alert rules can use them (Chains.X -
+// see ALERTS.md), and horus chains lists them with their problems.
+//
+// A chain should have as many chips as the best chain of the same miner.  A
+// model in chain_counts should have that many chains - the ones it does not
+// report at all are listed as dead, numbered after the last one it does.
+//
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var chains_max_spread float64 = 10
+
+func chainsFlags(fs *flag.FlagSet) {
+	fs.Float64Var(&chains_max_spread, "max-spread", chains_max_spread, "Most a chain may run above the coolest chain of the same miner, in C")
+}
+
+// One hash board, as the stats reply tells it.
+type ChainStat struct {
+	Chain     int     `json:"chain"`             // N in chain_acnN
+	Chips     int     `json:"chips"`             // chain_acn: chips found
+	Expected  int     `json:"expected"`          // chips the best chain of the miner has
+	Missing   int     `json:"missing"`           // expected less found, or the - in chain_acs
+	Bad       int     `json:"bad"`               // the x in chain_acs
+	Dead      bool    `json:"dead"`              // no chips, no good chips, or not hashing while the others are
+	MHS       float64 `json:"mhs"`               // chain_rate, in MH/s
+	TempPCB   float64 `json:"temp_pcb"`          // hottest board sensor
+	TempChip  float64 `json:"temp_chip"`         // hottest chip sensor
+	TempDelta float64 `json:"temp_delta"`        // above the coolest live chain of the miner
+	Status    string  `json:"status,omitempty"`  // chain_acs as sent
+	Problem   string  `json:"problem,omitempty"` // what horus chains reports
+}
+
+// How many hash boards each model has.  Longest name that matches wins.
+var chain_counts = map[string]int{
+	"Antminer S9":  3,
+	"Antminer T9":  3,
+	"Antminer S17": 3,
+	"Antminer T17": 3,
+	"Antminer S19": 3,
+	"Antminer T19": 3,
+	"Antminer L3+": 4,
+	"Antminer D3":  3,
+	"Antminer DR5": 3,
+	"Antminer Z9":  3,
+}
+
+/////////////////////////////////////////////////////////////
+// parseChains
+// The chains in a stats reply (nil when there are none -
+// only bmminer style firmware sends them).
+/////////////////////////////////////////////////////////////
+func parseChains(stats []map[string]interface{}) []ChainStat {
+	// Antminers split the reply in two: the versions, then everything else.
+	all := make(map[string]interface{})
+	for _, s := range stats {
+		for k, v := range s {
+			all[k] = v
+		}
+	}
+
+	slots := make(map[int]bool)
+	for k := range all {
+		for _, prefix := range []string{"chain_acn", "chain_acs"} {
+			if strings.HasPrefix(k, prefix) {
+				if n, err := strconv.Atoi(k[len(prefix):]); err == nil {
+					slots[n] = true
+				}
+			}
+		}
+	}
+
+	var chains []ChainStat
+	rated := make(map[int]bool)
+	for n := range slots {
+		key := strconv.Itoa(n)
+		c := ChainStat{Chain: n}
+		chips, _ := statNumber(all["chain_acn"+key])
+		c.Chips = int(chips)
+		c.Status, _ = all["chain_acs"+key].(string)
+		if ghs, ok := statNumber(all["chain_rate"+key]); ok {
+			c.MHS = ghs * 1000
+			rated[n] = true
+		}
+		if _, ok := all["temp_pcb"+key]; ok {
+			c.TempPCB = statTemp(all["temp_pcb"+key])
+			c.TempChip = statTemp(all["temp_chip"+key])
+		} else {
+			c.TempPCB = statTemp(all["temp"+key])
+			c.TempChip = statTemp(all["temp2_"+key])
+		}
+
+		// The S9 sends all 16 slots - the empty ones have nothing at all.
+		if c.Chips == 0 && strings.TrimSpace(c.Status) == "" && c.MHS == 0 && c.TempPCB == 0 && c.TempChip == 0 {
+			continue
+		}
+		chains = append(chains, c)
+	}
+	if len(chains) == 0 {
+		return nil
+	}
+	sort.Slice(chains, func(i, j int) bool { return chains[i].Chain < chains[j].Chain })
+
+	expected := 0
+	hashing := false
+	for _, c := range chains {
+		if n := len(strings.Join(strings.Fields(c.Status), "")); n > expected {
+			expected = n
+		}
+		if c.Chips > expected {
+			expected = c.Chips
+		}
+		if c.MHS > 0 {
+			hashing = true
+		}
+	}
+
+	for i := range chains {
+		c := &chains[i]
+		c.Expected = expected
+		c.Bad = strings.Count(c.Status, "x")
+		c.Missing = expected - c.Chips
+		if dashes := strings.Count(c.Status, "-"); dashes > c.Missing {
+			c.Missing = dashes
+		}
+		good := strings.Count(c.Status, "o")
+		switch {
+		case c.Chips == 0:
+			c.Dead, c.Problem = true, "dead: no chips found"
+		case c.Status != "" && good == 0:
+			c.Dead, c.Problem = true, "dead: no good chips"
+		case rated[c.Chain] && c.MHS == 0 && hashing:
+			c.Dead, c.Problem = true, "dead: not hashing"
+		}
+	}
+
+	// The boards the model has and the miner did not report at all.
+	if model, ok := all["Type"].(string); ok {
+		if want := modelChains(model); want > len(chains) {
+			last := chains[len(chains)-1].Chain
+			for i := len(chains); i < want; i++ {
+				last++
+				chains = append(chains, ChainStat{Chain: last, Expected: expected, Missing: expected, Dead: true,
+					Problem: fmt.Sprintf("dead: not reported (the %s has %d chains)", model, want)})
+			}
+		}
+	}
+
+	// Hotter than the coolest chain that is hashing - a dead chain runs cold.
+	coolest := 0.0
+	for _, c := range chains {
+		if t := chainTemp(c); !c.Dead && t > 0 && (coolest == 0 || t < coolest) {
+			coolest = t
+		}
+	}
+	for i := range chains {
+		c := &chains[i]
+		if t := chainTemp(*c); coolest > 0 && t > coolest {
+			c.TempDelta = t - coolest
+		}
+		if c.Dead {
+			continue
+		}
+		var problems []string
+		if c.Missing > 0 {
+			problems = append(problems, fmt.Sprintf("%d of %d chips missing", c.Missing, expected))
+		}
+		if c.Bad > 0 {
+			problems = append(problems, fmt.Sprintf("%d bad chip(s)", c.Bad))
+		}
+		if c.TempDelta > chains_max_spread {
+			problems = append(problems, fmt.Sprintf("%.0fC above the coolest chain", c.TempDelta))
+		}
+		c.Problem = strings.Join(problems, ", ")
+	}
+	return chains
+}
+
+// The chip sensor when there is one, the board sensor when not.
+func chainTemp(c ChainStat) float64 {
+	if c.TempChip > 0 {
+		return c.TempChip
+	}
+	return c.TempPCB
+}
+
+func modelChains(model string) int {
+	best, count := "", 0
+	lower := strings.ToLower(model)
+	for name, n := range chain_counts {
+		if strings.Contains(lower, strings.ToLower(name)) && len(name) > len(best) {
+			best, count = name, n
+		}
+	}
+	return count
+}
+
+// Firmware sends numbers as numbers or as strings ("4540.12").
+func statNumber(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// A temperature, or the hottest of "45-44-62-61".
+func statTemp(v interface{}) float64 {
+	if s, ok := v.(string); ok && strings.Contains(s, "-") {
+		hottest := 0.0
+		for _, part := range strings.Split(s, "-") {
+			if t, err := strconv.ParseFloat(strings.TrimSpace(part), 64); err == nil && t > hottest {
+				hottest = t
+			}
+		}
+		return hottest
+	}
+	t, _ := statNumber(v)
+	return t
+}
+
+// What is wrong with the miner's chains, one line.
+func chainProblems(chains []ChainStat) string {
+	var problems []string
+	for _, c := range chains {
+		if c.Problem != "" {
+			problems = append(problems, fmt.Sprintf("chain %d: %s", c.Chain, c.Problem))
+		}
+	}
+	return strings.Join(problems, "; ")
+}
+
+/////////////////////////////////////////////////////////////
+// cmdChains
+// horus chains [-max-spread 10] [IP OR CIDR_BLOCK ...]
+//
+// Exits 1 if any chain has a problem.
+/////////////////////////////////////////////////////////////
+func cmdChains(args []string) int {
+	if chains_max_spread <= 0 {
+		fmt.Println("Error: -max-spread must be more than zero")
+		return 1
+	}
+
+	m := scanTargets(args)
+	if m == nil {
+		return 1
+	}
+	records := minerRecords(m, detailSet{version: true, stats: true})
+
+	bad := 0
+	for i := range records {
+		rec := &records[i]
+		rec.Action = "chains"
+		rec.Message = chainProblems(rec.Chains)
+		switch {
+		case rec.Chains == nil:
+			rec.Result = "no-chains"
+		case rec.Message != "":
+			rec.Result = "problem"
+			bad++
+		default:
+			rec.Result = "ok"
+		}
+	}
+
+	if writeRecords(records) {
+		return chainsExit(bad)
+	}
+
+	fmt.Printf("\n%-15s  %-18s  %5s  %9s  %7s  %3s  %10s  %5s  %5s  %s\n", "IP", "MODEL", "CHAIN", "CHIPS", "MISSING", "BAD", "RATE", "PCB", "CHIP", "PROBLEM")
+	none := 0
+	for _, rec := range records {
+		if rec.Chains == nil {
+			none++
+			continue
+		}
+		model := "-"
+		if rec.Version != nil && rec.Version.Type != "" {
+			model = rec.Version.Type
+		}
+		for _, c := range rec.Chains {
+			fmt.Printf("%-15s  %-18s  %5d  %4d/%-4d  %7d  %3d  %10s  %5s  %5s  %s\n", rec.Host, fit(model, 18), c.Chain,
+				c.Chips, c.Expected, c.Missing, c.Bad, formatHashrate(c.MHS), chainCelsius(c.TempPCB), chainCelsius(c.TempChip), orDash(c.Problem))
+		}
+	}
+
+	fmt.Printf("\n%d miner(s): %d with chain problems", len(records)-none, bad)
+	if none > 0 {
+		fmt.Printf(", %d more do not report chains", none)
+	}
+	fmt.Println(".")
+	return chainsExit(bad)
+}
+
+func chainsExit(bad int) int {
+	if bad > 0 {
+		return 1
+	}
+	return 0
+}
+
+func chainCelsius(t float64) string {
+	if t == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.0fC", t)
+}
@@ -0,0 +1,562 @@
+package main
+
+//
+// Command line:
+//	horus [global options] [command] [command options] [IP OR CIDR_BLOCK ...]
+//
+// Global options can go before or after the command.  With no command we
+// do what horus always did - find the miners and show what they are up to.
+//
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"cgminer-api"
+)
+
+const default_command = "info"
+
+type command struct {
+	name  string
+	args  string                  // synopsis after the command name
+	help  string                  // one line for the usage message
+	flags func(fs *flag.FlagSet)  // the command's own options (may be nil)
+	run   func(args []string) int // returns the exit status
+}
+
+var commands = []*command{
+	{"scan", "[IP OR CIDR_BLOCK ...]", "Find the miners (and anything else on -ports) and report what answered", nil, cmdScan},
+	{"info", "[IP OR CIDR_BLOCK ...]", "Scan, then show summary, config, devs and pools for every miner found", nil, cmdInfo},
+	{"pools", "[plan | apply [-f pools.conf] [-racks file] [-y] | check [-f pools.conf] | baseline [-f pools.conf]] [IP OR CIDR_BLOCK ...]", "Show the pools of every miner found - plan and apply the pools they should have, check the pools answer, or approve the pools they have for -pool-guard", nil, cmdPools},
+	{"devs", "[IP OR CIDR_BLOCK ...]", "Scan, then show the devices of every miner found", nil, cmdDevs},
+	{"exec", "[-param P] <api command> [IP OR CIDR_BLOCK ...]", "Send any api command to every miner found and show the reply", execFlags, cmdExec},
+	{"restart", "[-y] [-rolling [-batch 10] [-wait-healthy 5m] [-healthy 0.9]] <IP OR CIDR_BLOCK ...>", "Restart every miner found, or a batch at a time (asks first unless -y)", restartFlags, cmdRestart},
+	{"do", "[-parallel 16] [-dry-run] [-y] [-continue-on-error | -max-failures N] <action> [params] <IP OR CIDR_BLOCK ...>", "Restart, switch, add, enable, disable or remove pools on many miners at once - with a result for each", doFlags, cmdDo},
+	{"watch", "[-interval 60s] [-missed 2] [IP OR CIDR_BLOCK ...]", "Scan and poll every interval, report miners appearing, rebooting, changing pool ... (until Ctrl-C)", watchFlags, cmdWatch},
+	{"listen", "[-udp 14235,...] [-for duration]", "Wait for miners to announce themselves (the IP Report button) and query them", listenFlags, cmdListen},
+	{"inventory", "list | show <MAC OR IP> | forget <MAC OR IP> ...", "The register of every miner ever seen: addresses, model, firmware, pools, health", nil, cmdInventory},
+	{"exporter", "[-listen :9428] [-interval 30s] [-rescan 10m] [IP OR CIDR_BLOCK ...]", "Serve Prometheus metrics for the miners found (/metrics and /probe?target=)", exporterFlags, cmdExporter},
+	{"serve", "[-listen :8080] [-interval 30s] [-rescan 10m] [-racks file] [IP OR CIDR_BLOCK ...]", "Web dashboard for the miners found: live table, miner pages, rack heatmap", serveFlags, cmdServe},
+	{"top", "[-interval 10s] [-sort hashrate] [-filter ...] [-tags file] [IP OR CIDR_BLOCK ...]", "Full screen live view of the miners: sort, filter, drill in, switch pool, restart", topFlags, cmdTop},
+	{"audit", "[-credentials u:p,...] [-min-firmware cgminer=4.10.0,...] [-web-ports 80] [IP OR CIDR_BLOCK ...]", "Check every miner found for risky exposure - privileged api, default web logins, plain stratum, old firmware, ssh - worst first", auditFlags, cmdAudit},
+	{"chains", "[-max-spread 10] [IP OR CIDR_BLOCK ...]", "Show the hash chains of every Antminer found - missing chips, dead chains, chains running hot", chainsFlags, cmdChains},
+	{"triage", "[-racks file] [-models file] [-max-temp 85] [-max-spread 10] [-top 20] [IP OR CIDR_BLOCK ...]", "Score the health of every miner found and list the worst first, with why", triageFlags, cmdTriage},
+	{"api", "-tokens file [-listen :8081] [-tls-cert file -tls-key file] [IP OR CIDR_BLOCK ...]", "REST api over the scanner and the miners, for other programs (see API.md)", apiFlags, cmdAPI},
+}
+
+// Global options - shared by every command.
+var show_version bool = false
+var site_name string = ""
+var output_format string = "table"
+var output_formats = []string{"table", "json", "ndjson", "csv", "yaml"} // see output.go
+
+/////////////////////////////////////////////////////////////
+// globalFlags
+// Register the options every command understands.  The current
+// value is the default, so options given before the command are
+// not reset when the command's own flag set is built.
+/////////////////////////////////////////////////////////////
+func globalFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&debug, "d", debug, "Add DEBUG information to results")
+	fs.BoolVar(&show_version, "v", show_version, "Display Program Version and Exit")
+	fs.DurationVar(&connection_timeout, "timeout", connection_timeout, "Connection timeout for each port checked")
+	fs.StringVar(&port_spec, "ports", port_spec, "Ports to check - ranges and probe profiles allowed: 22,80,4028,8080:http,8000-8010:tcp")
+	fs.IntVar(&scan_rate, "rate", scan_rate, "Maximum connection attempts per second (0: no limit)")
+	fs.IntVar(&scan_workers, "workers", scan_workers, "Maximum concurrent connections (0: sized from the open file limit)")
+	fs.StringVar(&oui_file, "oui", oui_file, "IEEE oui.txt (or nmap / wireshark mac prefix file) used to name MAC vendors")
+	fs.StringVar(&output_format, "output", output_format, "Output format: "+strings.Join(output_formats, "|"))
+	fs.StringVar(&inventory_file, "inventory", inventory_file, "Inventory file kept up to date by every scan (default: in the user config dir, none: do not keep one)")
+	fs.StringVar(&rules_file, "rules", rules_file, "Alert rules checked after every poll by watch and exporter (see ALERTS.md)")
+	fs.StringVar(&notify_file, "notify", notify_file, "Channels (webhook, slack, smtp, mqtt) to send watch events and alerts to (see NOTIFY.md)")
+	fs.StringVar(&pool_guard, "pool-guard", pool_guard, "Check the miners' pools against the approved ones (horus pools baseline): off|alert|revert")
+	fs.StringVar(&pool_baseline_file, "pool-baseline", pool_baseline_file, "Approved pools file (default: in the user config dir)")
+	fs.Float64Var(&pool_guard_share, "pool-share", pool_guard_share, "Pool guard: largest share of -pool-window allowed on pools that are not approved")
+	fs.DurationVar(&pool_guard_window, "pool-window", pool_guard_window, "Pool guard: how far back -pool-share looks")
+	fs.StringVar(&wallet_coins, "wallet-coins", wallet_coins, "Coins pool workers may pay to: btc, ltc, dcr, tbtc, tltc, tdcr - bad addresses and others are flagged")
+	fs.StringVar(&site_name, "site", site_name, "Name of this site - a label on metrics, alerts and notifications")
+	fs.Var(&sink_specs, "sink", "Also write each poll to influx=http://host:8086/write?db=miners or graphite=tcp://host:2003 (repeatable)")
+	fs.StringVar(&sink_spool, "spool", sink_spool, "Directory for points a -sink could not take (default: the user cache dir)")
+
+	// The old command line used -m to start the list of addresses - it is not needed any more.
+	fs.Bool("m", false, "Ignored (kept for old scripts)")
+}
+
+/////////////////////////////////////////////////////////////
+// runCLI
+// Parse the command line and run the command.
+// Returns the exit status.
+/////////////////////////////////////////////////////////////
+func runCLI(args []string) int {
+	top := flag.NewFlagSet("horus", flag.ContinueOnError)
+	globalFlags(top)
+	top.Usage = func() { printUsage(os.Stdout) }
+	if err := top.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 1
+	}
+
+	if show_version {
+		fmt.Println("Horus:", Horus_Version)
+		return 0
+	}
+
+	// No command: the arguments are all addresses for the default command.
+	rest := top.Args()
+	cmd := findCommand(default_command)
+	if len(rest) > 0 {
+		if c := findCommand(rest[0]); c != nil {
+			cmd = c
+			rest = rest[1:]
+		}
+	}
+
+	fs := flag.NewFlagSet("horus "+cmd.name, flag.ContinueOnError)
+	globalFlags(fs)
+	if cmd.flags != nil {
+		cmd.flags(fs)
+	}
+	fs.Usage = func() {
+		fmt.Printf("Usage: horus [options] %s %s\n\n%s\n\nOptions:\n", cmd.name, cmd.args, cmd.help)
+		fs.SetOutput(os.Stdout)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(rest); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 1
+	}
+
+	if show_version {
+		fmt.Println("Horus:", Horus_Version)
+		return 0
+	}
+
+	if err := checkGlobalFlags(); err != nil {
+		fmt.Println("Error: ", err)
+		return 1
+	}
+
+	if debug {
+		fmt.Printf("Command: %s  Arguments: %v\n", cmd.name, fs.Args())
+	}
+
+	// json, csv etc go to stdout - everything else goes to stderr from here on.
+	current_command = cmd.name
+	startOutput()
+
+	fmt.Printf("HORUS (%s): Starting on %s\n ", Horus_Version, date_string)
+
+	// MAC vendor names - the bundled table plus the IEEE registry if we can find one.
+	if err := startOUI(); err != nil {
+		if oui_file != "" {
+			fmt.Printf("Error: -oui (%s): %s\n", oui_file, err)
+			return 1
+		}
+		fmt.Println("Cannot load the OUI registry: ", err)
+	}
+	if err := startAlerts(); err != nil {
+		fmt.Println("Error: ", err)
+		return 1
+	}
+	if err := startPoolGuard(); err != nil {
+		fmt.Println("Error: ", err)
+		return 1
+	}
+	if err := startSinks(); err != nil {
+		fmt.Println("Error: ", err)
+		return 1
+	}
+	if err := startNotifiers(); err != nil {
+		fmt.Println("Error: ", err)
+		return 1
+	}
+	status := cmd.run(fs.Args())
+	stopNotifiers()
+	stopSinks()
+	return status
+}
+
+func findCommand(name string) *command {
+	for _, c := range commands {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// Catch the bad global options before any scanning starts.
+func checkGlobalFlags() error {
+	if _, err := parsePortSpec(port_spec); err != nil {
+		return fmt.Errorf("-ports (%s): %s", port_spec, err)
+	}
+	if scan_rate < 0 || scan_workers < 0 {
+		return fmt.Errorf("-rate and -workers can not be negative")
+	}
+	if connection_timeout <= 0 {
+		return fmt.Errorf("-timeout must be more than zero")
+	}
+	if err := checkWalletCoins(); err != nil {
+		return err
+	}
+
+	known := false
+	for _, f := range output_formats {
+		if f == output_format {
+			known = true
+		}
+	}
+	if !known {
+		return fmt.Errorf("-output (%s) must be one of %s", output_format, strings.Join(output_formats, ", "))
+	}
+	return nil
+}
+
+func printUsage(w *os.File) {
+	fmt.Fprintf(w, `
+	Horus: The Local Area Network Miner Explorer (%s)
+
+	Display information for any ASIC Miners found on the local area network.
+	You may specify 0 or more IPs, CIDR blocks or a mixture of each on the command line.
+	If no addresses are specified, your current network will be searched.
+
+	USAGE:
+		horus [options] [command] [command options] [ < IP OR CIDR_BLOCK > ...]
+
+	COMMANDS:  (default: %s)
+`, Horus_Version, default_command)
+
+	for _, c := range commands {
+		fmt.Fprintf(w, "\t\t%-9s %s\n", c.name, c.help)
+	}
+
+	fmt.Fprintf(w, `
+	USAGE EXAMPLES:
+		horus                       Displays information for all miners discovered on the current Network
+		horus -d 10.0.4.2           Display the miner info on 10.0.4.2 with debug output
+		horus -v                    Displays program version and exits
+		horus -h                    Display this help message and exit
+		horus scan 10.0.2.0/24      List the miners found in the cidr block network 10.0.2.0/24
+		horus pools 10.2.4.6 10.2.4.0/24
+		                            Show the pools for miners found in the list of ip or cidr blocks provided
+		                            (note, you can mix and match ip and cidr blocks)
+		horus exec -param 0 switchpool 10.0.2.12
+		horus restart 10.0.2.12     Restart the miner on 10.0.2.12
+		horus scan -h               Help for one command
+
+	OPTIONS:  (before or after the command)
+`)
+	fs := flag.NewFlagSet("horus", flag.ContinueOnError)
+	globalFlags(fs)
+	fs.SetOutput(w)
+	fs.PrintDefaults()
+}
+
+/////////////////////////////////////////////////////////////
+// Test_Cmdline_IP
+// Every address on the command line must be an ipv4 address
+// or cidr block - check them all before we start a scan.
+/////////////////////////////////////////////////////////////
+func Test_Cmdline_IP(iplist []string) bool {
+
+	for _, ipl := range iplist {
+		if debug {
+			fmt.Printf("Search the following for miners: %s\n", ipl)
+		}
+
+		trial := net.ParseIP(ipl)
+
+		if trial.To4() != nil {
+			if debug {
+				fmt.Printf("%v is a valid IPv4 address ... continuing to next check\n", trial)
+			}
+			continue
+		}
+
+		if debug {
+			fmt.Printf("Maybe it is a cidrblock? \n")
+		}
+
+		ipA, ipnetA, _ := net.ParseCIDR(ipl)
+
+		if debug {
+			fmt.Println("ipA              : ", ipA)
+			fmt.Println("ipnetA           : ", ipnetA)
+		}
+
+		if ipA.To4() != nil {
+			if debug {
+				fmt.Printf("%v is a valid IPv4 address as part of a cidr block ... continuing to next check\n", ipA)
+			}
+			continue
+		}
+
+		// do we have a fatal error?
+		fmt.Println("Error: Network address specified on command line: (", ipl, ") is not a valid IP address or CIDR block.")
+		return false
+	}
+
+	return true
+}
+
+/////////////////////////////////////////////////////////////
+// Commands
+/////////////////////////////////////////////////////////////
+
+// Validate the addresses and scan.  nil if the addresses are no good.
+func scanTargets(targets []string) *MyNet {
+	if !Test_Cmdline_IP(targets) {
+		return nil
+	}
+	if debug {
+		fmt.Println("Commandlines Are All Good!!!", targets)
+	}
+	return scanNetwork(targets)
+}
+
+func cmdScan(args []string) int {
+	m := scanTargets(args)
+	if m == nil {
+		return 1
+	}
+	if !writeRecords(scanRecords(m)) {
+		reportScan(m)
+	}
+	return 0
+}
+
+func cmdInfo(args []string) int {
+	m := scanTargets(args)
+	if m == nil {
+		return 1
+	}
+	if writeRecords(minerRecords(m, all_details)) {
+		return 0
+	}
+	reportScan(m)
+
+	fmt.Printf("\n\nHere is some information from the miners...\n\n")
+
+	// Lets get some details from the miners (if any)
+	for _, ip := range m.AvailableIPs {
+		fmt.Printf("\n\n.....Miner Information for ip: %s....\n", ip)
+		port := scanPort(m, ip)
+
+		fmt.Printf("\nSummary information:\n")
+		Test_Summary(ip, port)
+
+		fmt.Printf("\nConfig information:\n")
+		Test_Config(ip, port)
+
+		fmt.Printf("\nDev information:\n")
+		Test_Devs(ip, port)
+
+		fmt.Printf("\nPool information:\n")
+		Test_Pools(ip, port)
+	}
+	return 0
+}
+
+func cmdPools(args []string) int {
+	// horus pools plan|apply - see pools_apply.go
+	if len(args) > 0 && (args[0] == "plan" || args[0] == "apply") {
+		return cmdPoolsState(args[0], args[1:])
+	}
+	// horus pools check - see pools_check.go
+	if len(args) > 0 && args[0] == "check" {
+		return cmdPoolsCheck(args[1:])
+	}
+	// horus pools baseline - see pool_guard.go
+	if len(args) > 0 && args[0] == "baseline" {
+		return cmdPoolsBaseline(args[1:])
+	}
+
+	m := scanTargets(args)
+	if m == nil {
+		return 1
+	}
+	if writeRecords(minerRecords(m, detailSet{pools: true})) {
+		return 0
+	}
+	for _, ip := range m.AvailableIPs {
+		fmt.Printf("\n.....Pools for ip: %s....\n", ip)
+		Test_Pools(ip, scanPort(m, ip))
+	}
+	return 0
+}
+
+func cmdDevs(args []string) int {
+	m := scanTargets(args)
+	if m == nil {
+		return 1
+	}
+	if writeRecords(minerRecords(m, detailSet{devs: true})) {
+		return 0
+	}
+	for _, ip := range m.AvailableIPs {
+		fmt.Printf("\n.....Devs for ip: %s....\n", ip)
+		Test_Devs(ip, scanPort(m, ip))
+	}
+	return 0
+}
+
+// exec
+var exec_param string = ""
+
+func execFlags(fs *flag.FlagSet) {
+	fs.StringVar(&exec_param, "param", "", "Parameter for the api command (for example the pool number)")
+}
+
+func cmdExec(args []string) int {
+	if len(args) == 0 {
+		fmt.Println("Error: exec needs an api command - for example: horus exec version 10.0.0.5")
+		return 1
+	}
+	api_command, targets := args[0], args[1:]
+
+	m := scanTargets(targets)
+	if m == nil {
+		return 1
+	}
+
+	status := 0
+	var records []HostRecord
+	for _, rec := range minerRecords(m, detailSet{}) {
+		ip := rec.Host
+		fmt.Printf("\n.....%s on ip: %s....\n", api_command, ip)
+
+		rec.Action = api_command
+		result, err := cgminer.New(ip, apiPort(rec)).RunCommand(api_command, exec_param)
+		if err != nil {
+			fmt.Println("Got an error back from the miner: ", err)
+			rec.Result = "failed"
+			rec.Errors = append(rec.Errors, err.Error())
+			records = append(records, rec)
+			status = 1
+			continue
+		}
+
+		rec.Result = "ok"
+		if json.Valid([]byte(result)) {
+			rec.Reply = json.RawMessage(result)
+		} else {
+			rec.Errors = append(rec.Errors, "reply is not json: "+result)
+		}
+		records = append(records, rec)
+		if machineOutput() {
+			continue
+		}
+
+		var out bytes.Buffer
+		if json.Indent(&out, []byte(result), "", "  ") != nil {
+			fmt.Println(result)
+			continue
+		}
+		fmt.Println(out.String())
+	}
+
+	writeRecords(records)
+	return status
+}
+
+// restart
+var restart_yes bool = false
+
+func restartFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&restart_yes, "y", false, "Do not ask before restarting")
+	fs.BoolVar(&restart_rolling, "rolling", restart_rolling, "A batch at a time, waiting for each to hash again (see rolling.go)")
+	fs.IntVar(&restart_batch, "batch", restart_batch, "Rolling: miners to restart at once")
+	fs.DurationVar(&restart_wait, "wait-healthy", restart_wait, "Rolling: how long a batch has to recover before we stop")
+	fs.Float64Var(&restart_healthy, "healthy", restart_healthy, "Rolling: fraction of the MHS av before the restart that MHS 5s must get back to")
+}
+
+func cmdRestart(args []string) int {
+	// Never default to the whole network for this one.
+	if len(args) == 0 {
+		fmt.Println("Error: restart needs the addresses of the miners to restart")
+		return 1
+	}
+
+	m := scanTargets(args)
+	if m == nil {
+		return 1
+	}
+	if len(m.AvailableIPs) == 0 {
+		fmt.Println("No miners found - nothing to restart.")
+		return 0
+	}
+
+	if restart_rolling && (restart_batch < 1 || restart_wait <= 0 || restart_healthy < 0) {
+		fmt.Println("Error: -batch and -wait-healthy must be more than zero, -healthy can not be negative")
+		return 1
+	}
+
+	question := fmt.Sprintf("Restart %d miner(s): %s ?", len(m.AvailableIPs), strings.Join(m.AvailableIPs, " "))
+	if restart_rolling {
+		question = fmt.Sprintf("Restart %d miner(s), %d at a time: %s ?", len(m.AvailableIPs), restart_batch, strings.Join(m.AvailableIPs, " "))
+	}
+	if !restart_yes && !confirm(question) {
+		fmt.Println("Nothing restarted.")
+		return 0
+	}
+
+	if restart_rolling {
+		records := minerRecords(m, detailSet{})
+		ok := rollingRestart(records)
+		if !writeRecords(records) {
+			printResultMatrix(records)
+		}
+		if !ok {
+			return 1
+		}
+		for _, rec := range records {
+			if rec.Result != "ok" {
+				return 1
+			}
+		}
+		return 0
+	}
+
+	status := 0
+	var records []HostRecord
+	for _, rec := range minerRecords(m, detailSet{}) {
+		ip := rec.Host
+		rec.Action = "restart"
+		if _, err := minerCommand(ip, apiPort(rec), "restart", ""); err != nil {
+			fmt.Printf(" ... IP: %s restart failed: %s\n", ip, err)
+			rec.Result = "failed"
+			rec.Errors = append(rec.Errors, err.Error())
+			status = 1
+		} else {
+			fmt.Printf(" ... IP: %s restarting\n", ip)
+			rec.Result = "ok"
+		}
+		records = append(records, rec)
+	}
+
+	writeRecords(records)
+	return status
+}
+
+// Ask a yes/no question on the terminal.  Anything but y/yes is no.
+func confirm(question string) bool {
+	fmt.Printf("%s [y/N] ", question)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// listen
+func cmdListen(args []string) int {
+	return runListen(args)
+}
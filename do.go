@@ -0,0 +1,283 @@
+package main
+
+//
+// horus do:
+// One action on many miners, a few at a time, with a line for each miner
+// at the end - ok, failed or skipped, and what the miner said.
+//
+//	horus do -dry-run switchpool 1 10.0.0.0/22
+//	horus do -parallel 32 -continue-on-error restart 10.0.0.0/22
+//	horus do -targets 10.0.0.5,10.0.0.9 addpool stratum+tcp://pool:3333 worker x
+//
+// By default the first failure stops it (the miners not started yet are
+// skipped); -max-failures N lets N fail first, -continue-on-error never stops.
+//
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"cgminer-api"
+)
+
+var do_targets string = ""
+var do_parallel int = 16
+var do_dry_run bool = false
+var do_yes bool = false
+var do_continue bool = false
+var do_max_failures int = 1
+
+func doFlags(fs *flag.FlagSet) {
+	fs.StringVar(&do_targets, "targets", do_targets, "Miners to act on: IPs and CIDR blocks, comma separated (as well as, or instead of, the ones after the action)")
+	fs.IntVar(&do_parallel, "parallel", do_parallel, "How many miners to act on at once")
+	fs.BoolVar(&do_dry_run, "dry-run", do_dry_run, "Find the miners and show what would be done - do nothing")
+	fs.BoolVar(&do_yes, "y", do_yes, "Do not ask first")
+	fs.BoolVar(&do_continue, "continue-on-error", do_continue, "Keep going whatever fails")
+	fs.IntVar(&do_max_failures, "max-failures", do_max_failures, "Stop starting new miners after this many have failed")
+}
+
+// An action: the api command, and how many parameters it takes.
+type doAction struct {
+	command string
+	params  []string // names, for the usage message
+}
+
+var do_actions = map[string]doAction{
+	"restart":     {"restart", nil},
+	"quit":        {"quit", nil},
+	"switchpool":  {"switchpool", []string{"POOL"}},
+	"enablepool":  {"enablepool", []string{"POOL"}},
+	"disablepool": {"disablepool", []string{"POOL"}},
+	"removepool":  {"removepool", []string{"POOL"}},
+	"addpool":     {"addpool", []string{"URL", "USER", "PASSWORD"}},
+}
+
+// The same names as the go api (cgminer.Enable, Disable, Delete).
+var do_aliases = map[string]string{
+	"enable":  "enablepool",
+	"disable": "disablepool",
+	"delete":  "removepool",
+}
+
+func doActionNames() string {
+	var names []string
+	for name, a := range do_actions {
+		names = append(names, strings.TrimSpace(name+" "+strings.Join(a.params, " ")))
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+/////////////////////////////////////////////////////////////
+// cmdDo
+// horus do [-parallel N] [-dry-run] [-y] [-continue-on-error |
+//
+//	-max-failures N] <action> [params] [IP OR CIDR_BLOCK ...]
+//
+/////////////////////////////////////////////////////////////
+func cmdDo(args []string) int {
+	if len(args) == 0 {
+		fmt.Println("Error: do needs an action:", doActionNames())
+		return 1
+	}
+	name := args[0]
+	if alias, ok := do_aliases[name]; ok {
+		name = alias
+	}
+	action, ok := do_actions[name]
+	if !ok {
+		fmt.Printf("Error: no such action (%s) - one of: %s\n", args[0], doActionNames())
+		return 1
+	}
+	if len(args)-1 < len(action.params) {
+		fmt.Printf("Error: %s needs %s\n", name, strings.Join(action.params, " "))
+		return 1
+	}
+	params, targets := args[1:1+len(action.params)], args[1+len(action.params):]
+
+	if len(action.params) == 1 {
+		if n, err := strconv.Atoi(params[0]); err != nil || n < 0 {
+			fmt.Printf("Error: %s: pool (%s) must be a pool number\n", name, params[0])
+			return 1
+		}
+	}
+	if strings.Contains(strings.Join(params, ""), ",") {
+		// The miner api splits its parameter on commas.
+		fmt.Printf("Error: %s: the parameters can not have commas in them\n", name)
+		return 1
+	}
+	param := strings.Join(params, ",")
+	if name == "addpool" {
+		// A mistyped wallet address pays nobody - catch it before any miner gets it.
+		if err := checkPoolUser(params[1]); err != nil {
+			fmt.Printf("Error: addpool: worker %s: %s\n", params[1], err)
+			return 1
+		}
+	}
+
+	for _, t := range strings.Split(do_targets, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			targets = append(targets, t)
+		}
+	}
+	// Never default to the whole network for this one.
+	if len(targets) == 0 {
+		fmt.Println("Error: do needs the addresses of the miners (-targets or after the action)")
+		return 1
+	}
+	if do_parallel < 1 {
+		fmt.Println("Error: -parallel must be at least 1")
+		return 1
+	}
+	max_failures := do_max_failures
+	if do_continue {
+		max_failures = 0
+	} else if max_failures < 1 {
+		fmt.Println("Error: -max-failures must be at least 1 (or use -continue-on-error)")
+		return 1
+	}
+
+	m := scanTargets(targets)
+	if m == nil {
+		return 1
+	}
+	records := minerRecords(m, detailSet{})
+	if len(records) == 0 {
+		fmt.Println("No miners found - nothing to do.")
+		return 0
+	}
+
+	what := strings.TrimSpace(name + " " + strings.Join(params, " "))
+	if !do_dry_run && !do_yes && !confirm(fmt.Sprintf("%s on %d miner(s): %s ?", what, len(records), strings.Join(m.AvailableIPs, " "))) {
+		fmt.Println("Nothing done.")
+		return 0
+	}
+
+	runActions(records, action.command, param, what, max_failures)
+
+	if !writeRecords(records) {
+		printResultMatrix(records)
+	}
+	for _, rec := range records {
+		if rec.Result != "ok" && rec.Result != "dry-run" {
+			return 1
+		}
+	}
+	return 0
+}
+
+/////////////////////////////////////////////////////////////
+// runActions
+// The command on every record, do_parallel at a time.  Once
+// max_failures (0: no limit) have failed, the rest are skipped.
+/////////////////////////////////////////////////////////////
+func runActions(records []HostRecord, command string, param string, what string, max_failures int) {
+	sem := make(chan struct{}, do_parallel)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	failures := 0
+
+	for i := range records {
+		rec := &records[i]
+		rec.Action = what
+
+		if do_dry_run {
+			rec.Result = "dry-run"
+			rec.Message = fmt.Sprintf("would send %s %s", command, param)
+			continue
+		}
+
+		sem <- struct{}{}
+		mu.Lock()
+		failed := failures
+		mu.Unlock()
+		if max_failures > 0 && failed >= max_failures {
+			<-sem
+			rec.Result = "skipped"
+			rec.Message = fmt.Sprintf("%d failure(s) - stopped", failed)
+			continue
+		}
+
+		wg.Add(1)
+		go func(rec *HostRecord) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			msg, err := minerCommand(rec.Host, apiPort(*rec), command, param)
+			rec.Message = msg
+			if err != nil {
+				rec.Result = "failed"
+				rec.Errors = append(rec.Errors, err.Error())
+				mu.Lock()
+				failures++
+				mu.Unlock()
+				return
+			}
+			rec.Result = "ok"
+		}(rec)
+	}
+	wg.Wait()
+}
+
+func printResultMatrix(records []HostRecord) {
+	counts := make(map[string]int)
+	fmt.Printf("\n%-15s  %-17s  %-28s  %-8s  %s\n", "IP", "MAC", "ACTION", "RESULT", "STATUS")
+	for _, rec := range records {
+		counts[rec.Result]++
+		status := rec.Message
+		if len(rec.Errors) > 0 && !strings.Contains(status, rec.Errors[0]) {
+			if status != "" {
+				status += " - "
+			}
+			status += strings.Join(rec.Errors, "; ")
+		}
+		fmt.Printf("%-15s  %-17s  %-28s  %-8s  %s\n", rec.Host, orDash(rec.MAC), rec.Action, rec.Result, status)
+	}
+
+	var totals []string
+	for _, r := range []string{"ok", "failed", "skipped", "dry-run"} {
+		if counts[r] > 0 {
+			totals = append(totals, fmt.Sprintf("%d %s", counts[r], r))
+		}
+	}
+	fmt.Printf("\n%s\n", strings.Join(totals, ", "))
+}
+
+/////////////////////////////////////////////////////////////
+// minerCommand
+// Send an api command and read the STATUS the miner sends
+// back.  An error for E (error) and F (fatal) - the message
+// either way.
+/////////////////////////////////////////////////////////////
+func minerCommand(ip string, port int64, command string, param string) (string, error) {
+	reply, err := cgminer.New(ip, port).RunCommand(command, param)
+	if err != nil {
+		// restart and quit can close the connection before they answer.
+		if (command == "restart" || command == "quit") && err == io.EOF {
+			return "", nil
+		}
+		return "", err
+	}
+	var r struct {
+		Status []struct {
+			Status      string `json:"STATUS"`
+			Msg         string `json:"Msg"`
+			Description string `json:"Description"`
+		} `json:"STATUS"`
+	}
+	if err := json.Unmarshal([]byte(reply), &r); err != nil || len(r.Status) == 0 {
+		// Some firmware answers restart with a plain "RESTART".
+		return strings.TrimSpace(reply), nil
+	}
+	s := r.Status[0]
+	if s.Status == "E" || s.Status == "F" {
+		return s.Msg, fmt.Errorf("%s", s.Msg)
+	}
+	return s.Msg, nil
+}
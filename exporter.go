@@ -0,0 +1,270 @@
+package main
+
+//
+// horus exporter:
+// Keep polling the miners and serve what they say as Prometheus metrics.
+//
+//	/metrics             every miner found by the last scan
+//	/probe?target=IP     ask one miner right now (like blackbox_exporter),
+//	                     so Prometheus can do the target discovery itself
+//
+// The miners are re-discovered every -rescan and polled every -interval.
+// We write the text exposition format by hand - it is simple, and
+// keeps us to the standard library.
+//
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var exporter_listen string = ":9428"
+var exporter_interval time.Duration = 30 * time.Second
+var exporter_rescan time.Duration = 10 * time.Minute
+
+func exporterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&exporter_listen, "listen", exporter_listen, "Address to serve /metrics and /probe on")
+	fs.DurationVar(&exporter_interval, "interval", exporter_interval, "Time between polls of the miners")
+	fs.DurationVar(&exporter_rescan, "rescan", exporter_rescan, "Time between scans for new miners")
+}
+
+/////////////////////////////////////////////////////////////
+// cmdExporter
+// horus exporter [-listen :9428] [-interval 30s] [-rescan 10m] [targets]
+/////////////////////////////////////////////////////////////
+func cmdExporter(args []string) int {
+	if !Test_Cmdline_IP(args) {
+		return 1
+	}
+	if exporter_interval <= 0 || exporter_rescan <= 0 {
+		fmt.Println("Error: -interval and -rescan must be more than zero")
+		return 1
+	}
+
+	state := &fleetState{name: "Exporter", interval: exporter_interval, rescan: exporter_rescan}
+	go state.loop(args)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", state.serveMetrics)
+	mux.HandleFunc("/probe", serveProbe)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "<html><head><title>Horus Exporter</title></head><body><h1>Horus Exporter (%s)</h1>"+
+			"<p><a href=\"/metrics\">Metrics</a></p><p>/probe?target=10.0.0.5</p></body></html>\n", Horus_Version)
+	})
+
+	fmt.Printf("Serving miner metrics on %s (/metrics, /probe?target=)\n", exporter_listen)
+	if err := http.ListenAndServe(exporter_listen, mux); err != nil {
+		fmt.Println("Error: ", err)
+		return 1
+	}
+	return 0
+}
+
+func (s *fleetState) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	records, polled, duration := s.snapshot()
+
+	var out bytes.Buffer
+	writeMinerMetrics(&out, records)
+
+	if alert_engine != nil {
+		writeMetricHeader(&out, "horus_alert_firing", "gauge", "Alerts firing (-rules)")
+		for _, a := range alert_engine.firing() {
+			fmt.Fprintf(&out, "horus_alert_firing{%s} 1\n", metricLabels("rule", a.Rule, "severity", a.Severity,
+				"ip", a.Host, "instance", a.Instance, "site", site_name))
+		}
+	}
+
+	writeMetricHeader(&out, "horus_miners", "gauge", "Number of miners found by the last scan")
+	fmt.Fprintf(&out, "horus_miners %d\n", len(records))
+	writeMetricHeader(&out, "horus_poll_duration_seconds", "gauge", "How long the last poll of all the miners took")
+	fmt.Fprintf(&out, "horus_poll_duration_seconds %g\n", duration.Seconds())
+	writeMetricHeader(&out, "horus_last_poll_timestamp_seconds", "gauge", "When the last poll started")
+	fmt.Fprintf(&out, "horus_last_poll_timestamp_seconds %d\n", polled.Unix())
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(out.Bytes())
+}
+
+/////////////////////////////////////////////////////////////
+// serveProbe
+// /probe?target=10.0.0.5 (or 10.0.0.5:4028) - poll one miner now.
+/////////////////////////////////////////////////////////////
+func serveProbe(w http.ResponseWriter, r *http.Request) {
+	target := r.URL.Query().Get("target")
+	host := target
+	if h, _, err := net.SplitHostPort(target); err == nil {
+		host = h
+	}
+	if net.ParseIP(host).To4() == nil {
+		http.Error(w, "target must be an IPv4 address", http.StatusBadRequest)
+		return
+	}
+
+	rec := newRecord(host)
+	start := time.Now()
+	addDetails(&rec, detailSet{version: true, summary: true, pools: true, devs: true, stats: true})
+	if table, err := readNeighborTable(); err == nil {
+		rec.MAC = table[host]
+	}
+
+	var out bytes.Buffer
+	writeMinerMetrics(&out, []HostRecord{rec})
+
+	success := 0
+	if rec.Summary != nil {
+		success = 1
+	}
+	writeMetricHeader(&out, "horus_probe_success", "gauge", "Whether the miner api answered")
+	fmt.Fprintf(&out, "horus_probe_success %d\n", success)
+	writeMetricHeader(&out, "horus_probe_duration_seconds", "gauge", "How long the probe took")
+	fmt.Fprintf(&out, "horus_probe_duration_seconds %g\n", time.Since(start).Seconds())
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(out.Bytes())
+}
+
+/////////////////////////////////////////////////////////////
+// writeMinerMetrics
+// All the per miner, per device, per pool and per chain metrics.
+// Each family is written in one block (HELP, TYPE, samples)
+// as the exposition format wants.
+/////////////////////////////////////////////////////////////
+type metricFamily struct {
+	name    string
+	kind    string
+	help    string
+	samples []string
+}
+
+func writeMinerMetrics(out *bytes.Buffer, records []HostRecord) {
+	families := []*metricFamily{
+		{name: "horus_miner_up", kind: "gauge", help: "Whether the miner api answered the last poll"},
+		{name: "horus_miner_mhs_5s", kind: "gauge", help: "Hashrate over the last 5 seconds (MH/s)"},
+		{name: "horus_miner_mhs_av", kind: "gauge", help: "Average hashrate since the miner started (MH/s)"},
+		{name: "horus_miner_accepted_total", kind: "counter", help: "Shares accepted"},
+		{name: "horus_miner_rejected_total", kind: "counter", help: "Shares rejected"},
+		{name: "horus_miner_stale_total", kind: "counter", help: "Stale shares"},
+		{name: "horus_miner_hardware_errors_total", kind: "counter", help: "Hardware errors"},
+		{name: "horus_miner_elapsed_seconds", kind: "gauge", help: "Seconds since the miner software started"},
+		{name: "horus_device_temperature_celsius", kind: "gauge", help: "Device temperature"},
+		{name: "horus_device_fan_rpm", kind: "gauge", help: "Device fan speed"},
+		{name: "horus_device_fan_percent", kind: "gauge", help: "Device fan speed percent"},
+		{name: "horus_device_mhs_5s", kind: "gauge", help: "Device hashrate over the last 5 seconds (MH/s)"},
+		{name: "horus_device_alive", kind: "gauge", help: "Whether the device status is Alive"},
+		{name: "horus_pool_alive", kind: "gauge", help: "Whether the miner says the pool is Alive"},
+		{name: "horus_pool_stratum_active", kind: "gauge", help: "Whether the pool is the active stratum connection"},
+		{name: "horus_pool_priority", kind: "gauge", help: "Pool priority (0 is first)"},
+		{name: "horus_chain_chips", kind: "gauge", help: "Chips the hash chain found"},
+		{name: "horus_chain_chips_missing", kind: "gauge", help: "Chips missing from the hash chain"},
+		{name: "horus_chain_chips_bad", kind: "gauge", help: "Chips the hash chain marks bad (x)"},
+		{name: "horus_chain_dead", kind: "gauge", help: "Whether the hash chain is dead"},
+		{name: "horus_chain_mhs", kind: "gauge", help: "Hash chain rate (MH/s)"},
+		{name: "horus_chain_temperature_celsius", kind: "gauge", help: "Hottest chip (or board) sensor of the hash chain"},
+	}
+	fam := make(map[string]*metricFamily)
+	for _, f := range families {
+		fam[f.name] = f
+	}
+	add := func(name string, labels string, value float64) {
+		f := fam[name]
+		f.samples = append(f.samples, fmt.Sprintf("%s{%s} %s", name, labels, formatMetricValue(value)))
+	}
+
+	for _, rec := range records {
+		model := ""
+		if rec.Version != nil {
+			model = rec.Version.Type
+		}
+		miner := metricLabels("ip", rec.Host, "mac", rec.MAC, "model", model, "site", site_name)
+
+		up := 0.0
+		if rec.Summary != nil {
+			up = 1
+		}
+		add("horus_miner_up", miner, up)
+
+		if s := rec.Summary; s != nil {
+			add("horus_miner_mhs_5s", miner, s.MHS5s)
+			add("horus_miner_mhs_av", miner, s.MHSav)
+			add("horus_miner_accepted_total", miner, float64(s.Accepted))
+			add("horus_miner_rejected_total", miner, float64(s.Rejected))
+			add("horus_miner_stale_total", miner, float64(s.Stale))
+			add("horus_miner_hardware_errors_total", miner, float64(s.HardwareErrors))
+			add("horus_miner_elapsed_seconds", miner, float64(s.Elapsed))
+		}
+
+		for i, d := range rec.Devs {
+			// The position in the DEVS list - ASC and GPU numbers are both 0 on half the firmware out there.
+			dev := miner + "," + metricLabels("device", strconv.Itoa(i))
+			add("horus_device_temperature_celsius", dev, d.Temperature)
+			add("horus_device_fan_rpm", dev, float64(d.FanSpeed))
+			add("horus_device_fan_percent", dev, float64(d.FanPercent))
+			add("horus_device_mhs_5s", dev, d.MHS5s)
+			add("horus_device_alive", dev, boolMetric(d.Status == "Alive"))
+		}
+
+		for _, p := range rec.Pools {
+			pool := miner + "," + metricLabels("pool", strconv.FormatInt(p.Pool, 10), "url", p.URL, "user", p.User)
+			add("horus_pool_alive", pool, boolMetric(p.Status == "Alive"))
+			add("horus_pool_stratum_active", pool, boolMetric(p.StratumActive))
+			add("horus_pool_priority", pool, float64(p.Priority))
+		}
+
+		for _, c := range rec.Chains {
+			chain := miner + "," + metricLabels("chain", strconv.Itoa(c.Chain))
+			add("horus_chain_chips", chain, float64(c.Chips))
+			add("horus_chain_chips_missing", chain, float64(c.Missing))
+			add("horus_chain_chips_bad", chain, float64(c.Bad))
+			add("horus_chain_dead", chain, boolMetric(c.Dead))
+			add("horus_chain_mhs", chain, c.MHS)
+			add("horus_chain_temperature_celsius", chain, chainTemp(c))
+		}
+	}
+
+	for _, f := range families {
+		if len(f.samples) == 0 {
+			continue
+		}
+		writeMetricHeader(out, f.name, f.kind, f.help)
+		for _, s := range f.samples {
+			out.WriteString(s)
+			out.WriteString("\n")
+		}
+	}
+}
+
+func writeMetricHeader(out *bytes.Buffer, name string, kind string, help string) {
+	fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// name, value, name, value ... -> name="value",name="value"
+func metricLabels(pairs ...string) string {
+	var parts []string
+	for i := 0; i+1 < len(pairs); i += 2 {
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, pairs[i], escapeLabel(pairs[i+1])))
+	}
+	return strings.Join(parts, ",")
+}
+
+var label_escaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(v string) string {
+	return label_escaper.Replace(v)
+}
+
+func formatMetricValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func boolMetric(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
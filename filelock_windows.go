@@ -0,0 +1,30 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const lockfileExclusiveLock = 0x0002
+
+var procLockFileEx = kernel32.NewProc("LockFileEx")
+var procUnlockFileEx = kernel32.NewProc("UnlockFileEx")
+
+// lockFile waits for an exclusive lock on the first byte of f - Windows
+// drops it when f is closed or the process dies.
+func lockFile(f *os.File) error {
+	var ol syscall.Overlapped
+	if r, _, err := procLockFileEx.Call(f.Fd(), lockfileExclusiveLock, 0, 1, 0, uintptr(unsafe.Pointer(&ol))); r == 0 {
+		return err
+	}
+	return nil
+}
+
+func unlockFile(f *os.File) error {
+	var ol syscall.Overlapped
+	if r, _, err := procUnlockFileEx.Call(f.Fd(), 0, 1, 0, uintptr(unsafe.Pointer(&ol))); r == 0 {
+		return err
+	}
+	return nil
+}
@@ -30,10 +30,11 @@
  * C:\Users\howie\Apps\Nmap>
  *
  * USAGE: 
- *	Usage: horus.exe [-m value ...]
- *		-m   	0 or more Miner addresses - can be mixture of CIDR blocks or IP addresses
+ *	Usage: horus.exe [options] [command] [command options] [IP OR CIDR_BLOCK ...]
+ *		commands: scan, info (the default), pools, devs, exec, restart, watch, listen, inventory, exporter
+ *		horus -h for the full list of options - see cli.go
  *	
- *		Note, If no value is specified for -m, the current local network will be searched +
+ *		Note, If no addresses are specified, the current local network will be searched
  *		for any/all miners on the subnet.
  *
  *
@@ -48,6 +49,31 @@
  * 0.3 - grapek - use command line to accept ip, cidr block or default to local area network
  * 0.4 - grapek - actually connect and display some information from the miners. (use test stubs)
  * 0.5 - grapek - added "config" structure to the api code.   Repaired Dev structure.
+ * 0.6 - grapek - bounded worker pool scan engine (scan_engine.go), -rate and -workers options.
+ * 0.7 - grapek - -ports option and per-port probe profiles (probe_profiles.go).
+ * 0.8 - grapek - classify every host: open/refused/timeout/unreachable with dial latency (host_state.go).
+ * 0.9 - grapek - MAC addresses from the arp table and OUI vendor lookup (neighbors.go, oui.go).
+ * 0.10 - grapek - "horus listen" for the Antminer IP Report broadcast (listen.go).
+ * 0.11 - grapek - one command line with subcommands (cli.go) - flag_teststub.go folded in.
+ * 0.12 - grapek - -output json, ndjson, csv and yaml (output.go, schema in OUTPUT.md).
+ * 0.13 - grapek - "horus exporter" Prometheus metrics (exporter.go), api timeouts in cgminer-api.
+ * 0.14 - grapek - -sink influx=... / graphite=... time series writers with a disk spool (sink.go).
+ * 0.15 - grapek - inventory of every miner seen across scans, "horus inventory" (inventory.go).
+ * 0.16 - grapek - "horus watch" change events, SIGTERM and systemd notify (watch.go, sdnotify.go).
+ * 0.17 - grapek - -rules alert rules checked after every poll (alerts.go, ALERTS.md).
+ * 0.18 - grapek - -notify webhook, slack, smtp and mqtt notifications (notify.go, mqtt.go, NOTIFY.md).
+ * 0.19 - grapek - "horus serve" web dashboard (serve.go, web/).
+ * 0.20 - grapek - "horus api" REST api with tokens, roles and tls (api.go, openapi.json, API.md).
+ * 0.21 - grapek - "horus top" terminal ui (top.go, term_*.go).
+ * 0.22 - grapek - "horus do" bulk actions with -dry-run, -parallel, -max-failures (do.go).
+ * 0.23 - grapek - "horus restart -rolling" batches that wait for the miners to hash again (rolling.go).
+ * 0.24 - grapek - "horus pools plan|apply" pools file for groups of miners (pools_apply.go, POOLS.md).
+ * 0.25 - grapek - -pool-guard: approved pools baseline, unapproved pool and pool share events, revert (pool_guard.go).
+ * 0.26 - grapek - "horus audit" privileged api, default web logins, plain stratum, old firmware, ssh (audit.go).
+ * 0.27 - grapek - "horus pools check" stratum subscribe / authorize from the scanner (pools_check.go).
+ * 0.28 - grapek - wallet address checks on pool workers: base58check, bech32, decred (wallet.go).
+ * 0.29 - grapek - "horus triage" health score and worst-first report, boots kept in the inventory (triage.go).
+ * 0.30 - grapek - Antminer hash chains from stats: missing chips, dead chains, hot chains - "horus chains", Chains.X alert rules, triage and exporter (chains.go).
  */
 
 package main
@@ -59,7 +85,7 @@ import (
 	"time"
 	"sync"
 	"os"
-	"strings"
+	"sort"
 	"cgminer-api"			// Howie's Reqired Package. 
 )
 
@@ -70,12 +96,16 @@ type MyNet struct {
 	Netmask      net.IPMask			// ffffff00
 	Subnet       net.IP			// first ip address of network block based on netmask
 	AvailableIPs []string          		// list of unique addresses of those which have miners on them
+	Services     map[string][]Service		// open ports (and what answered on them) keyed by ip
+	Hosts        map[string]*HostResult		// hosts that are up (open or refused) keyed by ip
+	StateCounts  map[string]int			// number of hosts in each state - see host_state.go
+	Neighbors    map[string]Neighbor		// MAC / vendor from the arp table keyed by ip - see neighbors.go
 }
 
 
 // Global Constants and Variables. 
 
-var Horus_Version string = "Version 0.05"
+var Horus_Version string = "Version 0.30"
 var date = time.Now()	
 var date_string = date.Format("Mon Jan 02 2006 at 15:04:05")
 
@@ -87,30 +117,21 @@ var remote = false
 // create a global empty slice of strings
 // and a bool for debugging
 var ips []string
-var ports []string
+var port_spec string = default_port_spec	// -ports: see probe_profiles.go
 var debug bool = false			// first level debug
 
-// A WaitGroup waits for a collection of goroutines to finish. The main loop calls Add(1)
-// to set the number of goroutines to wait for. Then each of the goroutines runs and calls Done
-// when finished.
-var wg sync.WaitGroup
+// Protects MyNet.AvailableIPs, Services, Hosts and StateCounts - the scan workers all add to it at the same time.
+var miners_mu sync.Mutex
 
-// A channel that acts as a counting semaphore. Only allow X concurrent connections.
-// The number here can be adjusted up or down. If too many open files/sockets then
-// adjust this down. Lower numbers mean slower scan times.
-// `ls /proc/pidof netscan/fd | wc -l` should be just under this
-var sem = make(chan struct{}, 32768)
+// Scan engine tuning - see scan_engine.go
+// scan_workers == 0 means size it from the open file limit (ulimit -n)
+// scan_rate == 0 means no limit on connection attempts per second.
+var scan_workers int = 0
+var scan_rate int = 0
 
-const usage string =
-	"\n\nUsage: horus.exe [-m value ...]\n" +
-		"-m   	0 or more Miner addresses - can be mixture of CIDR blocks or IP addresses\n" +
-		"\n" +
-		"Note, If no value is specified for -m, the current local network will be searched \n" +
-		"for any/all miners on the subnet.\n"
-
-
-const connection_timeout = 2 * time.Second
-//const connection_timeout = 20 * time.Millisecond
+// -timeout
+var connection_timeout = 2 * time.Second
+//var connection_timeout = 20 * time.Millisecond
 
 //////////////////////////////////////////////////////////////
 // Get my external interface -
@@ -137,6 +158,10 @@ func resolveHostIp() (string) {
 /////////////////////////////////////////////////////////////
 func getMyLanInfo() (*MyNet) {
 	mn := new(MyNet)
+	mn.Services = make(map[string][]Service)
+	mn.Hosts = make(map[string]*HostResult)
+	mn.StateCounts = make(map[string]int)
+	mn.Neighbors = make(map[string]Neighbor)
 	ifaces, err := net.Interfaces()
 
 	// Handle any error (there shouldn't be
@@ -205,38 +230,97 @@ func getMyLanInfo() (*MyNet) {
 // Take an IP string and a ptr to the ports slice
 //
 // Check to see if we can connect to a specific port 
-// If we can, report on it and add to global list of assets 
+// If we can, run the port's prober on it, report on it and add to global list of assets 
+// If we cannot, work out why (refused, timeout, unreachable) - see host_state.go
+// All dials go through the scan engine so they are rate limited and bounded.
 /////////////////////////////////////////////////////////////
-func connect(ip string, the_ports []string, m *MyNet) {
+func connect(ip string, the_ports []portProbe, m *MyNet, engine *scanEngine) {
+
+	host := &HostResult{IP: ip}
+
+	// Count the host once all its ports are done.
+	defer func() {
+		miners_mu.Lock()
+		m.StateCounts[host.State]++
+		if host.up() {
+			m.Hosts[ip] = host
+		}
+		miners_mu.Unlock()
+	}()
 
-	for _, port := range the_ports {
+	for _, pp := range the_ports {
+		port := pp.Port
 		if debug {
 			fmt.Fprintln(os.Stderr, "checking port: ", port, "on ip: ", ip)
 		}
 
 		hostPort := net.JoinHostPort(ip, port)
 
-		conn, err := net.DialTimeout("tcp", hostPort, connection_timeout)
+		conn, latency, err := engine.dial("tcp", hostPort)
+		state := classifyDial(err)
+		host.add(PortResult{Port: port, State: state, Latency: latency})
+
 		if err != nil {
 			if debug {
-				fmt.Printf("Cannot connect to %s on port %s - error: %s\n", ip, port, err.Error())
+				fmt.Printf("Cannot connect to %s on port %s - %s after %v - error: %s\n", ip, port, state, latency, err.Error())
 			}
 		} else {
-			fmt.Printf(" ... Success on Port: %s - IP: %s\n", port, ip)
-		
-			// Add ip address to list of good ones in our global structure. - Only add if unique and not found already
-			// (TODO: Howie) this may not work for concurrency, I need to check that there isn't already added
-			m.AvailableIPs = AppendIfMissing(m.AvailableIPs, ip)
-
+			svc := probeService(conn, ip, pp)
 			conn.Close()
+
+			fmt.Printf(" ... Success on Port: %s (%s) - IP: %s (%v) %s\n", port, svc.Profile, ip, latency.Round(time.Microsecond), svc.Detail)
+
+			// Remember what this host exposes.
+			// Add ip address to list of good ones in our global structure if the miner API answered. 
+			// - Only add if unique and not found already
+			miners_mu.Lock()
+			m.Services[ip] = append(m.Services[ip], svc)
+			if svc.Profile == "cgminer" {
+				m.AvailableIPs = AppendIfMissing(m.AvailableIPs, ip)
+			}
+			miners_mu.Unlock()
 		}
 	}
+}
 
-	// Decrements wg counter by 1
-	defer wg.Done()
+/////////////////////////////////////////////////////////////
+// reportServices
+// Every host with an open port and what answered on it.
+// Hosts whose web ui (or banner) says miner, but with no miner api,
+// are listed separately - those need someone to go turn the api on.
+/////////////////////////////////////////////////////////////
+func reportServices(m *MyNet) {
+	var hosts []string
+	for ip := range m.Services {
+		hosts = append(hosts, ip)
+	}
+	sort.Strings(hosts)
+
+	fmt.Println("\nServices found:")
+	var api_off []string
+	for _, ip := range hosts {
+		has_api := false
+		vendor := ""
+		for _, svc := range m.Services[ip] {
+			fmt.Printf(" ... IP: %-15s port %-5s %-8s %s\n", ip, svc.Port, svc.Profile, svc.Detail)
+			if svc.Profile == "cgminer" {
+				has_api = true
+			}
+			if svc.Miner != "" && vendor == "" {
+				vendor = svc.Miner
+			}
+		}
+		if !has_api && vendor != "" {
+			api_off = append(api_off, fmt.Sprintf("%s (%s)", ip, vendor))
+		}
+	}
 
-	// Receive Signal
-	<-sem
+	if len(api_off) > 0 {
+		fmt.Println("\nMiners with the API disabled (web ui or banner only):")
+		for _, host := range api_off {
+			fmt.Printf(" ... IP: %s\n", host)
+		}
+	}
 }
 
 /////////////////////////////////////////////////////////////
@@ -269,8 +353,8 @@ func inc(ip net.IP) {
 // testing stubs
 ////
 
-func Test_Summary(miner_ip string) {
-	miner := cgminer.New(miner_ip, 4028)
+func Test_Summary(miner_ip string, port int64) {
+	miner := cgminer.New(miner_ip, port)
 	summary, err := miner.Summary()
 	if err != nil {
 		fmt.Println("Got an error back from miner.Summary: ", err)
@@ -288,8 +372,8 @@ func Test_Summary(miner_ip string) {
 	//fmt.Printf("Status: %s\n", summary.Status)
 }
 
-func Test_Devs(miner_ip string) {
-	miner := cgminer.New(miner_ip, 4028)
+func Test_Devs(miner_ip string, port int64) {
+	miner := cgminer.New(miner_ip, port)
 	devs, err := miner.Devs()
 	if err != nil {
 		fmt.Println("Got an error back from miner.Devs: ", err)
@@ -304,8 +388,8 @@ func Test_Devs(miner_ip string) {
 	}
 }
 
-func Test_Pools(miner_ip string) {
-	miner := cgminer.New(miner_ip, 4028)
+func Test_Pools(miner_ip string, port int64) {
+	miner := cgminer.New(miner_ip, port)
 	pools, err := miner.Pools()
 	if err != nil {
 		fmt.Println("Got an error back from miner.Pools: ", err)
@@ -317,8 +401,8 @@ func Test_Pools(miner_ip string) {
 
 }
 
-func Test_Config(miner_ip string) {
-	miner := cgminer.New(miner_ip, 4028)
+func Test_Config(miner_ip string, port int64) {
+	miner := cgminer.New(miner_ip, port)
 	config, err := miner.Config()
 	if err != nil {
 		fmt.Println("Got an error back from miner.Config: ", err)
@@ -334,179 +418,103 @@ func Test_Config(miner_ip string) {
 //////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
 
 func main() {
+	// Everything else (options, commands) is in cli.go
+	os.Exit(runCLI(os.Args[1:]))
+}
 
-	var pips []string                   // temporary list of IP's
-	var my_cidr string                  // My CIDR Block as discovered. 
+/////////////////////////////////////////////////////////////
+// scanNetwork
+// MAIN NMAP FUNCTION TO FIND ALL THE HOSTS LOOKING FOR MINERS.
+// It used to be inline in main, but now every command needs it.
+// No addresses means scan my own network.
+/////////////////////////////////////////////////////////////
+func scanNetwork(pips []string) *MyNet {
 
 	// Shortcut for println
 	p := fmt.Println
 
-	fmt.Printf("HORUS (%s): Starting on %s\n ", Horus_Version, date_string)
-
 	// Get local area info, If we don't give any networks on the commmand line - use this network as a default
 	MyLanInfo := getMyLanInfo()
-	my_cidr = fmt.Sprintf("%s", MyLanInfo.IP)
+	my_cidr := fmt.Sprintf("%s", MyLanInfo.IP)
 
 	if debug {
 		p("MyCidr after conversion is: ", my_cidr)
 	}
 
-	// Parse Commandline Arguments. 
-	// can be -help or -m 
-	// any other items on the command line are considered 1 or more ip addresses/cidr blocks. 
-	// args[0] is the name of the program, so we don't count that. 
-
-    if len (os.Args) == 1 {
-    	// No command line arguments specified 
-	   	p("Searching for miners on all IP's in local area network...")
-
-    	//pips = []string{"172.22.70.80", "172.22.201.231", "172.22.201.231/24", "172.22.201.228"}
-    	pips = append(pips, my_cidr)
-    } else {
-    	// Parse Command line args. 
-
-		for i, arg := range os.Args {
-
-			if i == 0 {
-				continue                 // ignore the argv[0] - the program name
-			} 
-
-			if arg == "-help" {
-				fmt.Println (usage)
-				time.Sleep(2 * time.Second)
-				os.Exit(1)
-			}
-
-			if arg == "-m" {
-				p("Searching for miners on ip's or cidr blocks entered on command line...\n")
-			} else {
-				if debug {
-					fmt.Printf("arg %d: %s\n", i, os.Args[i])
-				}
-				pips = append(pips, os.Args[i])
-			}
-		}
+	if len(pips) == 0 {
+		// No addresses specified
+		p("Searching for miners on all IP's in local area network...")
+		pips = []string{my_cidr}
+	} else {
+		p("Searching for miners on ip's or cidr blocks entered on command line...")
 	}
-	
-	
+
 	// Ports to check - for testing, we can test multiple ports. 
 	// Note, for miners, the port required is only CGMiner: 4028, 
 	// for other nmap like operations, we can search for ssh, http, etc
-	//ports := []string{"21", "22", "80", "4028"}
-	ports := []string{"4028"}
+	// and 80 finds the miners with the api switched off but the web ui still up.
+	// (already checked by checkGlobalFlags)
+	ports, _ := parsePortSpec(port_spec)
 
 	if debug {
 		fmt.Println("Ports being checked are: ", ports)
-	}
-
-	if debug {
 		fmt.Println("IPs being checked are: ", pips)
-
-		for _, ip := range pips {
-			fmt.Fprintf(os.Stderr, "In for loop ... Checking IP: %s\n", ip)
-		}
 	}
 
 	//
 	// Just some diagnostics and debug output:
 	//
 	if debug {
-		fmt.Println("\nAt bottom of main - before getting network... the myLanInfo struct is:")
+		fmt.Println("\nBefore scanning the network... the myLanInfo struct is:")
 		fmt.Println(MyLanInfo)
 		fmt.Printf("ipv4 .... (%s)\n", MyLanInfo.IP)
 	}
 
-	//
-	// MAIN NMAP FUNCTION TO FIND ALL THE HOSTS LOOKING FOR MINERS.
-	// I can make this a function, but the amount of code and the fact that it is called only once 
-	// makes it justtifyable that it is inline. 
-	//
-
-	// Set up the variable to use herein
-	var ipnet 	*net.IPNet						// The IP Network address to check (individual ip or cidr block)
-	var newip 	net.IP							// Single IP to
-	var err   	error							// errors
+	// The engine hands out one address at a time (cidr blocks are walked lazily)
+	// to a bounded pool of workers - see scan_engine.go
+	engine := newScanEngine(scan_workers, scan_rate)
 
 	// Traverse the list of IPs passed in (either my network, or commandline ip's)
-	for _, ip := range pips {
+	// blocks until every address has been checked.
+	engine.run(newTargetIterator(pips), func(ip string) {
 		if debug {
-			fmt.Fprintln(os.Stderr, "In for loop ... Checking IP %s", ip)
+			fmt.Fprintf(os.Stderr, "Worker ... Checking IP %s\n", ip)
 		}
+		connect(ip, ports, MyLanInfo, engine)	// Check the individual IP with all ports in list.
+	})
 
-		// Lets see if there is a CIDR Block or not.
-		if !strings.Contains(ip, "/") {
-			// We got an ip not a CIDR block. no prob. just process it.
-			newip := net.ParseIP(ip)
+	// The scan has filled the arp table for the local segment - pick up the MACs.
+	harvestNeighbors(MyLanInfo, pips)
 
-			if debug {
-				fmt.Println("after parsing - we have an ip, not a cidr block: ", newip)
-			}
-
-			wg.Add(1)									// Add 1 to wg counter
-			sem <- struct{}{}							// Send Signal into channel
-			go connect(ip, ports, MyLanInfo)			// Do the nmap scan.
-			continue
-
-		}
+	// Every miner we have ever seen - see inventory.go
+	rememberScan(MyLanInfo)
 
-		newip, ipnet, err = net.ParseCIDR(ip)
-		if err != nil {
-			fmt.Println("Got an error back from net.Parse: ", err)
-		} else {
-			if debug {
-				fmt.Println("In a CIDR Block: ip:", ip, "newip", newip, "ipnet: ", ipnet)
-			}
-
-			// walk the network block with the appropriate mask.
-			for newip := newip.Mask(ipnet.Mask); ipnet.Contains(newip); inc(newip) {
-
-				if debug {
-					fmt.Println("Inside a Cidr Block Walking network with this ip: ", newip)
-				}
-
-				wg.Add(1)										// Add 1 to wg counter
-				sem <- struct{}{}								// Send Signal into channel
-				go connect(newip.String(), ports, MyLanInfo)	// Check the individual IP with all ports in list.
-			}
-		}
-	}
-
-	// blocks until the WaitGroup counter is zero.
-	wg.Wait()
-	close(sem)
-
-	// Ok, now we know exactly what we are working with, how many miners we have, 
-	// and can grab those ip's out of the global memory when needed. 
+	sort.Strings(MyLanInfo.AvailableIPs)
+	return MyLanInfo
+}
 
+/////////////////////////////////////////////////////////////
+// reportScan
+// Ok, now we know exactly what we are working with, how many miners we have, 
+// and can grab those ip's out of the global memory when needed. 
+/////////////////////////////////////////////////////////////
+func reportScan(MyLanInfo *MyNet) {
 	fmt.Println("\n\nComplete list of ip addresses who are miners:")
 
 	num_miners := 0
 	for _, ip := range MyLanInfo.AvailableIPs {
-		fmt.Fprintf(os.Stderr, " ... IP: %s\n", ip)
+		fmt.Printf(" ... IP: %s %s\n", ip, MyLanInfo.Neighbors[ip].MAC)
 		num_miners++
 	}
 
 	fmt.Printf("Total Number of unique miners found: %d\n", num_miners) 
 
-	fmt.Printf("\n\nHere is some information from the miners - just stub routines to prove we are getting info...\n\n")
-
-	// Lets get some details from the miners (if any)
-	for _, ip := range MyLanInfo.AvailableIPs {
-
-			//ip := "10.0.0.5"
-			fmt.Printf("\n\n.....Miner Information for ip: %s....\n", ip)
-
-			fmt.Printf("\nSummary information:\n")
-			Test_Summary(ip)
+	// What else did we find - and which miners have their api turned off?
+	reportServices(MyLanInfo)
 
-			fmt.Printf("\nConfig information:\n")
-			Test_Config(ip)
-
-			fmt.Printf("\nDev information:\n")
-			Test_Devs(ip)
-			
-			fmt.Printf("\nPool information:\n")
-			Test_Pools(ip)		
-	}
+	// How many hosts were up, refused, timed out, unreachable...
+	reportStates(MyLanInfo)
 
+	// MACs, vendors and the miners we can see but cannot talk to.
+	reportNeighbors(MyLanInfo)
 }
@@ -0,0 +1,132 @@
+package main
+
+//
+// Host state classification:
+// A failed dial is not just "cannot connect".  Refused means the host is up
+// but nothing is listening (a miner with its api turned off), a timeout means
+// the host is down or filtered, and unreachable comes back from a router or
+// from our own arp.  Knowing which one tells us who to send to the rack.
+//
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"syscall"
+	"time"
+)
+
+const (
+	state_open         = "open"
+	state_refused      = "refused"
+	state_host_unreach = "host-unreachable"
+	state_timeout      = "timeout"
+	state_net_unreach  = "network-unreachable"
+	state_error        = "error"
+)
+
+// Report order - and when a host has several ports, the lowest wins
+// (one open port makes the host "open", one refusal proves it is up).
+var state_order = []string{
+	state_open,
+	state_refused,
+	state_host_unreach,
+	state_timeout,
+	state_net_unreach,
+	state_error,
+}
+
+type PortResult struct {
+	Port    string
+	State   string
+	Latency time.Duration
+}
+
+type HostResult struct {
+	IP      string
+	State   string        // best state over all the ports
+	Latency time.Duration // latency of the port that gave us State
+	Ports   []PortResult
+	MAC     string // from the neighbor table, if the host is on our segment
+	Vendor  string // from the MAC OUI
+}
+
+/////////////////////////////////////////////////////////////
+// classifyDial
+// Turn the error from a dial into one of our states.
+/////////////////////////////////////////////////////////////
+func classifyDial(err error) string {
+	if err == nil {
+		return state_open
+	}
+
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return state_timeout
+	}
+
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		switch {
+		case isRefused(errno):
+			return state_refused
+		case isHostUnreachable(errno):
+			return state_host_unreach
+		case isNetUnreachable(errno):
+			return state_net_unreach
+		case isTimedOut(errno):
+			return state_timeout
+		}
+	}
+	return state_error
+}
+
+func stateRank(state string) int {
+	for i, s := range state_order {
+		if s == state {
+			return i
+		}
+	}
+	return len(state_order)
+}
+
+// Fold one port result into the host result.
+func (h *HostResult) add(pr PortResult) {
+	h.Ports = append(h.Ports, pr)
+	if h.State == "" || stateRank(pr.State) < stateRank(h.State) {
+		h.State = pr.State
+		h.Latency = pr.Latency
+	}
+}
+
+// Is the host up?  (something answered, even if it was only to say no)
+func (h *HostResult) up() bool {
+	return h.State == state_open || h.State == state_refused
+}
+
+/////////////////////////////////////////////////////////////
+// reportStates
+// Count of hosts in each state, and the hosts that are up
+// but refused the miner api.
+/////////////////////////////////////////////////////////////
+func reportStates(m *MyNet) {
+	fmt.Println("\nHost states:")
+	for _, state := range state_order {
+		fmt.Printf(" ... %-20s %d\n", state, m.StateCounts[state])
+	}
+
+	var refused []string
+	for ip, h := range m.Hosts {
+		if h.State == state_refused {
+			refused = append(refused, ip)
+		}
+	}
+	sort.Strings(refused)
+
+	if len(refused) > 0 {
+		fmt.Println("\nHosts up but refusing every port checked (api off?):")
+		for _, ip := range refused {
+			fmt.Printf(" ... IP: %-15s %v\n", ip, m.Hosts[ip].Latency.Round(time.Microsecond))
+		}
+	}
+}
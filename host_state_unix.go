@@ -0,0 +1,22 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import "syscall"
+
+func isRefused(errno syscall.Errno) bool {
+	return errno == syscall.ECONNREFUSED
+}
+
+func isHostUnreachable(errno syscall.Errno) bool {
+	return errno == syscall.EHOSTUNREACH || errno == syscall.EHOSTDOWN
+}
+
+func isNetUnreachable(errno syscall.Errno) bool {
+	return errno == syscall.ENETUNREACH || errno == syscall.ENETDOWN
+}
+
+func isTimedOut(errno syscall.Errno) bool {
+	return errno == syscall.ETIMEDOUT
+}
@@ -0,0 +1,29 @@
+package main
+
+import "syscall"
+
+// Winsock error codes - the syscall package does not name all of these.
+const (
+	wsaENETDOWN     syscall.Errno = 10050
+	wsaENETUNREACH  syscall.Errno = 10051
+	wsaETIMEDOUT    syscall.Errno = 10060
+	wsaECONNREFUSED syscall.Errno = 10061
+	wsaEHOSTDOWN    syscall.Errno = 10064
+	wsaEHOSTUNREACH syscall.Errno = 10065
+)
+
+func isRefused(errno syscall.Errno) bool {
+	return errno == wsaECONNREFUSED
+}
+
+func isHostUnreachable(errno syscall.Errno) bool {
+	return errno == wsaEHOSTUNREACH || errno == wsaEHOSTDOWN
+}
+
+func isNetUnreachable(errno syscall.Errno) bool {
+	return errno == wsaENETUNREACH || errno == wsaENETDOWN
+}
+
+func isTimedOut(errno syscall.Errno) bool {
+	return errno == wsaETIMEDOUT
+}
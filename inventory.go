@@ -0,0 +1,616 @@
+package main
+
+//
+// Inventory:  every miner horus has ever seen, kept between runs.
+//
+// Each scan updates the register - first / last seen, the addresses the
+// miner has had and its MAC - and each poll a command makes anyway adds
+// its model, firmware, pools and how healthy it was the last time we
+// looked.  The inventory never asks the miners anything itself.  Miners are
+// known by their MAC where we have one (the address changes with DHCP, the
+// MAC does not), otherwise by ip.
+//
+// The register is one json file (-inventory, default in the user config
+// dir), not an embedded database: sqlite needs cgo and a driver, bbolt is a
+// module, and horus builds from the standard library alone (no go.mod, no
+// vendored code).  A few thousand miners is a few MB - small enough to read
+// whole, easy to back up and to read by eye.  It is rewritten through a temp
+// file + rename so a crash never leaves half a register behind.  Every
+// update holds inventory_mu (the goroutines of this process) and a lock on
+// inventory.json.lock (flock, LockFileEx on windows - the other horus
+// processes: watch, the exporter, a horus inventory forget ...) from the
+// load to the save, so no update is lost and nothing forgotten comes back.
+//
+// USAGE:
+//	horus inventory list
+//	horus inventory show <MAC OR IP>
+//	horus inventory forget <MAC OR IP> ...
+//
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const inventory_schema = 1
+
+// -inventory: the register file ("": the default place, "none": do not keep one)
+var inventory_file string = ""
+
+type InventoryMiner struct {
+	ID        string          `json:"id"` // the MAC, or "ip:" + address when we have never seen the MAC
+	MAC       string          `json:"mac,omitempty"`
+	Vendor    string          `json:"vendor,omitempty"`
+	IP        string          `json:"ip"` // the last address
+	IPHistory []InventoryIP   `json:"ip_history"`
+	FirstSeen time.Time       `json:"first_seen"`
+	LastSeen  time.Time       `json:"last_seen"`
+	Model     string          `json:"model,omitempty"`
+	Firmware  string          `json:"firmware,omitempty"`
+	Dialect   string          `json:"dialect,omitempty"`
+	Pools     []InventoryPool `json:"pools,omitempty"`
+	Health    InventoryHealth `json:"health"`
+	Boots     []time.Time     `json:"boots,omitempty"` // when it started, from its uptime - the last inventory_boots
+}
+
+type InventoryIP struct {
+	IP    string    `json:"ip"`
+	First time.Time `json:"first"`
+	Last  time.Time `json:"last"`
+}
+
+type InventoryPool struct {
+	Priority int64  `json:"priority"`
+	URL      string `json:"url"`
+	User     string `json:"user"`
+	Password string `json:"password,omitempty"` // pool baseline only - from pools baseline -f
+}
+
+type InventoryHealth struct {
+	Time      time.Time `json:"time"`
+	State     string    `json:"state"` // ok, degraded (a device down / no hashrate), no-api
+	MHSav     float64   `json:"mhs_av,omitempty"`
+	DevsAlive int       `json:"devs_alive,omitempty"`
+	DevsTotal int       `json:"devs_total,omitempty"`
+	MaxTemp   float64   `json:"max_temp,omitempty"`
+	Errors    []string  `json:"errors,omitempty"`
+}
+
+type Inventory struct {
+	Schema  int                        `json:"schema"`
+	Updated time.Time                  `json:"updated"`
+	Miners  map[string]*InventoryMiner `json:"miners"`
+}
+
+// How many boot times to keep for each miner (horus triage counts reboots).
+const inventory_boots = 20
+
+var inventory_mu sync.Mutex // one update at a time (exporter and watch scan from goroutines)
+
+/////////////////////////////////////////////////////////////
+// lockInventory
+// inventory_mu, then the lock file next to the register - to
+// hold from loadInventory to save.  Returns the unlock.
+/////////////////////////////////////////////////////////////
+func lockInventory() (func(), error) {
+	inventory_mu.Lock()
+	path := inventoryPath() + ".lock"
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		inventory_mu.Unlock()
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		inventory_mu.Unlock()
+		return nil, err
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		inventory_mu.Unlock()
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return func() {
+		unlockFile(f)
+		f.Close()
+		inventory_mu.Unlock()
+	}, nil
+}
+
+func inventoryPath() string {
+	if inventory_file != "" {
+		return inventory_file
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		dir = "."
+	}
+	return filepath.Join(dir, "horus", "inventory.json")
+}
+
+func inventoryEnabled() bool {
+	return inventory_file != "none"
+}
+
+/////////////////////////////////////////////////////////////
+// loadInventory
+// A missing file is an empty register, not an error.
+/////////////////////////////////////////////////////////////
+func loadInventory() (*Inventory, error) {
+	inv := &Inventory{Schema: inventory_schema, Miners: make(map[string]*InventoryMiner)}
+
+	data, err := os.ReadFile(inventoryPath())
+	if os.IsNotExist(err) {
+		return inv, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, inv); err != nil {
+		return nil, fmt.Errorf("%s: %s", inventoryPath(), err)
+	}
+	if inv.Schema > inventory_schema {
+		return nil, fmt.Errorf("%s: made by a newer horus (schema %d)", inventoryPath(), inv.Schema)
+	}
+	if inv.Miners == nil {
+		inv.Miners = make(map[string]*InventoryMiner)
+	}
+	return inv, nil
+}
+
+func (inv *Inventory) save() error {
+	path := inventoryPath()
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	inv.Schema = inventory_schema
+	inv.Updated = time.Now()
+	data, err := json.MarshalIndent(inv, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+/////////////////////////////////////////////////////////////
+// rememberScan
+// Called after every scan: the miners found (and the ones the
+// arp table says are miners) - where they are, not how they are.
+/////////////////////////////////////////////////////////////
+func rememberScan(m *MyNet) {
+	if !inventoryEnabled() {
+		return
+	}
+
+	var records []HostRecord
+	for _, rec := range scanRecords(m) {
+		if rec.Miner || m.Neighbors[rec.Host].Miner {
+			records = append(records, rec)
+		}
+	}
+	if len(records) == 0 {
+		return
+	}
+	if err := updateInventory(records, detailSet{}); err != nil {
+		fmt.Printf("Inventory (%s) not updated: %s\n", inventoryPath(), err)
+	}
+}
+
+// Called with what a command polled: model, firmware, pools and health.
+func rememberRecords(records []HostRecord, d detailSet) {
+	if !inventoryEnabled() || len(records) == 0 || !(d.version || d.summary || d.pools) {
+		return
+	}
+	if err := updateInventory(records, d); err != nil {
+		fmt.Printf("Inventory (%s) not updated: %s\n", inventoryPath(), err)
+	}
+}
+
+func updateInventory(records []HostRecord, d detailSet) error {
+	unlock, err := lockInventory()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	inv, err := loadInventory()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, rec := range records {
+		inv.remember(rec, d, now)
+	}
+	return inv.save()
+}
+
+/////////////////////////////////////////////////////////////
+// remember
+// Find the miner (by MAC, then by address for the ones we have
+// no MAC for) and bring it up to date with what d asked for.
+/////////////////////////////////////////////////////////////
+func (inv *Inventory) remember(rec HostRecord, d detailSet, now time.Time) {
+	e := inv.find(rec)
+	if e == nil {
+		e = &InventoryMiner{FirstSeen: now}
+	}
+
+	// First time we get the MAC of a miner we only knew by address - it moves to its MAC.
+	id := rec.MAC
+	if id == "" {
+		id = e.ID
+	}
+	if id == "" {
+		id = "ip:" + rec.Host
+	}
+	if e.ID != id {
+		delete(inv.Miners, e.ID)
+		e.ID = id
+	}
+	inv.Miners[id] = e
+
+	e.LastSeen = now
+	if rec.MAC != "" {
+		e.MAC = rec.MAC
+	}
+	if rec.Vendor != "" {
+		e.Vendor = rec.Vendor
+	}
+
+	e.IP = rec.Host
+	if n := len(e.IPHistory); n > 0 && e.IPHistory[n-1].IP == rec.Host {
+		e.IPHistory[n-1].Last = now
+	} else {
+		e.IPHistory = append(e.IPHistory, InventoryIP{IP: rec.Host, First: now, Last: now})
+	}
+
+	if rec.Dialect != "" {
+		e.Dialect = rec.Dialect
+	}
+	if v := rec.Version; v != nil {
+		if v.Type != "" {
+			e.Model = v.Type
+		}
+		if fw := firmwareName(rec); fw != "" {
+			e.Firmware = fw
+		}
+	}
+	if rec.Pools != nil {
+		e.Pools = nil
+		for _, p := range rec.Pools {
+			e.Pools = append(e.Pools, InventoryPool{Priority: p.Priority, URL: p.URL, User: p.User})
+		}
+	}
+	// A miner the scan found but nobody polled keeps the health it had.
+	if d.summary || !rec.Miner {
+		e.Health = recordHealth(rec, now)
+	}
+
+	if s := rec.Summary; s != nil && s.Elapsed > 0 {
+		// Uptime and our clock drift a little between scans - within a minute is the same boot.
+		boot := now.Add(-time.Duration(s.Elapsed) * time.Second).Truncate(time.Second)
+		if n := len(e.Boots); n == 0 || boot.Sub(e.Boots[n-1]) > time.Minute {
+			e.Boots = append(e.Boots, boot)
+			if len(e.Boots) > inventory_boots {
+				e.Boots = e.Boots[len(e.Boots)-inventory_boots:]
+			}
+		}
+	}
+}
+
+func (inv *Inventory) find(rec HostRecord) *InventoryMiner {
+	if rec.MAC != "" {
+		if e, ok := inv.Miners[rec.MAC]; ok {
+			return e
+		}
+	}
+	if e, ok := inv.Miners["ip:"+rec.Host]; ok {
+		return e
+	}
+	if rec.MAC == "" {
+		// No MAC (not on our segment) - whatever was last seen on this address.
+		var found *InventoryMiner
+		for _, e := range inv.Miners {
+			if e.IP == rec.Host && (found == nil || e.LastSeen.After(found.LastSeen)) {
+				found = e
+			}
+		}
+		return found
+	}
+	return nil
+}
+
+// The firmware build if the miner tells us, otherwise the miner software and version.
+func firmwareName(rec HostRecord) string {
+	v := rec.Version
+	switch {
+	case v.Miner != "":
+		return v.Miner
+	case v.BMMiner != "":
+		return "bmminer " + v.BMMiner
+	case v.SGMiner != "":
+		return "sgminer " + v.SGMiner
+	case v.CGMiner != "":
+		return "cgminer " + v.CGMiner
+	}
+	return ""
+}
+
+func recordHealth(rec HostRecord, now time.Time) InventoryHealth {
+	h := InventoryHealth{Time: now, State: "ok", Errors: rec.Errors}
+	if rec.Summary == nil {
+		h.State = "no-api"
+		return h
+	}
+	h.MHSav = rec.Summary.MHSav
+	h.DevsTotal = len(rec.Devs)
+	for _, d := range rec.Devs {
+		if d.Status == "Alive" {
+			h.DevsAlive++
+		}
+		if d.Temperature > h.MaxTemp {
+			h.MaxTemp = d.Temperature
+		}
+	}
+	if h.DevsAlive < h.DevsTotal || h.MHSav == 0 {
+		h.State = "degraded"
+	}
+	return h
+}
+
+/////////////////////////////////////////////////////////////
+// lookup - by id, MAC (any case or separator) or current ip
+/////////////////////////////////////////////////////////////
+func (inv *Inventory) lookup(key string) *InventoryMiner {
+	if e, ok := inv.Miners[key]; ok {
+		return e
+	}
+	if mac := normalizeMAC(key); mac != "" {
+		if e, ok := inv.Miners[mac]; ok {
+			return e
+		}
+	}
+	if e, ok := inv.Miners["ip:"+key]; ok {
+		return e
+	}
+	for _, e := range inv.Miners {
+		if e.IP == key {
+			return e
+		}
+	}
+	return nil
+}
+
+// In address order - the newest first when miners shared an address.
+func (inv *Inventory) sorted() []*InventoryMiner {
+	var list []*InventoryMiner
+	var ips []string
+	byIP := make(map[string][]*InventoryMiner)
+	for _, e := range inv.Miners {
+		if _, ok := byIP[e.IP]; !ok {
+			ips = append(ips, e.IP)
+		}
+		byIP[e.IP] = append(byIP[e.IP], e)
+	}
+	sortIPs(ips)
+	for _, ip := range ips {
+		same := byIP[ip]
+		sort.Slice(same, func(i, j int) bool { return same[i].LastSeen.After(same[j].LastSeen) })
+		list = append(list, same...)
+	}
+	return list
+}
+
+/////////////////////////////////////////////////////////////
+// cmdInventory
+// horus inventory list | show <MAC OR IP> | forget <MAC OR IP> ...
+/////////////////////////////////////////////////////////////
+func cmdInventory(args []string) int {
+	if !inventoryEnabled() {
+		fmt.Println("Error: the inventory is turned off (-inventory none)")
+		return 1
+	}
+
+	action := "list"
+	if len(args) > 0 {
+		action, args = args[0], args[1:]
+	}
+
+	unlock, err := lockInventory()
+	if err != nil {
+		fmt.Println("Error: ", err)
+		return 1
+	}
+	defer unlock()
+
+	inv, err := loadInventory()
+	if err != nil {
+		fmt.Println("Error: ", err)
+		return 1
+	}
+
+	switch action {
+	case "list":
+		list := inv.sorted()
+		if writeInventory(list) {
+			return 0
+		}
+		fmt.Printf("\nInventory (%s): %d miner(s)\n\n", inventoryPath(), len(list))
+		fmt.Printf("%-17s %-15s %-20s %-24s %-10s %-16s %s\n", "MAC", "IP", "MODEL", "FIRMWARE", "HEALTH", "FIRST SEEN", "LAST SEEN")
+		for _, e := range list {
+			fmt.Printf("%-17s %-15s %-20s %-24s %-10s %-16s %s\n", orDash(e.MAC), e.IP, orDash(e.Model), orDash(e.Firmware),
+				orDash(e.Health.State), e.FirstSeen.Format("2006-01-02 15:04"), e.LastSeen.Format("2006-01-02 15:04"))
+		}
+		return 0
+
+	case "show":
+		if len(args) == 0 {
+			fmt.Println("Error: show needs the MAC or IP of a miner")
+			return 1
+		}
+		var list []*InventoryMiner
+		for _, key := range args {
+			e := inv.lookup(key)
+			if e == nil {
+				fmt.Printf("Error: %s is not in the inventory\n", key)
+				return 1
+			}
+			list = append(list, e)
+		}
+		if writeInventory(list) {
+			return 0
+		}
+		for _, e := range list {
+			showInventoryMiner(e)
+		}
+		return 0
+
+	case "forget":
+		if len(args) == 0 {
+			fmt.Println("Error: forget needs the MAC or IP of the miner(s) to forget")
+			return 1
+		}
+		status := 0
+		for _, key := range args {
+			e := inv.lookup(key)
+			if e == nil {
+				fmt.Printf("%s is not in the inventory\n", key)
+				status = 1
+				continue
+			}
+			delete(inv.Miners, e.ID)
+			fmt.Printf("Forgot %s (%s)\n", e.ID, e.IP)
+		}
+		if err := inv.save(); err != nil {
+			fmt.Println("Error: ", err)
+			return 1
+		}
+		return status
+	}
+
+	fmt.Printf("Error: unknown inventory action (%s) - list, show or forget\n", action)
+	return 1
+}
+
+func showInventoryMiner(e *InventoryMiner) {
+	fmt.Printf("\nMiner %s\n", e.ID)
+	fmt.Printf("...MAC: %s  Vendor: %s\n", orDash(e.MAC), orDash(e.Vendor))
+	fmt.Printf("...Model: %s  Firmware: %s  Api: %s\n", orDash(e.Model), orDash(e.Firmware), orDash(e.Dialect))
+	fmt.Printf("...First seen: %s  Last seen: %s\n", e.FirstSeen.Format(time.RFC1123), e.LastSeen.Format(time.RFC1123))
+
+	h := e.Health
+	if h.Time.IsZero() {
+		fmt.Println("...Health: - (only scanned so far, not polled)")
+	} else {
+		fmt.Printf("...Health: %s (%s)  MHS av: %.2f  Devices alive: %d/%d  Max temp: %.1f\n",
+			h.State, h.Time.Format("2006-01-02 15:04"), h.MHSav, h.DevsAlive, h.DevsTotal, h.MaxTemp)
+	}
+	for _, err := range h.Errors {
+		fmt.Printf("......%s\n", err)
+	}
+
+	if n := len(e.Boots); n > 0 {
+		fmt.Printf("...Booted: %s (%d boot(s) seen since %s)\n", e.Boots[n-1].Format("2006-01-02 15:04"), n, e.Boots[0].Format("2006-01-02 15:04"))
+	}
+
+	fmt.Println("...Addresses:")
+	for _, ip := range e.IPHistory {
+		fmt.Printf("......%-15s %s - %s\n", ip.IP, ip.First.Format("2006-01-02 15:04"), ip.Last.Format("2006-01-02 15:04"))
+	}
+
+	fmt.Println("...Pools:")
+	for _, p := range e.Pools {
+		fmt.Printf("......%d: (URL: %s) (User: %s)\n", p.Priority, p.URL, p.User)
+	}
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+/////////////////////////////////////////////////////////////
+// writeInventory
+// The register in the -output format.  Returns false for table.
+/////////////////////////////////////////////////////////////
+var inventory_csv_columns = []string{
+	"id", "mac", "vendor", "ip", "ip_count", "first_seen", "last_seen", "model", "firmware", "dialect",
+	"pool_url", "pool_user", "health", "health_time", "mhs_av", "devs_alive", "devs_total", "max_temp",
+}
+
+func writeInventory(list []*InventoryMiner) bool {
+	if !machineOutput() {
+		return false
+	}
+	if list == nil {
+		list = []*InventoryMiner{}
+	}
+
+	var err error
+	switch output_format {
+	case "json", "yaml":
+		doc := map[string]interface{}{
+			"schema":        inventory_schema,
+			"horus_version": Horus_Version,
+			"generated":     time.Now().Format(time.RFC3339),
+			"miners":        list,
+		}
+		var b []byte
+		if output_format == "json" {
+			if b, err = json.MarshalIndent(doc, "", "  "); err == nil {
+				_, err = fmt.Fprintf(data_out, "%s\n", b)
+			}
+		} else if b, err = json.Marshal(doc); err == nil {
+			if b, err = jsonToYAML(b); err == nil {
+				_, err = fmt.Fprintf(data_out, "---\n%s", b)
+			}
+		}
+
+	case "ndjson":
+		enc := json.NewEncoder(data_out)
+		for _, e := range list {
+			if err = enc.Encode(e); err != nil {
+				break
+			}
+		}
+
+	case "csv":
+		w := csv.NewWriter(data_out)
+		w.Write(inventory_csv_columns)
+		for _, e := range list {
+			pool_url, pool_user := "", ""
+			if len(e.Pools) > 0 {
+				pool_url, pool_user = e.Pools[0].URL, e.Pools[0].User
+			}
+			w.Write([]string{
+				e.ID, e.MAC, e.Vendor, e.IP, strconv.Itoa(len(e.IPHistory)),
+				e.FirstSeen.Format(time.RFC3339), e.LastSeen.Format(time.RFC3339),
+				e.Model, e.Firmware, e.Dialect, pool_url, pool_user,
+				e.Health.State, e.Health.Time.Format(time.RFC3339),
+				strconv.FormatFloat(e.Health.MHSav, 'f', -1, 64), strconv.Itoa(e.Health.DevsAlive),
+				strconv.Itoa(e.Health.DevsTotal), strconv.FormatFloat(e.Health.MaxTemp, 'f', -1, 64),
+			})
+		}
+		w.Flush()
+		err = w.Error()
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error writing output: ", err)
+	}
+	return true
+}
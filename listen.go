@@ -0,0 +1,247 @@
+package main
+
+//
+// horus listen:
+// When the "IP Report" button on an Antminer is pressed, the miner
+// broadcasts its ip and mac over UDP (port 14235) - several other vendors
+// do something similar on their own ports.  We sit on the port(s), decode
+// whatever turns up and ask the miner's api who it is.  This is how a
+// technician finds a box that was just racked on a DHCP network.
+//
+// USAGE:
+//	horus listen [-udp 14235,...] [-for 10m]
+//
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cgminer-api"
+)
+
+const default_report_ports = "14235"
+
+// The button sends the same report a few times - only show it once per window.
+const report_dedupe = 30 * time.Second
+
+type IPReport struct {
+	IP   string // what the miner says its ip is
+	MAC  string
+	From string // where the packet came from
+	Raw  string
+}
+
+/////////////////////////////////////////////////////////////
+// listen options
+/////////////////////////////////////////////////////////////
+var listen_udp string = default_report_ports
+var listen_for time.Duration = 0
+
+func listenFlags(fs *flag.FlagSet) {
+	fs.StringVar(&listen_udp, "udp", listen_udp, "UDP port(s) to listen on, comma separated")
+	fs.DurationVar(&listen_for, "for", listen_for, "Stop listening after this long (0: until Ctrl-C)")
+}
+
+/////////////////////////////////////////////////////////////
+// runListen
+// horus listen [-udp ports] [-for duration]
+// Returns the exit status.
+/////////////////////////////////////////////////////////////
+func runListen(args []string) int {
+	if len(args) > 0 {
+		fmt.Println("Error: listen does not take addresses - the miners come to us: ", args)
+		return 1
+	}
+
+	reports := make(chan IPReport)
+
+	for _, port := range strings.Split(listen_udp, ",") {
+		port = strings.TrimSpace(port)
+		if _, err := strconv.Atoi(port); err != nil {
+			fmt.Printf("Error: bad udp port (%s)\n", port)
+			return 1
+		}
+
+		conn, err := net.ListenPacket("udp4", ":"+port)
+		if err != nil {
+			fmt.Printf("Error: cannot listen on udp port %s: %s\n", port, err)
+			return 1
+		}
+		defer conn.Close()
+
+		fmt.Printf("Listening for miner IP reports on udp port %s ...\n", port)
+		go readReports(conn, reports)
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt)
+
+	var timeout <-chan time.Time
+	if listen_for > 0 {
+		timeout = time.After(listen_for)
+	}
+
+	seen := make(map[string]time.Time)
+	var wg sync.WaitGroup
+
+	for {
+		select {
+		case r := <-reports:
+			key := r.MAC + "/" + r.IP
+			if last, ok := seen[key]; ok && time.Since(last) < report_dedupe {
+				continue
+			}
+			seen[key] = time.Now()
+
+			fmt.Printf("\n%s IP Report: IP: %s MAC: %s (from %s)\n", time.Now().Format("15:04:05"), r.IP, r.MAC, r.From)
+
+			// Ask the miner about itself - without holding up the next report.
+			wg.Add(1)
+			go func(r IPReport) {
+				defer wg.Done()
+				describeReportedMiner(r)
+			}(r)
+
+		case <-stop:
+			fmt.Println("\nStopped.")
+			wg.Wait()
+			return 0
+
+		case <-timeout:
+			wg.Wait()
+			return 0
+		}
+	}
+}
+
+// Read packets forever (until the socket is closed), pass on anything we can decode.
+func readReports(conn net.PacketConn, reports chan<- IPReport) {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		from := addr.String()
+		if ua, ok := addr.(*net.UDPAddr); ok {
+			from = ua.IP.String()
+		}
+
+		r, ok := decodeIPReport(buf[:n], from)
+		if debug {
+			fmt.Printf("udp packet from %s (%d bytes): %q decoded: %v\n", from, n, buf[:n], ok)
+		}
+		if ok {
+			reports <- r
+		}
+	}
+}
+
+/////////////////////////////////////////////////////////////
+// decodeIPReport
+// Bitmain sends plain text: "10.0.4.23,b4:10:7b:01:02:03"
+// Other firmware sends JSON ({"ip":..., "mac":...}) or some
+// other text with an ip and mac in it - we take any of those.
+// If all we get is a mac, the sender address is the ip.
+/////////////////////////////////////////////////////////////
+func decodeIPReport(payload []byte, from string) (IPReport, bool) {
+	text := strings.TrimSpace(strings.Trim(string(payload), "\x00"))
+	r := IPReport{From: from, Raw: text}
+
+	var js map[string]interface{}
+	if json.Unmarshal([]byte(text), &js) == nil {
+		for k, v := range js {
+			s, ok := v.(string)
+			if !ok {
+				continue
+			}
+			switch strings.ToLower(k) {
+			case "ip", "ipaddr", "ip_address":
+				r.IP = s
+			case "mac", "macaddr", "mac_address":
+				r.MAC = normalizeMAC(s)
+			}
+		}
+	} else {
+		r.IP = arp_ip_re.FindString(text)
+		r.MAC = normalizeMAC(arp_mac_re.FindString(text))
+	}
+
+	if net.ParseIP(r.IP) == nil {
+		r.IP = ""
+	}
+	if r.MAC == "" {
+		return r, false
+	}
+	if r.IP == "" {
+		r.IP = from
+	}
+	return r, true
+}
+
+/////////////////////////////////////////////////////////////
+// describeReportedMiner
+// Vendor from the mac, model / firmware / hashrate / pool
+// from the miner api.
+/////////////////////////////////////////////////////////////
+func describeReportedMiner(r IPReport) {
+	if machineOutput() {
+		rec := newRecord(r.IP)
+		rec.MAC = r.MAC
+		if v, ok := lookupOUI(r.MAC); ok {
+			rec.Vendor = v.Name
+		}
+		addDetails(&rec, detailSet{version: true, summary: true, pools: true})
+		rec.Miner = rec.Version != nil
+		writeRecords([]HostRecord{rec})
+		return
+	}
+
+	var lines []string
+
+	if v, ok := lookupOUI(r.MAC); ok {
+		lines = append(lines, fmt.Sprintf("...Vendor: %s", v.Name))
+	}
+
+	miner := cgminer.New(r.IP, 4028)
+
+	version, err := miner.Version()
+	if err != nil {
+		lines = append(lines, fmt.Sprintf("...API not answering on %s:4028 (%s)", r.IP, err))
+		printReportLines(r, lines)
+		return
+	}
+	if version.Type != "" {
+		lines = append(lines, fmt.Sprintf("...Model: %s", version.Type))
+	}
+	if version.Miner != "" {
+		lines = append(lines, fmt.Sprintf("...Firmware: %s", version.Miner))
+	}
+
+	if summary, err := miner.Summary(); err == nil {
+		lines = append(lines, fmt.Sprintf("...MHS av: %.2f  Elapsed: %ds  Accepted: %d  Rejected: %d",
+			summary.MHSav, summary.Elapsed, summary.Accepted, summary.Rejected))
+	}
+
+	if pools, err := miner.Pools(); err == nil {
+		for _, pool := range pools {
+			lines = append(lines, fmt.Sprintf("...Pool %d: (URL: %s) (User: %s) %s", pool.Pool, pool.URL, pool.User, pool.Status))
+		}
+	}
+
+	printReportLines(r, lines)
+}
+
+// One Println per miner so lines from different miners do not interleave.
+func printReportLines(r IPReport, lines []string) {
+	fmt.Printf("Miner at %s (%s):\n%s\n", r.IP, r.MAC, strings.Join(lines, "\n"))
+}
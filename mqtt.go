@@ -0,0 +1,113 @@
+package main
+
+//
+// Just enough MQTT (3.1.1) to publish a message: CONNECT, wait for
+// CONNACK, PUBLISH at QoS 0, DISCONNECT.  One connection per message -
+// notifications are rare, and it saves keeping a session alive.
+//
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// Each connection gets its own client id - a broker drops the session that
+// already has an id when another connects with it, and every mqtt channel
+// (and every retry) connects on its own.
+var mqtt_connections uint64
+
+
+/////////////////////////////////////////////////////////////
+// mqttPublish
+// u is tcp://[user:pass@]host[:port] (port 1883 if not given)
+/////////////////////////////////////////////////////////////
+func mqttPublish(u *url.URL, topic string, payload []byte) error {
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "1883")
+	}
+
+	conn, err := net.DialTimeout("tcp", addr, connection_timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	// CONNECT: protocol name, level 4, flags, keepalive, client id [, user [, password]]
+	var body bytes.Buffer
+	mqttString(&body, "MQTT")
+	body.WriteByte(4)
+	flags := byte(0x02) // clean session
+	if u.User != nil {
+		flags |= 0x80
+		if _, ok := u.User.Password(); ok {
+			flags |= 0x40
+		}
+	}
+	body.WriteByte(flags)
+	body.Write([]byte{0, 60})
+	mqttString(&body, fmt.Sprintf("horus-%d-%d", os.Getpid(), atomic.AddUint64(&mqtt_connections, 1)))
+	if u.User != nil {
+		mqttString(&body, u.User.Username())
+		if pass, ok := u.User.Password(); ok {
+			mqttString(&body, pass)
+		}
+	}
+	if err := mqttPacket(conn, 0x10, body.Bytes()); err != nil {
+		return err
+	}
+
+	// CONNACK: 0x20 0x02 flags code
+	ack := make([]byte, 4)
+	if _, err := io.ReadFull(conn, ack); err != nil {
+		return fmt.Errorf("no CONNACK: %s", err)
+	}
+	if ack[0] != 0x20 {
+		return fmt.Errorf("expected CONNACK, got packet type %#x", ack[0])
+	}
+	if ack[3] != 0 {
+		return fmt.Errorf("broker refused the connection (code %d)", ack[3])
+	}
+
+	// PUBLISH QoS 0: topic, payload (no packet id)
+	body.Reset()
+	mqttString(&body, topic)
+	body.Write(payload)
+	if err := mqttPacket(conn, 0x30, body.Bytes()); err != nil {
+		return err
+	}
+
+	return mqttPacket(conn, 0xe0, nil) // DISCONNECT
+}
+
+// Fixed header (type, remaining length as a varint) then the body.
+func mqttPacket(w io.Writer, kind byte, body []byte) error {
+	packet := []byte{kind}
+	n := len(body)
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		packet = append(packet, b)
+		if n == 0 {
+			break
+		}
+	}
+	_, err := w.Write(append(packet, body...))
+	return err
+}
+
+func mqttString(b *bytes.Buffer, s string) {
+	b.WriteByte(byte(len(s) >> 8))
+	b.WriteByte(byte(len(s)))
+	b.WriteString(s)
+}
@@ -0,0 +1,183 @@
+package main
+
+//
+// ARP / neighbor table harvesting:
+// Once the scan has touched every address, the OS neighbor table holds the
+// MAC address of every host on the local segment that answered ARP - even
+// the ones that did not answer on any of our ports.  The MAC is the only
+// identity that survives DHCP churn, and its OUI tells us who made the box.
+//
+// Linux reads /proc/net/arp (neighbors_linux.go), everything else parses
+// the output of "arp -a" (neighbors_other.go).
+//
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+type Neighbor struct {
+	IP     string
+	MAC    string // aa:bb:cc:dd:ee:ff
+	Vendor string // from the OUI table, "" if unknown
+	Miner  bool   // the OUI belongs to a miner manufacturer
+}
+
+var arp_ip_re = regexp.MustCompile(`\b(\d{1,3}\.\d{1,3}\.\d{1,3}\.\d{1,3})\b`)
+var arp_mac_re = regexp.MustCompile(`(?i)\b([0-9a-f]{1,2}[:-]){5}[0-9a-f]{1,2}\b`)
+
+/////////////////////////////////////////////////////////////
+// harvestNeighbors
+// Attach a MAC (and vendor) to every address in the neighbor
+// table that was part of this scan.
+/////////////////////////////////////////////////////////////
+func harvestNeighbors(m *MyNet, specs []string) {
+	table, err := readNeighborTable()
+	if err != nil {
+		if debug {
+			fmt.Println("Cannot read the neighbor (arp) table: ", err)
+		}
+		return
+	}
+
+	nets := scannedNets(specs)
+
+	for ip, mac := range table {
+		if !inScannedNets(nets, ip) {
+			continue
+		}
+
+		n := Neighbor{IP: ip, MAC: mac}
+		if v, ok := lookupOUI(mac); ok {
+			n.Vendor = v.Name
+			n.Miner = v.Miner
+		} else if isLocalMAC(mac) {
+			n.Vendor = "(locally administered)"
+		}
+
+		m.Neighbors[ip] = n
+		if h, ok := m.Hosts[ip]; ok {
+			h.MAC = mac
+			h.Vendor = n.Vendor
+		}
+	}
+}
+
+/////////////////////////////////////////////////////////////
+// parseArpLines
+// Pull ip / mac pairs out of any arp listing that has one
+// host per line (arp -a on windows, mac, bsd).
+// Incomplete entries have no mac and are skipped.
+/////////////////////////////////////////////////////////////
+func parseArpLines(text string) map[string]string {
+	table := make(map[string]string)
+
+	for _, line := range strings.Split(text, "\n") {
+		ip := arp_ip_re.FindString(line)
+		mac := arp_mac_re.FindString(line)
+		if ip == "" || mac == "" {
+			continue
+		}
+		if mac = normalizeMAC(mac); mac != "" {
+			table[ip] = mac
+		}
+	}
+	return table
+}
+
+// "0:1b:2C:3-4-5" styles -> "00:1b:2c:03:04:05".  "" for the all zero mac.
+func normalizeMAC(mac string) string {
+	parts := strings.FieldsFunc(strings.ToLower(mac), func(r rune) bool { return r == ':' || r == '-' })
+	if len(parts) != 6 {
+		return ""
+	}
+	for i, p := range parts {
+		if len(p) == 1 {
+			parts[i] = "0" + p
+		}
+	}
+	mac = strings.Join(parts, ":")
+	if mac == "00:00:00:00:00:00" || mac == "ff:ff:ff:ff:ff:ff" {
+		return ""
+	}
+	return mac
+}
+
+// The second bit of the first octet marks a locally administered
+// (made up / randomised) address - no OUI to look up.
+func isLocalMAC(mac string) bool {
+	hw, err := net.ParseMAC(mac)
+	return err == nil && len(hw) > 0 && hw[0]&0x02 != 0
+}
+
+// The cidr blocks (and single ips as /32) that were scanned.
+func scannedNets(specs []string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, spec := range specs {
+		if !strings.Contains(spec, "/") {
+			spec += "/32"
+		}
+		if _, ipnet, err := net.ParseCIDR(spec); err == nil {
+			nets = append(nets, ipnet)
+		}
+	}
+	return nets
+}
+
+func inScannedNets(nets []*net.IPNet, ip string) bool {
+	addr := net.ParseIP(ip)
+	for _, n := range nets {
+		if n.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+/////////////////////////////////////////////////////////////
+// reportNeighbors
+// MAC and vendor for every host we found in the neighbor table,
+// and the ones that look like miners but whose api did not answer.
+/////////////////////////////////////////////////////////////
+func reportNeighbors(m *MyNet) {
+	if len(m.Neighbors) == 0 {
+		return
+	}
+
+	var hosts []string
+	for ip := range m.Neighbors {
+		hosts = append(hosts, ip)
+	}
+	sort.Strings(hosts)
+
+	api := make(map[string]bool)
+	for _, ip := range m.AvailableIPs {
+		api[ip] = true
+	}
+
+	fmt.Println("\nMAC addresses (from the neighbor table):")
+	var likely []Neighbor
+	for _, ip := range hosts {
+		n := m.Neighbors[ip]
+		fmt.Printf(" ... IP: %-15s %s %s\n", ip, n.MAC, n.Vendor)
+		if n.Miner && !api[ip] {
+			likely = append(likely, n)
+		}
+	}
+
+	if len(likely) > 0 {
+		fmt.Println("\nLikely miners, API unreachable:")
+		for _, n := range likely {
+			state := "no answer"
+			if h, ok := m.Hosts[n.IP]; ok {
+				state = h.State
+			}
+			fmt.Printf(" ... IP: %-15s %s %s (%s)\n", n.IP, n.MAC, n.Vendor, state)
+		}
+	} else if oui_registry == "" {
+		fmt.Println("\n(No OUI registry loaded - miners whose api does not answer are only recognised with -oui oui.txt)")
+	}
+}
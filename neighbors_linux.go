@@ -0,0 +1,31 @@
+package main
+
+import (
+	"os"
+	"strings"
+)
+
+// readNeighborTable - ip -> mac from /proc/net/arp
+//
+//	IP address       HW type     Flags       HW address            Mask     Device
+//	10.0.0.5         0x1         0x2         aa:bb:cc:dd:ee:ff     *        eth0
+//
+// Flags 0x0 is an incomplete entry (nobody answered the arp).
+func readNeighborTable() (map[string]string, error) {
+	data, err := os.ReadFile("/proc/net/arp")
+	if err != nil {
+		return nil, err
+	}
+
+	table := make(map[string]string)
+	for i, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if i == 0 || len(fields) < 4 || fields[2] == "0x0" {
+			continue
+		}
+		if mac := normalizeMAC(fields[3]); mac != "" {
+			table[fields[0]] = mac
+		}
+	}
+	return table, nil
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "os/exec"
+
+// readNeighborTable - ip -> mac from "arp -a"
+// windows:  10.0.0.5              aa-bb-cc-dd-ee-ff     dynamic
+// mac/bsd:  ? (10.0.0.5) at aa:bb:cc:dd:ee:ff on en0 ifscope [ethernet]
+func readNeighborTable() (map[string]string, error) {
+	out, err := exec.Command("arp", "-a").Output()
+	if err != nil {
+		return nil, err
+	}
+	return parseArpLines(string(out)), nil
+}
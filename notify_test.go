@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// One SMTP conversation: the commands the client sent, and the message.
+type smtpSession struct {
+	commands []string
+	data     string
+}
+
+// A mail server on a local port that takes one message and hands it over.
+func smtpStub(t *testing.T) (string, chan smtpSession) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	got := make(chan smtpSession, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		in := bufio.NewReader(conn)
+		reply := func(s string) { fmt.Fprintf(conn, "%s\r\n", s) }
+
+		var s smtpSession
+		reply("220 stub ESMTP")
+		for {
+			line, err := in.ReadString('\n')
+			if err != nil {
+				got <- s
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			s.commands = append(s.commands, line)
+			switch verb := strings.ToUpper(strings.Fields(line + " x")[0]); verb {
+			case "EHLO":
+				reply("250 stub")
+			case "DATA":
+				reply("354 go ahead")
+				var data bytes.Buffer
+				for {
+					l, err := in.ReadString('\n')
+					if err != nil || l == ".\r\n" {
+						break
+					}
+					data.WriteString(l)
+				}
+				s.data = data.String()
+				reply("250 queued")
+			case "QUIT":
+				reply("221 bye")
+				got <- s
+				return
+			default:
+				reply("250 ok")
+			}
+		}
+	}()
+	return ln.Addr().String(), got
+}
+
+func TestSendMail(t *testing.T) {
+	addr, got := smtpStub(t)
+	ch, err := parseChannel("smtp smtp://" + addr + "?from=horus@example.com&to=ops@example.com,night@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// What the miner reported ends up in the subject - it must not make headers.
+	n := Notification{
+		Subject: "pool-changed 10.0.2.5\r\nBcc: someone@example.net\rX-Injected: yes\n",
+		Time:    time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC),
+	}
+	if err := sendMail(ch, n, "line one\nline two"); err != nil {
+		t.Fatal(err)
+	}
+
+	var s smtpSession
+	select {
+	case s = <-got:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no mail")
+	}
+
+	want := []string{"MAIL FROM:<horus@example.com>", "RCPT TO:<ops@example.com>", "RCPT TO:<night@example.com>", "DATA", "QUIT"}
+	if len(s.commands) == 0 || !strings.HasPrefix(s.commands[0], "EHLO ") {
+		t.Fatalf("dialogue: %q", s.commands)
+	}
+	if sent := s.commands[1:]; strings.Join(sent, "|") != strings.Join(want, "|") {
+		t.Errorf("dialogue:\n got %q\nwant %q", sent, want)
+	}
+
+	head := s.data
+	if i := strings.Index(head, "\r\n\r\n"); i >= 0 {
+		head = head[:i+2]
+	} else {
+		t.Fatalf("no end of headers in %q", s.data)
+	}
+	headers := strings.Split(strings.TrimSuffix(head, "\r\n"), "\r\n")
+	for _, h := range headers {
+		if strings.ContainsAny(h, "\r\n") {
+			t.Errorf("bare line break in header %q", h)
+		}
+		if strings.HasPrefix(h, "Bcc:") || strings.HasPrefix(h, "X-Injected:") {
+			t.Errorf("injected header %q", h)
+		}
+	}
+	subject := "Subject: horus: pool-changed 10.0.2.5 Bcc: someone@example.net X-Injected: yes"
+	found := false
+	for _, h := range headers {
+		found = found || h == subject
+	}
+	if !found {
+		t.Errorf("no %q in %q", subject, headers)
+	}
+	if !strings.HasSuffix(s.data, "\r\n\r\nline one\r\nline two\r\n") {
+		t.Errorf("body: %q", s.data)
+	}
+}
+
+// One MQTT packet: the type byte and the body.
+func readMQTT(r *bufio.Reader) (byte, []byte, error) {
+	kind, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	n, shift := 0, uint(0)
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		n |= int(b&0x7f) << shift
+		if b&0x80 == 0 {
+			break
+		}
+		shift += 7
+	}
+	body := make([]byte, n)
+	_, err = io.ReadFull(r, body)
+	return kind, body, err
+}
+
+func mqttField(b []byte) (string, []byte) {
+	n := int(binary.BigEndian.Uint16(b))
+	return string(b[2 : 2+n]), b[2+n:]
+}
+
+// What a broker saw of one connection.
+type mqttSession struct {
+	client, user, password string
+	flags                  byte
+	topic                  string
+	payload                []byte
+	disconnected           bool
+	err                    error
+}
+
+// A broker on a local port that answers CONNECT with code.
+func mqttStub(t *testing.T, code byte) (string, chan mqttSession) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	got := make(chan mqttSession, 4)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				conn.SetDeadline(time.Now().Add(5 * time.Second))
+				in := bufio.NewReader(conn)
+				var s mqttSession
+				defer func() { got <- s }()
+
+				kind, body, err := readMQTT(in)
+				if err != nil || kind != 0x10 {
+					s.err = fmt.Errorf("want CONNECT, got %#x %v", kind, err)
+					return
+				}
+				proto, rest := mqttField(body)
+				if proto != "MQTT" || rest[0] != 4 {
+					s.err = fmt.Errorf("protocol %q level %d", proto, rest[0])
+					return
+				}
+				s.flags = rest[1]
+				if keepalive := binary.BigEndian.Uint16(rest[2:4]); keepalive != 60 {
+					s.err = fmt.Errorf("keepalive %d", keepalive)
+					return
+				}
+				s.client, rest = mqttField(rest[4:])
+				if s.flags&0x80 != 0 {
+					s.user, rest = mqttField(rest)
+				}
+				if s.flags&0x40 != 0 {
+					s.password, rest = mqttField(rest)
+				}
+				if len(rest) != 0 {
+					s.err = fmt.Errorf("%d bytes left over in CONNECT", len(rest))
+					return
+				}
+
+				conn.Write([]byte{0x20, 0x02, 0x00, code})
+				if code != 0 {
+					return
+				}
+
+				if kind, body, err = readMQTT(in); err != nil || kind != 0x30 {
+					s.err = fmt.Errorf("want PUBLISH, got %#x %v", kind, err)
+					return
+				}
+				s.topic, s.payload = mqttField(body)
+				kind, body, err = readMQTT(in)
+				s.disconnected = err == nil && kind == 0xe0 && len(body) == 0
+			}(conn)
+		}
+	}()
+	return ln.Addr().String(), got
+}
+
+func TestMQTTPublish(t *testing.T) {
+	addr, got := mqttStub(t, 0)
+	ch, err := parseChannel("mqtt tcp://horus:s3cret@" + addr + "/mining/horus/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Over 127 bytes, so the remaining length takes two bytes.
+	text := strings.Repeat("rebooted 10.0.2.5 ", 20)
+	clients := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		if err := sendMQTT(ch, Notification{}, text); err != nil {
+			t.Fatal(err)
+		}
+		s := <-got
+		if s.err != nil {
+			t.Fatal(s.err)
+		}
+		if s.flags != 0xc2 || s.user != "horus" || s.password != "s3cret" {
+			t.Errorf("CONNECT flags %#x user %q password %q", s.flags, s.user, s.password)
+		}
+		if !strings.HasPrefix(s.client, "horus-") {
+			t.Errorf("client id %q", s.client)
+		}
+		clients[s.client] = true
+		if s.topic != "mining/horus/events" || string(s.payload) != text {
+			t.Errorf("PUBLISH topic %q payload %q", s.topic, s.payload)
+		}
+		if !s.disconnected {
+			t.Error("no DISCONNECT")
+		}
+	}
+	if len(clients) != 2 {
+		t.Errorf("two connections shared a client id: %v", clients)
+	}
+}
+
+func TestMQTTRefused(t *testing.T) {
+	addr, got := mqttStub(t, 5)
+	ch, err := parseChannel("mqtt tcp://" + addr + "/horus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sendMQTT(ch, Notification{}, "appeared")
+	if err == nil || !strings.Contains(err.Error(), "code 5") {
+		t.Errorf("got %v, want refused (code 5)", err)
+	}
+	if s := <-got; s.err != nil || s.flags != 0x02 {
+		t.Errorf("CONNECT without a login: flags %#x %v", s.flags, s.err)
+	}
+}
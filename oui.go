@@ -0,0 +1,154 @@
+package main
+
+//
+// MAC OUI (first three octets) to manufacturer.
+//
+// The bundled table only holds prefixes we have checked against the IEEE
+// registry ourselves.  Miner manufacturers register new blocks all the
+// time, so the full registry can be loaded on top of it with -oui <file>
+// (or from one of the usual system locations).  Any organisation in the
+// registry whose name matches miner_org_keys is treated as a miner maker.
+//
+// No Bitmain, Canaan, MicroBT or Innosilicon block is bundled yet - none has
+// been checked against the registry, and a wrong prefix would call some other
+// box a miner.  Until they are, "likely miner" needs a registry file, and the
+// scan says so when it has none.  Add a block here only with its registry line.
+//
+// Accepted file formats:
+//	IEEE oui.txt          B8-27-EB   (hex)		Raspberry Pi Foundation
+//	nmap-mac-prefixes     B827EB Raspberry Pi Foundation
+//	wireshark manuf       B8:27:EB	Raspberr	Raspberry Pi Foundation
+//
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+type ouiVendor struct {
+	Name  string
+	Miner bool // a miner manufacturer (as opposed to a controller board or anything else)
+}
+
+// Keyed by the first three octets, upper case hex, no separators.
+var oui_table = map[string]ouiVendor{
+	// Controller boards found inside (or bolted onto) miners
+	"B827EB": {"Raspberry Pi Foundation", false},
+	"DCA632": {"Raspberry Pi Trading", false},
+	"E45F01": {"Raspberry Pi Trading", false},
+	"000A35": {"Xilinx", false},
+}
+
+// Registry organisation names that make a miner.
+var miner_org_keys = []string{
+	"bitmain",
+	"canaan",
+	"microbt",
+	"innosilicon",
+	"ebang",
+	"goldshell",
+}
+
+// Where we look for a registry file when -oui is not given.
+var oui_search_path = []string{
+	"/usr/share/ieee-data/oui.txt",
+	"/usr/share/misc/oui.txt",
+	"/usr/share/nmap/nmap-mac-prefixes",
+	"/usr/share/wireshark/manuf",
+}
+
+var oui_file string = "" // -oui
+
+// The registry is loaded once - scans run side by side (horus api) and
+// read oui_table while they do.
+var oui_once sync.Once
+var oui_err error
+var oui_registry string = "" // the file loaded ("": the bundled table only)
+
+var oui_line_re = regexp.MustCompile(`^\s*([0-9A-Fa-f]{2})[-:]?([0-9A-Fa-f]{2})[-:]?([0-9A-Fa-f]{2})(?:\s+\(hex\))?\s+(.+)$`)
+
+// Load -oui (or a registry from the usual places).  Called once the options are parsed.
+func startOUI() error {
+	oui_once.Do(func() {
+		oui_err = loadOUI(oui_file)
+	})
+	return oui_err
+}
+
+/////////////////////////////////////////////////////////////
+// loadOUI
+// Add a registry file to the bundled table.  With no file
+// given, try the usual places and stay quiet if none exist.
+/////////////////////////////////////////////////////////////
+func loadOUI(path string) error {
+	if path != "" {
+		return loadOUIFile(path)
+	}
+	for _, p := range oui_search_path {
+		if _, err := os.Stat(p); err == nil {
+			if debug {
+				fmt.Println("Loading OUI registry from: ", p)
+			}
+			return loadOUIFile(p)
+		}
+	}
+	return nil
+}
+
+func loadOUIFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	oui_registry = path
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		m := oui_line_re.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+
+		key := strings.ToUpper(m[1] + m[2] + m[3])
+		if _, ok := oui_table[key]; ok {
+			continue // the bundled entry wins
+		}
+
+		// wireshark has a short name then a tab then the long one
+		name := strings.TrimSpace(m[4])
+		if tab := strings.LastIndex(name, "\t"); tab >= 0 {
+			name = strings.TrimSpace(name[tab+1:])
+		}
+		oui_table[key] = ouiVendor{Name: name, Miner: isMinerOrg(name)}
+	}
+	return scanner.Err()
+}
+
+func isMinerOrg(name string) bool {
+	lower := strings.ToLower(name)
+	for _, key := range miner_org_keys {
+		if strings.Contains(lower, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupOUI - manufacturer for a mac address (any separator style)
+func lookupOUI(mac string) (ouiVendor, bool) {
+	hex := strings.ToUpper(strings.NewReplacer(":", "", "-", "", ".", "").Replace(mac))
+	if len(hex) < 6 {
+		return ouiVendor{}, false
+	}
+	v, ok := oui_table[hex[:6]]
+	return v, ok
+}
@@ -0,0 +1,587 @@
+package main
+
+//
+// Machine readable output:  -output table|json|ndjson|csv|yaml
+//
+// table is the old human readable output.  Everything else writes
+// HostRecords (schema below, documented in OUTPUT.md) to stdout, and all
+// the chatter (progress, "Success on Port" lines, prompts) goes to stderr so
+// the output can be piped straight into jq or a spreadsheet.
+//
+// The schema number goes up whenever a field changes meaning or goes away.
+// Adding a field does not change it.
+//
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cgminer-api"
+)
+
+const output_schema = 1
+
+type HostRecord struct {
+	Schema      int              `json:"schema"`
+	Time        string           `json:"time"`    // RFC3339 - when the record was made
+	Command     string           `json:"command"` // the horus command that made it
+	Host        string           `json:"host"`
+	State       string           `json:"state,omitempty"` // see host_state.go
+	LatencyMS   float64          `json:"latency_ms,omitempty"`
+	MAC         string           `json:"mac,omitempty"`
+	Vendor      string           `json:"vendor,omitempty"`
+	Miner       bool             `json:"miner"`             // the miner api answered the scan
+	Dialect     string           `json:"dialect,omitempty"` // cgminer, sgminer, bmminer ...
+	Services    []Service        `json:"services,omitempty"`
+	Version     *cgminer.Version `json:"version,omitempty"`
+	Summary     *cgminer.Summary `json:"summary,omitempty"`
+	Pools       []cgminer.Pool   `json:"pools,omitempty"`
+	Devs        []cgminer.Devs   `json:"devs,omitempty"`
+	Config      *cgminer.Config  `json:"config,omitempty"`
+	Chains      []ChainStat      `json:"chains,omitempty"` // from stats - see chains.go
+	Reply       json.RawMessage  `json:"reply,omitempty"`  // exec: the raw api reply
+	Action      string           `json:"action,omitempty"` // restart ...
+	Result      string           `json:"result,omitempty"`
+	Message     string           `json:"message,omitempty"`      // do: the STATUS message the miner sent back
+	Score       *int             `json:"score,omitempty"`        // triage: 100 (nothing wrong) to 0
+	Event       string           `json:"event,omitempty"`        // watch: appeared, disappeared, ip-changed ...
+	Previous    string           `json:"previous,omitempty"`     // watch: the value before the change
+	EventDetail string           `json:"event_detail,omitempty"` // watch: the value now
+	Alert       *Alert           `json:"alert,omitempty"`        // event "alert": see alerts.go
+	Errors      []string         `json:"errors,omitempty"`
+}
+
+// What to ask the miner api for when building a record.
+type detailSet struct {
+	version bool
+	summary bool
+	pools   bool
+	devs    bool
+	config  bool
+	stats   bool // the hash chains (Antminers)
+}
+
+var all_details = detailSet{version: true, summary: true, pools: true, devs: true, config: true, stats: true}
+
+// The real stdout - when a machine format is chosen, os.Stdout is pointed at
+// stderr so every Printf in the program becomes chatter, and the records go here.
+var data_out io.Writer = os.Stdout
+
+// Name of the running command (for HostRecord.Command)
+var current_command string = ""
+
+func machineOutput() bool {
+	return output_format != "table"
+}
+
+/////////////////////////////////////////////////////////////
+// startOutput
+// Called once the options are parsed.
+/////////////////////////////////////////////////////////////
+func startOutput() {
+	if machineOutput() {
+		data_out = os.Stdout
+		os.Stdout = os.Stderr
+	}
+}
+
+func newRecord(ip string) HostRecord {
+	return HostRecord{
+		Schema:  output_schema,
+		Time:    time.Now().Format(time.RFC3339),
+		Command: current_command,
+		Host:    ip,
+	}
+}
+
+/////////////////////////////////////////////////////////////
+// scanRecords
+// One record for every host that answered (or that the
+// neighbor table knows about), in address order.
+/////////////////////////////////////////////////////////////
+func scanRecords(m *MyNet) []HostRecord {
+	api := make(map[string]bool)
+	for _, ip := range m.AvailableIPs {
+		api[ip] = true
+	}
+
+	seen := make(map[string]bool)
+	var hosts []string
+	for ip := range m.Hosts {
+		hosts = append(hosts, ip)
+		seen[ip] = true
+	}
+	for ip := range m.Neighbors {
+		if !seen[ip] {
+			hosts = append(hosts, ip)
+		}
+	}
+	sortIPs(hosts)
+
+	var records []HostRecord
+	for _, ip := range hosts {
+		rec := newRecord(ip)
+		rec.Miner = api[ip]
+		if h, ok := m.Hosts[ip]; ok {
+			rec.State = h.State
+			rec.LatencyMS = float64(h.Latency.Microseconds()) / 1000
+		}
+		if n, ok := m.Neighbors[ip]; ok {
+			rec.MAC = n.MAC
+			rec.Vendor = n.Vendor
+		}
+		rec.Services = m.Services[ip]
+		for _, svc := range rec.Services {
+			if svc.Profile != "cgminer" {
+				continue
+			}
+			if fields := strings.Fields(svc.Detail); len(fields) > 0 {
+				rec.Dialect = strings.ToLower(fields[0])
+			}
+		}
+		records = append(records, rec)
+	}
+	return records
+}
+
+// Just the miners (the hosts whose api answered), with api details (which go into the inventory).
+func minerRecords(m *MyNet, d detailSet) []HostRecord {
+	var records []HostRecord
+	for _, rec := range scanRecords(m) {
+		if !rec.Miner {
+			continue
+		}
+		addDetails(&rec, d)
+		records = append(records, rec)
+	}
+	rememberRecords(records, d)
+	return records
+}
+
+// The port the miner api answered the scan on - 4028 unless -ports
+// found it somewhere else (4029:cgminer ...).
+func apiPort(rec HostRecord) int64 {
+	port := int64(0)
+	for _, svc := range rec.Services {
+		if svc.Profile != "cgminer" {
+			continue
+		}
+		p, err := strconv.ParseInt(svc.Port, 10, 64)
+		if err != nil {
+			continue
+		}
+		if svc.Detail != "" {
+			return p
+		}
+		if port == 0 {
+			port = p
+		}
+	}
+	if port == 0 {
+		return 4028
+	}
+	return port
+}
+
+// The same, straight from a scan.
+func scanPort(m *MyNet, ip string) int64 {
+	return apiPort(HostRecord{Services: m.Services[ip]})
+}
+
+/////////////////////////////////////////////////////////////
+// addDetails
+// Ask the miner api for whatever the command wants.
+// Errors are kept in the record rather than stopping us.
+/////////////////////////////////////////////////////////////
+func addDetails(rec *HostRecord, d detailSet) {
+	miner := cgminer.New(rec.Host, apiPort(*rec))
+	fail := func(what string, err error) {
+		rec.Errors = append(rec.Errors, fmt.Sprintf("%s: %s", what, err))
+	}
+
+	if d.version {
+		if v, err := miner.Version(); err != nil {
+			fail("version", err)
+		} else {
+			rec.Version = v
+			if rec.Dialect == "" {
+				rec.Dialect = versionDialect(v)
+			}
+		}
+	}
+	if d.summary {
+		if s, err := miner.Summary(); err != nil {
+			fail("summary", err)
+		} else {
+			rec.Summary = s
+		}
+	}
+	if d.pools {
+		if p, err := miner.Pools(); err != nil {
+			fail("pools", err)
+		} else {
+			rec.Pools = p
+		}
+	}
+	if d.devs {
+		if devs, err := miner.Devs(); err != nil {
+			fail("devs", err)
+		} else if devs != nil {
+			rec.Devs = *devs
+		}
+	}
+	if d.config {
+		if c, err := miner.Config(); err != nil {
+			fail("config", err)
+		} else {
+			rec.Config = c
+		}
+	}
+	if d.stats {
+		if s, err := miner.Stats(); err != nil {
+			fail("stats", err)
+		} else {
+			rec.Chains = parseChains(s)
+		}
+	}
+}
+
+func versionDialect(v *cgminer.Version) string {
+	switch {
+	case v.BMMiner != "":
+		return "bmminer"
+	case v.SGMiner != "":
+		return "sgminer"
+	case v.CGMiner != "":
+		return "cgminer"
+	}
+	return ""
+}
+
+/////////////////////////////////////////////////////////////
+// Record writers
+// json and yaml write one document per batch (one per scan in
+// watch mode), ndjson one line per record, csv a header then
+// one row per record.
+/////////////////////////////////////////////////////////////
+type recordWriter struct {
+	mu     sync.Mutex
+	format string
+	w      io.Writer
+	csv    *csv.Writer
+}
+
+var records_out *recordWriter
+
+func newRecordWriter(format string, w io.Writer) *recordWriter {
+	return &recordWriter{format: format, w: w}
+}
+
+// Write a batch of records.
+func (rw *recordWriter) Write(records []HostRecord) error {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+
+	switch rw.format {
+	case "json":
+		b, err := json.MarshalIndent(envelope(records), "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(rw.w, "%s\n", b)
+		return err
+
+	case "ndjson":
+		enc := json.NewEncoder(rw.w)
+		for _, rec := range records {
+			if err := enc.Encode(rec); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case "yaml":
+		b, err := json.Marshal(envelope(records))
+		if err != nil {
+			return err
+		}
+		y, err := jsonToYAML(b)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(rw.w, "---\n%s", y)
+		return err
+
+	case "csv":
+		if rw.csv == nil {
+			rw.csv = csv.NewWriter(rw.w)
+			rw.csv.Write(csv_columns)
+		}
+		for _, rec := range records {
+			rw.csv.Write(csvRow(rec))
+		}
+		rw.csv.Flush()
+		return rw.csv.Error()
+	}
+	return fmt.Errorf("unknown output format (%s)", rw.format)
+}
+
+// Write the records if a machine format was asked for.
+// Returns false for table output - the caller prints its own.
+func writeRecords(records []HostRecord) bool {
+	if !machineOutput() {
+		return false
+	}
+	if records_out == nil {
+		records_out = newRecordWriter(output_format, data_out)
+	}
+	if err := records_out.Write(records); err != nil {
+		fmt.Fprintln(os.Stderr, "Error writing output: ", err)
+	}
+	return true
+}
+
+type recordEnvelope struct {
+	Schema    int          `json:"schema"`
+	Version   string       `json:"horus_version"`
+	Generated string       `json:"generated"`
+	Hosts     []HostRecord `json:"hosts"`
+}
+
+func envelope(records []HostRecord) recordEnvelope {
+	if records == nil {
+		records = []HostRecord{}
+	}
+	return recordEnvelope{
+		Schema:    output_schema,
+		Version:   Horus_Version,
+		Generated: time.Now().Format(time.RFC3339),
+		Hosts:     records,
+	}
+}
+
+/////////////////////////////////////////////////////////////
+// csv - one flat row per record.  Lists are summarised
+// (first pool, hottest device) - use json for everything.
+/////////////////////////////////////////////////////////////
+var csv_columns = []string{
+	"schema", "time", "command", "host", "state", "latency_ms", "mac", "vendor", "miner", "dialect", "services",
+	"model", "firmware", "mhs_av", "mhs_5s", "accepted", "rejected", "stale", "hardware_errors", "elapsed",
+	"pool_count", "pool_url", "pool_user", "pool_status", "dev_count", "devs_alive", "max_temp", "os",
+	"chain_count", "chains_dead", "chips_missing",
+	"action", "result", "message", "score", "errors",
+}
+
+func csvRow(rec HostRecord) []string {
+	row := make(map[string]string)
+
+	row["schema"] = strconv.Itoa(rec.Schema)
+	row["time"] = rec.Time
+	row["command"] = rec.Command
+	row["host"] = rec.Host
+	row["state"] = rec.State
+	if rec.LatencyMS != 0 {
+		row["latency_ms"] = strconv.FormatFloat(rec.LatencyMS, 'f', 3, 64)
+	}
+	row["mac"] = rec.MAC
+	row["vendor"] = rec.Vendor
+	row["miner"] = strconv.FormatBool(rec.Miner)
+	row["dialect"] = rec.Dialect
+
+	var svcs []string
+	for _, svc := range rec.Services {
+		svcs = append(svcs, svc.Port+"/"+svc.Profile)
+	}
+	row["services"] = strings.Join(svcs, " ")
+
+	if v := rec.Version; v != nil {
+		row["model"] = v.Type
+		row["firmware"] = v.Miner
+	}
+	if s := rec.Summary; s != nil {
+		row["mhs_av"] = strconv.FormatFloat(s.MHSav, 'f', -1, 64)
+		row["mhs_5s"] = strconv.FormatFloat(s.MHS5s, 'f', -1, 64)
+		row["accepted"] = strconv.FormatInt(s.Accepted, 10)
+		row["rejected"] = strconv.FormatInt(s.Rejected, 10)
+		row["stale"] = strconv.FormatInt(s.Stale, 10)
+		row["hardware_errors"] = strconv.FormatInt(s.HardwareErrors, 10)
+		row["elapsed"] = strconv.FormatInt(s.Elapsed, 10)
+	}
+	if rec.Pools != nil {
+		row["pool_count"] = strconv.Itoa(len(rec.Pools))
+		if len(rec.Pools) > 0 {
+			row["pool_url"] = rec.Pools[0].URL
+			row["pool_user"] = rec.Pools[0].User
+			row["pool_status"] = rec.Pools[0].Status
+		}
+	}
+	if rec.Devs != nil {
+		alive := 0
+		hottest := 0.0
+		for _, d := range rec.Devs {
+			if d.Status == "Alive" {
+				alive++
+			}
+			if d.Temperature > hottest {
+				hottest = d.Temperature
+			}
+		}
+		row["dev_count"] = strconv.Itoa(len(rec.Devs))
+		row["devs_alive"] = strconv.Itoa(alive)
+		row["max_temp"] = strconv.FormatFloat(hottest, 'f', -1, 64)
+	}
+	if rec.Config != nil {
+		row["os"] = rec.Config.OS
+	}
+	if rec.Chains != nil {
+		dead, missing := 0, 0
+		for _, c := range rec.Chains {
+			if c.Dead {
+				dead++
+			}
+			missing += c.Missing
+		}
+		row["chain_count"] = strconv.Itoa(len(rec.Chains))
+		row["chains_dead"] = strconv.Itoa(dead)
+		row["chips_missing"] = strconv.Itoa(missing)
+	}
+	row["action"] = rec.Action
+	row["result"] = rec.Result
+	row["message"] = rec.Message
+	if rec.Score != nil {
+		row["score"] = strconv.Itoa(*rec.Score)
+	}
+	row["errors"] = strings.Join(rec.Errors, "; ")
+
+	out := make([]string, len(csv_columns))
+	for i, col := range csv_columns {
+		out[i] = row[col]
+	}
+	return out
+}
+
+/////////////////////////////////////////////////////////////
+// jsonToYAML
+// No yaml package in the standard library, and our records are
+// plain json anyway - so walk the json (keeping the key order)
+// and write it out as block yaml.  Strings are always double
+// quoted, json escapes are valid yaml escapes.
+/////////////////////////////////////////////////////////////
+func jsonToYAML(data []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	var out bytes.Buffer
+	if err := yamlValue(dec, &out, 0, false); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+var yaml_plain_key = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Write the next json value.  inline means we are right after "key:" or "- ".
+func yamlValue(dec *json.Decoder, out *bytes.Buffer, indent int, inline bool) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	pad := strings.Repeat("  ", indent)
+
+	switch t := tok.(type) {
+	case json.Delim:
+		first := true
+		empty := true
+		switch t {
+		case '{':
+			for dec.More() {
+				empty = false
+				keyTok, err := dec.Token()
+				if err != nil {
+					return err
+				}
+				key := keyTok.(string)
+				if !yaml_plain_key.MatchString(key) {
+					key = strconv.Quote(key)
+				}
+				if inline && first {
+					out.WriteString("\n")
+				}
+				first = false
+				fmt.Fprintf(out, "%s%s:", pad, key)
+				if err := yamlValue(dec, out, indent+1, true); err != nil {
+					return err
+				}
+			}
+			if empty {
+				out.WriteString(" {}\n")
+			}
+		case '[':
+			for dec.More() {
+				empty = false
+				if inline && first {
+					out.WriteString("\n")
+				}
+				first = false
+				fmt.Fprintf(out, "%s-", pad)
+				if err := yamlListItem(dec, out, indent+1); err != nil {
+					return err
+				}
+			}
+			if empty {
+				out.WriteString(" []\n")
+			}
+		}
+		_, err := dec.Token() // the closing } or ]
+		return err
+
+	case string:
+		fmt.Fprintf(out, " %s\n", strconv.Quote(t))
+	case json.Number:
+		fmt.Fprintf(out, " %s\n", t.String())
+	case bool:
+		fmt.Fprintf(out, " %t\n", t)
+	case nil:
+		out.WriteString(" null\n")
+	}
+	return nil
+}
+
+// A list item: maps start on the same line as the "-".
+func yamlListItem(dec *json.Decoder, out *bytes.Buffer, indent int) error {
+	var item bytes.Buffer
+	if err := yamlValue(dec, &item, indent, true); err != nil {
+		return err
+	}
+	text := item.String()
+	// "\n    key: v\n    key2: v" -> " key: v\n    key2: v"
+	if strings.HasPrefix(text, "\n") {
+		text = " " + strings.TrimLeft(text, " \n")
+	}
+	out.WriteString(text)
+	return nil
+}
+
+/////////////////////////////////////////////////////////////
+// sortIPs - numeric order, so 10.0.0.9 comes before 10.0.0.10
+/////////////////////////////////////////////////////////////
+func sortIPs(ips []string) {
+	sort.Slice(ips, func(i, j int) bool {
+		a, b := net.ParseIP(ips[i]), net.ParseIP(ips[j])
+		if a == nil || b == nil {
+			return ips[i] < ips[j]
+		}
+		return bytes.Compare(a.To16(), b.To16()) < 0
+	})
+}
@@ -0,0 +1,140 @@
+package main
+
+//
+// Polling - ask a set of miners for their details, a few at a time.
+// Used by everything that keeps coming back to the same miners
+// (exporter, serve, watch ...) rather than scanning once.
+//
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// How many miners we talk to at once when polling.
+var poll_parallel int = 32
+
+/////////////////////////////////////////////////////////////
+// pollRecords
+// addDetails on every record, at most poll_parallel at a time.
+// The records are updated in place, and go into the inventory.
+/////////////////////////////////////////////////////////////
+func pollRecords(records []HostRecord, d detailSet) {
+	parallel := poll_parallel
+	if parallel < 1 {
+		parallel = 1
+	}
+
+	sem := make(chan struct{}, parallel)
+	var wg sync.WaitGroup
+
+	for i := range records {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(rec *HostRecord) {
+			defer wg.Done()
+			addDetails(rec, d)
+			sdProgress()
+			<-sem
+		}(&records[i])
+	}
+	wg.Wait()
+	rememberRecords(records, d)
+}
+
+/////////////////////////////////////////////////////////////
+// fleetState
+// The miners as of the last poll - for the long running
+// commands that serve them (exporter, serve).  loop scans every
+// rescan, polls every interval, and passes each poll to the
+// sinks, the alert rules and anyone subscribed.
+/////////////////////////////////////////////////////////////
+type fleetState struct {
+	name     string // for the log lines
+	interval time.Duration
+	rescan   time.Duration
+
+	mu          sync.RWMutex
+	records     []HostRecord
+	polled      time.Time
+	duration    time.Duration
+	scanned     time.Time
+	subscribers map[chan struct{}]bool
+}
+
+// Never returns.
+func (s *fleetState) loop(targets []string) {
+	var miners []HostRecord
+
+	for {
+		if time.Since(s.scanned) >= s.rescan {
+			m := scanNetwork(targets)
+			miners = minerRecords(m, detailSet{})
+			s.scanned = time.Now()
+			fmt.Printf("%s %s: %d miner(s) found\n", time.Now().Format("15:04:05"), s.name, len(miners))
+		}
+
+		// Fresh copies - pollRecords fills them in.
+		records := make([]HostRecord, len(miners))
+		for i, m := range miners {
+			rec := newRecord(m.Host)
+			rec.MAC = m.MAC
+			rec.Vendor = m.Vendor
+			rec.Miner = true
+			records[i] = rec
+		}
+
+		start := time.Now()
+		pollRecords(records, detailSet{version: true, summary: true, pools: true, devs: true, stats: true})
+
+		s.mu.Lock()
+		s.records = records
+		s.polled = start
+		s.duration = time.Since(start)
+		for ch := range s.subscribers {
+			select {
+			case ch <- struct{}{}:
+			default: // it has not read the last one yet - one is enough
+			}
+		}
+		s.mu.Unlock()
+
+		sendToSinks(records)
+		events := checkPoolGuard(records, time.Now())
+		for _, ev := range events {
+			fmt.Println(eventLine(ev))
+		}
+		alerts := checkAlerts(records, time.Now())
+		for _, ev := range alerts {
+			fmt.Println(alertLine(ev.Alert))
+		}
+		notifyEvents(append(events, alerts...))
+
+		time.Sleep(s.interval)
+	}
+}
+
+func (s *fleetState) snapshot() ([]HostRecord, time.Time, time.Duration) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.records, s.polled, s.duration
+}
+
+// A channel that gets a message after every poll.  Unsubscribe when done.
+func (s *fleetState) subscribe() chan struct{} {
+	ch := make(chan struct{}, 1)
+	s.mu.Lock()
+	if s.subscribers == nil {
+		s.subscribers = make(map[chan struct{}]bool)
+	}
+	s.subscribers[ch] = true
+	s.mu.Unlock()
+	return ch
+}
+
+func (s *fleetState) unsubscribe(ch chan struct{}) {
+	s.mu.Lock()
+	delete(s.subscribers, ch)
+	s.mu.Unlock()
+}
@@ -0,0 +1,493 @@
+package main
+
+//
+// Pool guard:  horus remembers which pools each miner is meant to have,
+// and says so when they change.
+//
+// Firmware that has been got at rewrites the pool urls or workers so the
+// hashrate goes somewhere else, or mines on another pool for a few minutes
+// an hour (a hidden "dev fee") and goes back.  horus pools baseline records
+// the pools each miner has now as its approved pools; with -pool-guard
+// alert, watch (and serve, api, top, exporter) check every poll against
+// them:
+//
+//	pool-unapproved     the urls, workers or their order are not the approved ones
+//	pool-approved       the miner is back on its approved pools
+//	pool-share          more than -pool-share of the last -pool-window was
+//	                    spent mining on a pool that is not approved
+//
+// -pool-guard revert also puts the approved pools back, the same way horus
+// pools apply does (pool-reverted or pool-revert-failed).  The miner api does
+// not show passwords: pools baseline -f pools.conf keeps the ones the pools
+// file gives, and x is sent for the rest.
+//
+// The time on each pool is sampled: at every poll the time since the last
+// poll goes to the pool that is active now.  A short switch is missed by
+// some polls and caught by others - over the window it comes to about the
+// right share.  See POOLS.md.
+//
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cgminer-api"
+)
+
+const pool_baseline_schema = 1
+
+// -pool-guard off, alert or revert
+var pool_guard string = "off"
+
+// -pool-baseline: the approved pools ("": the default place)
+var pool_baseline_file string = ""
+var pool_guard_share float64 = 0.02
+var pool_guard_window time.Duration = time.Hour
+
+// pools baseline -f: the pools file to take the passwords from
+var pool_baseline_pools string = ""
+
+func poolsBaselineFlags(fs *flag.FlagSet) {
+	fs.StringVar(&pool_baseline_pools, "f", pool_baseline_pools, "Keep the passwords this pools file gives the approved pools (for -pool-guard revert)")
+	fs.StringVar(&pools_racks, "racks", pools_racks, "File of: MAC or IP, rack, position - for {rack} and {slot}")
+}
+
+type PoolBaseline struct {
+	Schema  int                       `json:"schema"`
+	Updated time.Time                 `json:"updated"`
+	Miners  map[string]*BaselineMiner `json:"miners"`
+}
+
+type BaselineMiner struct {
+	ID       string          `json:"id"` // as in the inventory: the MAC, or "ip:" + address
+	MAC      string          `json:"mac,omitempty"`
+	IP       string          `json:"ip"`
+	Approved time.Time       `json:"approved"`
+	Pools    []InventoryPool `json:"pools"`
+}
+
+// The time since the last poll, and the pool active at the end of it.
+type poolSample struct {
+	at     time.Time
+	length time.Duration
+	pool   string // url and worker, "" when no pool was active
+}
+
+type guardedMiner struct {
+	changed string // the pools last reported as unapproved, "" when they are approved
+	samples []poolSample
+	sharing bool
+}
+
+type poolGuard struct {
+	mu       sync.Mutex
+	revert   bool
+	baseline *PoolBaseline
+	miners   map[string]*guardedMiner
+}
+
+var pool_guard_state *poolGuard
+
+func poolBaselinePath() string {
+	if pool_baseline_file != "" {
+		return pool_baseline_file
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		dir = "."
+	}
+	return filepath.Join(dir, "horus", "pool-baseline.json")
+}
+
+/////////////////////////////////////////////////////////////
+// loadPoolBaseline
+// A missing file is an empty baseline, not an error.
+/////////////////////////////////////////////////////////////
+func loadPoolBaseline() (*PoolBaseline, error) {
+	b := &PoolBaseline{Schema: pool_baseline_schema, Miners: make(map[string]*BaselineMiner)}
+
+	data, err := ioutil.ReadFile(poolBaselinePath())
+	if os.IsNotExist(err) {
+		return b, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, b); err != nil {
+		return nil, fmt.Errorf("%s: %s", poolBaselinePath(), err)
+	}
+	if b.Schema > pool_baseline_schema {
+		return nil, fmt.Errorf("%s: made by a newer horus (schema %d)", poolBaselinePath(), b.Schema)
+	}
+	if b.Miners == nil {
+		b.Miners = make(map[string]*BaselineMiner)
+	}
+	return b, nil
+}
+
+func (b *PoolBaseline) save() error {
+	path := poolBaselinePath()
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	b.Schema = pool_baseline_schema
+	b.Updated = time.Now()
+	data, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// By MAC, then by address (for a miner approved before we knew its MAC).
+func (b *PoolBaseline) find(rec HostRecord) *BaselineMiner {
+	if m, ok := b.Miners[watchKey(rec)]; ok {
+		return m
+	}
+	return b.Miners["ip:"+rec.Host]
+}
+
+// Make the pools the miner has now its approved pools - with the password
+// from want (the pools file) for each one it gives.
+func (b *PoolBaseline) approve(rec HostRecord, want []poolWant, now time.Time) *BaselineMiner {
+	if old := b.find(rec); old != nil {
+		delete(b.Miners, old.ID)
+	}
+	m := &BaselineMiner{ID: watchKey(rec), MAC: rec.MAC, IP: rec.Host, Approved: now}
+	for _, p := range sortedByPriority(rec.Pools) {
+		pool := InventoryPool{Priority: p.Priority, URL: p.URL, User: p.User}
+		for _, w := range want {
+			if samePool(p, w) {
+				pool.Password = w.Password
+				break
+			}
+		}
+		m.Pools = append(m.Pools, pool)
+	}
+	b.Miners[m.ID] = m
+	return m
+}
+
+// url and worker of each pool, in priority order.
+func baselinePools(pools []InventoryPool) string {
+	var list []string
+	for _, p := range pools {
+		list = append(list, p.URL+" "+p.User)
+	}
+	return strings.Join(list, ", ")
+}
+
+func minerPools(pools []cgminer.Pool) string {
+	var list []string
+	for _, p := range sortedByPriority(pools) {
+		list = append(list, p.URL+" "+p.User)
+	}
+	return strings.Join(list, ", ")
+}
+
+/////////////////////////////////////////////////////////////
+// startPoolGuard
+// Check -pool-guard and read the baseline.
+/////////////////////////////////////////////////////////////
+func startPoolGuard() error {
+	switch pool_guard {
+	case "off":
+		return nil
+	case "alert", "revert":
+	default:
+		return fmt.Errorf("-pool-guard (%s) must be off, alert or revert", pool_guard)
+	}
+	if pool_guard_share < 0 || pool_guard_share >= 1 {
+		return fmt.Errorf("-pool-share must be from 0 to less than 1")
+	}
+	if pool_guard_window <= 0 {
+		return fmt.Errorf("-pool-window must be more than zero")
+	}
+
+	b, err := loadPoolBaseline()
+	if err != nil {
+		return fmt.Errorf("-pool-baseline: %s", err)
+	}
+	if len(b.Miners) == 0 {
+		fmt.Printf("Pool guard: no approved pools in %s - run horus pools baseline first\n", poolBaselinePath())
+	} else {
+		fmt.Printf("Pool guard (%s): %d miner(s) approved in %s\n", pool_guard, len(b.Miners), poolBaselinePath())
+	}
+	pool_guard_state = &poolGuard{
+		revert:   pool_guard == "revert",
+		baseline: b,
+		miners:   make(map[string]*guardedMiner),
+	}
+	return nil
+}
+
+/////////////////////////////////////////////////////////////
+// checkPoolGuard
+// Compare this poll with the approved pools, return the
+// events.  Miners that are not in the baseline, or did not
+// answer pools this time, are left alone.
+/////////////////////////////////////////////////////////////
+func checkPoolGuard(records []HostRecord, now time.Time) []HostRecord {
+	g := pool_guard_state
+	if g == nil {
+		return nil
+	}
+
+	var events []HostRecord
+	event := func(rec HostRecord, name string, previous string, detail string) {
+		ev := rec
+		ev.Time = now.Format(time.RFC3339)
+		ev.Event = name
+		ev.Previous = previous
+		ev.EventDetail = detail
+		events = append(events, ev)
+	}
+
+	var reverts []*HostRecord
+	var approvedPools []*BaselineMiner
+	g.mu.Lock()
+	for i := range records {
+		rec := records[i]
+		b := g.baseline.find(rec)
+		if b == nil || rec.Pools == nil {
+			continue
+		}
+		m := g.miners[b.ID]
+		if m == nil {
+			m = &guardedMiner{}
+			g.miners[b.ID] = m
+		}
+
+		approved, have := baselinePools(b.Pools), minerPools(rec.Pools)
+		switch {
+		case have != approved && have != m.changed:
+			// Once for each new set of pools, not every poll.
+			event(rec, "pool-unapproved", approved, have)
+			m.changed = have
+			if g.revert {
+				reverts = append(reverts, &records[i])
+				approvedPools = append(approvedPools, b)
+			}
+		case have == approved && m.changed != "":
+			event(rec, "pool-approved", m.changed, have)
+			m.changed = ""
+		}
+
+		if detail, over := m.share(rec, b, now); over && !m.sharing {
+			event(rec, "pool-share", fmt.Sprintf("%.1f%% allowed", pool_guard_share*100), detail)
+			m.sharing = true
+		} else if !over {
+			m.sharing = false
+		}
+	}
+	g.mu.Unlock()
+
+	return append(events, revertPools(reverts, approvedPools, now)...)
+}
+
+/////////////////////////////////////////////////////////////
+// share
+// Add this poll to the miner's samples and work out how much
+// of the window was spent on pools that are not approved.
+// Says nothing until half the window has been seen.
+/////////////////////////////////////////////////////////////
+func (m *guardedMiner) share(rec HostRecord, b *BaselineMiner, now time.Time) (string, bool) {
+	active := ""
+	for _, p := range rec.Pools {
+		if p.StratumActive {
+			active = p.URL + " " + p.User
+		}
+	}
+
+	// The first poll (or the first after a long gap) only starts the clock.
+	var length time.Duration
+	if n := len(m.samples); n > 0 && now.Sub(m.samples[n-1].at) < pool_guard_window {
+		length = now.Sub(m.samples[n-1].at)
+	} else {
+		m.samples = nil
+	}
+	m.samples = append(m.samples, poolSample{at: now, length: length, pool: active})
+
+	for len(m.samples) > 0 && now.Sub(m.samples[0].at) > pool_guard_window {
+		m.samples = m.samples[1:]
+	}
+
+	approved := make(map[string]bool)
+	for _, p := range b.Pools {
+		approved[p.URL+" "+p.User] = true
+	}
+	var total, off time.Duration
+	offPools := make(map[string]time.Duration)
+	for _, s := range m.samples {
+		total += s.length
+		if s.pool != "" && !approved[s.pool] {
+			off += s.length
+			offPools[s.pool] += s.length
+		}
+	}
+	if total < pool_guard_window/2 || float64(off) <= pool_guard_share*float64(total) {
+		return "", false
+	}
+
+	var names []string
+	for pool := range offPools {
+		names = append(names, pool)
+	}
+	sort.Strings(names)
+	for i, pool := range names {
+		names[i] = fmt.Sprintf("%s (%s)", pool, offPools[pool].Round(time.Second))
+	}
+	return fmt.Sprintf("%.1f%% of the last %s on %s", 100*float64(off)/float64(total), total.Round(time.Second), strings.Join(names, ", ")), true
+}
+
+// What it takes to put the approved pools back.
+func revertPlan(rec *HostRecord, b *BaselineMiner) *poolPlan {
+	// The miner api does not show passwords - the baseline has the ones
+	// the pools file gave, x goes for the rest.
+	var want []poolWant
+	for _, p := range b.Pools {
+		password := p.Password
+		if password == "" {
+			password = "x"
+		}
+		want = append(want, poolWant{URL: p.URL, User: p.User, Password: password})
+	}
+	return comparePools(rec, &poolGroup{name: "baseline"}, want)
+}
+
+/////////////////////////////////////////////////////////////
+// revertPools
+// Put each miner's approved pools back, pools_parallel at a
+// time, and return a pool-reverted or pool-revert-failed
+// event for each.
+/////////////////////////////////////////////////////////////
+func revertPools(records []*HostRecord, approved []*BaselineMiner, now time.Time) []HostRecord {
+	events := make([]HostRecord, len(records))
+	sem := make(chan struct{}, pools_parallel)
+	var wg sync.WaitGroup
+
+	for i := range records {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			p := revertPlan(records[i], approved[i])
+			ev := *p.rec
+			ev.Time = now.Format(time.RFC3339)
+			ev.Previous = minerPools(p.have)
+			err := p.err
+			if err == nil && p.changes() {
+				err = applyPlan(p)
+			}
+			if err != nil {
+				ev.Event = "pool-revert-failed"
+				ev.EventDetail = err.Error()
+			} else {
+				ev.Event = "pool-reverted"
+				ev.EventDetail = strings.Join(p.changeList(), "; ")
+			}
+			events[i] = ev
+		}(i)
+	}
+	wg.Wait()
+	return events
+}
+
+/////////////////////////////////////////////////////////////
+// cmdPoolsBaseline
+// horus pools baseline [-f pools.conf] [-racks file] [IP OR CIDR_BLOCK ...]
+// The pools every miner found has now become its approved
+// pools.  Other miners in the baseline are kept.
+/////////////////////////////////////////////////////////////
+func cmdPoolsBaseline(args []string) int {
+	fs := flag.NewFlagSet("horus pools baseline", flag.ContinueOnError)
+	poolsBaselineFlags(fs)
+	fs.Usage = func() {
+		fmt.Printf("Usage: horus [options] pools baseline [-f pools.conf] [-racks file] [IP OR CIDR_BLOCK ...]\n\nOptions:\n")
+		fs.SetOutput(os.Stdout)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 1
+	}
+
+	var groups []*poolGroup
+	if pool_baseline_pools != "" {
+		var err error
+		if groups, err = loadPoolGroups(pool_baseline_pools); err != nil {
+			fmt.Printf("Error: -f (%s): %s\n", pool_baseline_pools, err)
+			return 1
+		}
+	}
+	racks, err := loadRacks(pools_racks)
+	if err != nil {
+		fmt.Printf("Error: -racks (%s): %s\n", pools_racks, err)
+		return 1
+	}
+
+	m := scanTargets(fs.Args())
+	if m == nil {
+		return 1
+	}
+	records := minerRecords(m, detailSet{pools: true})
+
+	b, err := loadPoolBaseline()
+	if err != nil {
+		fmt.Println("Error: -pool-baseline:", err)
+		return 1
+	}
+
+	now := time.Now()
+	approved := 0
+	for i := range records {
+		rec := &records[i]
+		rec.Action = "pools baseline"
+		if rec.Pools == nil {
+			rec.Result = "failed"
+			rec.Message = "can not read the pools"
+			continue
+		}
+		var want []poolWant
+		if g := poolGroupFor(groups, *rec); g != nil {
+			want = poolsFor(g, *rec, racks)
+		}
+		a := b.approve(*rec, want, now)
+		rec.Result = "ok"
+		rec.Message = baselinePools(a.Pools)
+		approved++
+	}
+	if approved > 0 {
+		if err := b.save(); err != nil {
+			fmt.Println("Error: -pool-baseline:", err)
+			return 1
+		}
+	}
+
+	if !writeRecords(records) {
+		printResultMatrix(records)
+		fmt.Printf("%d miner(s) approved in %s (%d in all)\n", approved, poolBaselinePath(), len(b.Miners))
+	}
+	if approved < len(records) {
+		return 1
+	}
+	return 0
+}
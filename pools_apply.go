@@ -0,0 +1,615 @@
+package main
+
+//
+// horus pools plan | apply:
+// Say once which pools each group of miners should have, and let horus
+// make it so.  plan shows what would change, apply changes it.
+//
+//	# pools.conf
+//	group room2 10.0.2.0/24 10.0.3.0/24
+//	strategy failover
+//	pool stratum+tcp://pool.example:3333     {site}.{rack}{slot}  x
+//	pool stratum+tcp://backup.example:3333   {site}.{rack}{slot}  x
+//
+//	group everything-else *
+//	pool stratum+tcp://pool.example:3333     {site}.{last}        x
+//
+// A group is matched by CIDR blocks, IPs, MACs or * - the first group that
+// matches a miner is its group.  The pools are in priority order.  Workers
+// and passwords can use {site} (-site), {rack} and {slot} (-racks, as for
+// horus serve), {ip}, {last} (last octet of the ip) and {mac} (no colons).
+//
+// To converge a miner: add the missing pools, set the priorities, switch to
+// the first pool, remove the pools that should not be there, then save.
+// The miner api can not show passwords or change the strategy - a different
+// password is not seen, and a different strategy is only reported.  See POOLS.md.
+//
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"cgminer-api"
+)
+
+var pools_file string = "pools.conf"
+var pools_racks string = ""
+var pools_yes bool = false
+var pools_parallel int = 16
+
+func poolsStateFlags(fs *flag.FlagSet) {
+	fs.StringVar(&pools_file, "f", pools_file, "The pools each group of miners should have")
+	fs.StringVar(&pools_racks, "racks", pools_racks, "File of: MAC or IP, rack, position - for {rack} and {slot}")
+	fs.BoolVar(&pools_yes, "y", pools_yes, "apply: do not ask first")
+	fs.IntVar(&pools_parallel, "parallel", pools_parallel, "apply: how many miners to change at once")
+}
+
+type poolWant struct {
+	URL      string
+	User     string
+	Password string
+}
+
+type poolGroup struct {
+	name     string
+	match    []string // CIDR blocks, IPs, MACs, *
+	strategy string
+	pools    []poolWant // templates until poolsFor
+	line     int
+}
+
+// What one miner needs.
+type poolPlan struct {
+	rec      *HostRecord
+	group    *poolGroup
+	want     []poolWant
+	have     []cgminer.Pool
+	add      []poolWant
+	remove   []cgminer.Pool
+	reorder  bool
+	switchTo bool
+	strategy string // what it has, when it is not what the group wants
+	err      error
+}
+
+func (p *poolPlan) changes() bool {
+	return len(p.add) > 0 || len(p.remove) > 0 || p.reorder || p.switchTo
+}
+
+// The changes, short: +url worker, -url worker, ~priority, ~switch url.
+func (p *poolPlan) changeList() []string {
+	var changes []string
+	for _, w := range p.add {
+		changes = append(changes, "+"+w.URL+" "+w.User)
+	}
+	for _, h := range p.remove {
+		changes = append(changes, "-"+h.URL+" "+h.User)
+	}
+	if p.reorder {
+		changes = append(changes, "~priority")
+	}
+	if p.switchTo {
+		changes = append(changes, "~switch "+p.want[0].URL)
+	}
+	return changes
+}
+
+var pool_template_re = regexp.MustCompile(`\{[^}]*\}`)
+var pool_template_names = map[string]bool{"{site}": true, "{rack}": true, "{slot}": true, "{ip}": true, "{last}": true, "{mac}": true}
+
+/////////////////////////////////////////////////////////////
+// loadPoolGroups
+/////////////////////////////////////////////////////////////
+func loadPoolGroups(path string) ([]*poolGroup, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var groups []*poolGroup
+	var g *poolGroup
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		switch fields[0] {
+		case "group":
+			if len(fields) < 3 {
+				return nil, fmt.Errorf("line %d: want: group name CIDR|IP|MAC|* ...", n)
+			}
+			for _, m := range fields[2:] {
+				_, _, cidrErr := net.ParseCIDR(m)
+				if m != "*" && net.ParseIP(m).To4() == nil && cidrErr != nil && normalizeMAC(m) == "" {
+					return nil, fmt.Errorf("line %d: %s is not a CIDR block, IP, MAC or *", n, m)
+				}
+			}
+			g = &poolGroup{name: fields[1], match: fields[2:], line: n}
+			groups = append(groups, g)
+		case "strategy":
+			if g == nil || len(fields) < 2 {
+				return nil, fmt.Errorf("line %d: want: strategy name (after a group line)", n)
+			}
+			g.strategy = strings.Join(fields[1:], " ")
+		case "pool":
+			if g == nil || len(fields) < 3 || len(fields) > 4 {
+				return nil, fmt.Errorf("line %d: want: pool url worker [password] (after a group line)", n)
+			}
+			p := poolWant{URL: fields[1], User: fields[2], Password: "x"}
+			if len(fields) == 4 {
+				p.Password = fields[3]
+			}
+			// The miner api splits its parameters on commas.
+			if strings.Contains(p.URL+p.User+p.Password, ",") {
+				return nil, fmt.Errorf("line %d: url, worker and password can not have commas in them", n)
+			}
+			// A wallet address with a typo pays nobody.  An address made from a template is not checked.
+			if err := checkPoolUser(p.User); err != nil {
+				return nil, fmt.Errorf("line %d: worker %s: %s", n, p.User, err)
+			}
+			for _, name := range pool_template_re.FindAllString(p.User+p.Password, -1) {
+				if !pool_template_names[name] {
+					return nil, fmt.Errorf("line %d: unknown %s - {site}, {rack}, {slot}, {ip}, {last} or {mac}", n, name)
+				}
+			}
+			g.pools = append(g.pools, p)
+		default:
+			return nil, fmt.Errorf("line %d: %s? - want group, strategy or pool", n, fields[0])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	for _, g := range groups {
+		if len(g.pools) == 0 {
+			return nil, fmt.Errorf("line %d: group %s has no pools", g.line, g.name)
+		}
+	}
+	if len(groups) == 0 {
+		return nil, fmt.Errorf("no groups")
+	}
+	return groups, nil
+}
+
+// The first group with a CIDR block, IP or MAC that matches - nil if none do.
+func poolGroupFor(groups []*poolGroup, rec HostRecord) *poolGroup {
+	ip := net.ParseIP(rec.Host)
+	for _, g := range groups {
+		for _, m := range g.match {
+			if m == "*" || m == rec.Host {
+				return g
+			}
+			if _, block, err := net.ParseCIDR(m); err == nil && block.Contains(ip) {
+				return g
+			}
+			if mac := normalizeMAC(m); mac != "" && mac == rec.MAC {
+				return g
+			}
+		}
+	}
+	return nil
+}
+
+// The group's pools with the templates filled in for one miner.
+func poolsFor(g *poolGroup, rec HostRecord, racks map[string]rackSpot) []poolWant {
+	spot := rackFor(rec, racks)
+	last := rec.Host[strings.LastIndex(rec.Host, ".")+1:]
+	values := map[string]string{
+		"{site}": site_name,
+		"{rack}": spot.Rack,
+		"{slot}": strconv.Itoa(spot.Position),
+		"{ip}":   rec.Host,
+		"{last}": last,
+		"{mac}":  strings.Replace(rec.MAC, ":", "", -1),
+	}
+	fill := func(s string) string {
+		return pool_template_re.ReplaceAllStringFunc(s, func(name string) string { return values[name] })
+	}
+
+	var want []poolWant
+	for _, p := range g.pools {
+		want = append(want, poolWant{URL: p.URL, User: fill(p.User), Password: fill(p.Password)})
+	}
+	return want
+}
+
+func samePool(p cgminer.Pool, w poolWant) bool {
+	return p.URL == w.URL && p.User == w.User
+}
+
+/////////////////////////////////////////////////////////////
+// planPools
+// Compare what the miner has with what it should have.
+/////////////////////////////////////////////////////////////
+func planPools(rec *HostRecord, g *poolGroup, racks map[string]rackSpot) *poolPlan {
+	return comparePools(rec, g, poolsFor(g, *rec, racks))
+}
+
+// The same, for pools that are already filled in (the pool guard's baseline).
+func comparePools(rec *HostRecord, g *poolGroup, want []poolWant) *poolPlan {
+	p := &poolPlan{rec: rec, group: g, want: want}
+
+	miner := cgminer.New(rec.Host, apiPort(*rec))
+	have, err := miner.Pools()
+	if err != nil {
+		p.err = err
+		return p
+	}
+	p.have = sortedByPriority(have)
+
+	if g.strategy != "" {
+		if c, err := miner.Config(); err == nil && !strings.EqualFold(c.Strategy, g.strategy) {
+			p.strategy = c.Strategy
+		}
+	}
+
+	// What the order will be once the missing pools are added (at the end).
+	// Each pool the miner has stands for one wanted pool at most - the same
+	// pool in two slots (all three slots filled the same is common) is one
+	// too many, and goes.
+	var order []poolWant
+	used := make([]bool, len(p.want))
+	for _, h := range p.have {
+		wanted := false
+		for i, w := range p.want {
+			if !used[i] && samePool(h, w) {
+				used[i], wanted = true, true
+				order = append(order, w)
+				break
+			}
+		}
+		if !wanted {
+			p.remove = append(p.remove, h)
+		}
+	}
+	for i, w := range p.want {
+		if !used[i] {
+			p.add = append(p.add, w)
+			order = append(order, w)
+		}
+	}
+	for i := 0; i < len(order) && i < len(p.want); i++ {
+		if order[i] != p.want[i] {
+			p.reorder = true
+		}
+	}
+
+	p.switchTo = true
+	for _, h := range p.have {
+		if h.StratumActive && samePool(h, p.want[0]) {
+			p.switchTo = false
+		}
+	}
+	return p
+}
+
+func sortedByPriority(pools []cgminer.Pool) []cgminer.Pool {
+	out := append([]cgminer.Pool(nil), pools...)
+	for i := 1; i < len(out); i++ {
+		for j := i; j > 0 && out[j].Priority < out[j-1].Priority; j-- {
+			out[j], out[j-1] = out[j-1], out[j]
+		}
+	}
+	return out
+}
+
+/////////////////////////////////////////////////////////////
+// applyPlan
+// Pool numbers move when a pool is added or removed, so the
+// pools are read again before every step that needs them.
+/////////////////////////////////////////////////////////////
+func applyPlan(p *poolPlan) error {
+	ip, port := p.rec.Host, apiPort(*p.rec)
+	miner := cgminer.New(ip, port)
+	find := func(w poolWant) (int64, error) {
+		pools, err := miner.Pools()
+		if err != nil {
+			return 0, err
+		}
+		for _, h := range pools {
+			if samePool(h, w) {
+				return h.Pool, nil
+			}
+		}
+		return 0, fmt.Errorf("pool %s %s is not on the miner", w.URL, w.User)
+	}
+
+	for _, w := range p.add {
+		if _, err := minerCommand(ip, port, "addpool", w.URL+","+w.User+","+w.Password); err != nil {
+			return fmt.Errorf("addpool %s: %s", w.URL, err)
+		}
+	}
+
+	if p.reorder || len(p.add) > 0 {
+		var ids []string
+		for _, w := range p.want {
+			id, err := find(w)
+			if err != nil {
+				return err
+			}
+			ids = append(ids, strconv.FormatInt(id, 10))
+		}
+		if _, err := minerCommand(ip, port, "poolpriority", strings.Join(ids, ",")); err != nil {
+			return fmt.Errorf("poolpriority: %s", err)
+		}
+	}
+
+	if p.switchTo {
+		id, err := find(p.want[0])
+		if err != nil {
+			return err
+		}
+		if _, err := minerCommand(ip, port, "switchpool", strconv.FormatInt(id, 10)); err != nil {
+			return fmt.Errorf("switchpool: %s", err)
+		}
+	}
+
+	// A duplicate is the same as the pool that stays - take the copy that
+	// comes last, which poolpriority has put after the wanted ones.
+	for _, h := range p.remove {
+		pools, err := miner.Pools()
+		if err != nil {
+			return err
+		}
+		id := int64(-1)
+		for _, c := range sortedByPriority(pools) {
+			if samePool(c, poolWant{URL: h.URL, User: h.User}) {
+				id = c.Pool
+			}
+		}
+		if id < 0 {
+			continue // gone already
+		}
+		if _, err := minerCommand(ip, port, "removepool", strconv.FormatInt(id, 10)); err != nil {
+			return fmt.Errorf("removepool %s: %s", h.URL, err)
+		}
+	}
+
+	if _, err := minerCommand(ip, port, "save", ""); err != nil {
+		return fmt.Errorf("changed, but not saved (the miner will go back after a restart): %s", err)
+	}
+	return nil
+}
+
+/////////////////////////////////////////////////////////////
+// cmdPoolsState
+// horus pools plan|apply [-f pools.conf] [-racks file] [-y]
+//
+//	[-parallel 16] [IP OR CIDR_BLOCK ...]
+//
+// No addresses: the CIDR blocks and IPs in the pools file.
+/////////////////////////////////////////////////////////////
+func cmdPoolsState(action string, args []string) int {
+	fs := flag.NewFlagSet("horus pools "+action, flag.ContinueOnError)
+	poolsStateFlags(fs)
+	fs.Usage = func() {
+		fmt.Printf("Usage: horus [options] pools %s [-f pools.conf] [-racks file] [-y] [-parallel 16] [IP OR CIDR_BLOCK ...]\n\nOptions:\n", action)
+		fs.SetOutput(os.Stdout)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 1
+	}
+	if pools_parallel < 1 {
+		fmt.Println("Error: -parallel must be at least 1")
+		return 1
+	}
+
+	groups, err := loadPoolGroups(pools_file)
+	if err != nil {
+		fmt.Printf("Error: -f (%s): %s\n", pools_file, err)
+		return 1
+	}
+	racks, err := loadRacks(pools_racks)
+	if err != nil {
+		fmt.Printf("Error: -racks (%s): %s\n", pools_racks, err)
+		return 1
+	}
+
+	targets := fs.Args()
+	if len(targets) == 0 {
+		for _, g := range groups {
+			for _, m := range g.match {
+				if m != "*" && normalizeMAC(m) == "" {
+					targets = append(targets, m)
+				}
+			}
+		}
+		if len(targets) == 0 {
+			fmt.Println("Error: the pools file has no CIDR blocks or IPs to scan - give the addresses of the miners")
+			return 1
+		}
+	}
+
+	m := scanTargets(targets)
+	if m == nil {
+		return 1
+	}
+	records := minerRecords(m, detailSet{})
+
+	var plans []*poolPlan
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, pools_parallel)
+	for i := range records {
+		g := poolGroupFor(groups, records[i])
+		if g == nil {
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(rec *HostRecord) {
+			defer wg.Done()
+			p := planPools(rec, g, racks)
+			<-sem
+			mu.Lock()
+			plans = append(plans, p)
+			mu.Unlock()
+		}(&records[i])
+	}
+	wg.Wait()
+	sortPlans(plans)
+
+	printPoolPlans(plans, len(records))
+
+	var changing []*poolPlan
+	for _, p := range plans {
+		if p.err == nil && p.changes() {
+			changing = append(changing, p)
+		}
+	}
+
+	if action == "plan" {
+		writeRecords(planRecords(plans, "plan"))
+		if len(changing) > 0 {
+			fmt.Println("\nRun horus pools apply to make these changes.")
+		}
+		return 0
+	}
+
+	if len(changing) == 0 {
+		fmt.Println("\nNothing to change.")
+		writeRecords(planRecords(plans, "apply"))
+		return 0
+	}
+	if !pools_yes && !confirm(fmt.Sprintf("\nChange the pools on %d miner(s)?", len(changing))) {
+		fmt.Println("Nothing changed.")
+		return 0
+	}
+
+	failed := 0
+	for _, p := range changing {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(p *poolPlan) {
+			defer wg.Done()
+			p.err = applyPlan(p)
+			<-sem
+			mu.Lock()
+			if p.err != nil {
+				failed++
+				fmt.Printf(" ... IP: %s failed: %s\n", p.rec.Host, p.err)
+			} else {
+				fmt.Printf(" ... IP: %s done\n", p.rec.Host)
+			}
+			mu.Unlock()
+		}(p)
+	}
+	wg.Wait()
+
+	fmt.Printf("\nApply complete: %d changed, %d failed.\n", len(changing)-failed, failed)
+	writeRecords(planRecords(plans, "apply"))
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+func sortPlans(plans []*poolPlan) {
+	for i := 1; i < len(plans); i++ {
+		for j := i; j > 0 && ipLess(plans[j].rec.Host, plans[j-1].rec.Host); j-- {
+			plans[j], plans[j-1] = plans[j-1], plans[j]
+		}
+	}
+}
+
+/////////////////////////////////////////////////////////////
+// printPoolPlans
+// + to add, - to remove, ~ to change, ! for what we can not.
+/////////////////////////////////////////////////////////////
+func printPoolPlans(plans []*poolPlan, found int) {
+	var changing, same, unreachable, adds, removes, reorders int
+
+	fmt.Println()
+	for _, p := range plans {
+		switch {
+		case p.err != nil:
+			unreachable++
+			fmt.Printf("  ! %s (%s) can not read the pools: %s\n", p.rec.Host, p.group.name, p.err)
+			continue
+		case !p.changes():
+			same++
+			if p.strategy != "" {
+				fmt.Printf("  = %s (%s)\n", p.rec.Host, p.group.name)
+				fmt.Printf("      ! strategy %s, want %s (the miner api can not change it)\n", p.strategy, p.group.strategy)
+			}
+			continue
+		}
+
+		changing++
+		fmt.Printf("  ~ %s (%s)\n", p.rec.Host, p.group.name)
+		for _, w := range p.add {
+			adds++
+			fmt.Printf("      + pool %s  %s\n", w.URL, w.User)
+		}
+		for _, h := range p.remove {
+			removes++
+			fmt.Printf("      - pool %d %s  %s\n", h.Pool, h.URL, h.User)
+		}
+		if p.reorder {
+			reorders++
+			var was, want []string
+			for _, h := range p.have {
+				was = append(was, h.URL)
+			}
+			for _, w := range p.want {
+				want = append(want, w.URL)
+			}
+			fmt.Printf("      ~ priority %s\n                 -> %s\n", strings.Join(was, ", "), strings.Join(want, ", "))
+		}
+		if p.switchTo {
+			fmt.Printf("      ~ switch to %s\n", p.want[0].URL)
+		}
+		if p.strategy != "" {
+			fmt.Printf("      ! strategy %s, want %s (the miner api can not change it)\n", p.strategy, p.group.strategy)
+		}
+	}
+
+	fmt.Printf("\nPlan: %d miner(s) to change (%d pool(s) to add, %d to remove, %d to reorder), %d unchanged",
+		changing, adds, removes, reorders, same)
+	if unreachable > 0 {
+		fmt.Printf(", %d unreachable", unreachable)
+	}
+	if other := found - len(plans); other > 0 {
+		fmt.Printf(", %d in no group", other)
+	}
+	fmt.Println(".")
+}
+
+// For -output: one record per miner in a group.
+func planRecords(plans []*poolPlan, action string) []HostRecord {
+	var records []HostRecord
+	for _, p := range plans {
+		rec := *p.rec
+		rec.Action = "pools " + action
+		rec.Pools = p.have
+
+		rec.Message = strings.Join(p.changeList(), "; ")
+
+		switch {
+		case p.err != nil:
+			rec.Result = "failed"
+			rec.Errors = append(rec.Errors, p.err.Error())
+		case !p.changes():
+			rec.Result = "unchanged"
+		case action == "plan":
+			rec.Result = "planned"
+		default:
+			rec.Result = "ok"
+		}
+		records = append(records, rec)
+	}
+	return records
+}
@@ -0,0 +1,374 @@
+package main
+
+//
+// horus pools check:
+// The miner only says what it thinks of its pools.  This goes to each pool
+// from here and does what a miner does first - mining.subscribe, then
+// mining.authorize with the miner's worker - so a dead pool, a wrong port or
+// a mistyped worker shows up before the change goes out to the whole fleet.
+//
+//	horus pools check 10.0.2.0/24                    the pools the miners have
+//	horus pools check -f pools.conf 10.0.2.0/24      and the pools they should have
+//
+// Each url + worker is checked once however many miners use it.  The miner
+// api does not show passwords, so x is sent unless the pools file gives one.
+// Pools that take any worker (and make it up as they go) can not be told
+// apart from a good worker - see POOLS.md.
+//
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var pools_check_file string = ""
+var pools_check_wait time.Duration = 5 * time.Second
+
+func poolsCheckFlags(fs *flag.FlagSet) {
+	fs.StringVar(&pools_check_file, "f", pools_check_file, "Also check the pools this pools file gives the miners")
+	fs.StringVar(&pools_racks, "racks", pools_racks, "File of: MAC or IP, rack, position - for {rack} and {slot}")
+	fs.IntVar(&pools_parallel, "parallel", pools_parallel, "How many pools to check at once")
+	fs.DurationVar(&pools_check_wait, "wait", pools_check_wait, "How long to wait for each pool to connect and answer")
+}
+
+// One url + worker, and what the pool made of it.
+type stratumCheck struct {
+	url      string
+	user     string
+	password string // "" when only the miners use it - x is sent
+	miners   []*HostRecord
+
+	result    string // ok, dead, not-stratum, bad-worker, bad-url, skipped
+	detail    string
+	connect   time.Duration
+	handshake time.Duration
+}
+
+var errStratumV2 = errors.New("stratum v2 - not checked")
+
+/////////////////////////////////////////////////////////////
+// cmdPoolsCheck
+// horus pools check [-f pools.conf] [-racks file] [-wait 5s]
+//
+//	[-parallel 16] [IP OR CIDR_BLOCK ...]
+//
+// Exits 1 if any pool is not ok.
+/////////////////////////////////////////////////////////////
+func cmdPoolsCheck(args []string) int {
+	fs := flag.NewFlagSet("horus pools check", flag.ContinueOnError)
+	poolsCheckFlags(fs)
+	fs.Usage = func() {
+		fmt.Printf("Usage: horus [options] pools check [-f pools.conf] [-racks file] [-wait 5s] [-parallel 16] [IP OR CIDR_BLOCK ...]\n\nOptions:\n")
+		fs.SetOutput(os.Stdout)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 1
+	}
+	if pools_parallel < 1 || pools_check_wait <= 0 {
+		fmt.Println("Error: -parallel and -wait must be more than zero")
+		return 1
+	}
+
+	var groups []*poolGroup
+	if pools_check_file != "" {
+		var err error
+		if groups, err = loadPoolGroups(pools_check_file); err != nil {
+			fmt.Printf("Error: -f (%s): %s\n", pools_check_file, err)
+			return 1
+		}
+	}
+	racks, err := loadRacks(pools_racks)
+	if err != nil {
+		fmt.Printf("Error: -racks (%s): %s\n", pools_racks, err)
+		return 1
+	}
+
+	m := scanTargets(fs.Args())
+	if m == nil {
+		return 1
+	}
+	records := minerRecords(m, detailSet{pools: true})
+
+	// Every url + worker once, with the miners that use it.  The miner's own
+	// pools come with no password ("") - the pools file's takes its place, and
+	// a worker the file gives two passwords is checked with each.
+	var checks []*stratumCheck
+	index := make(map[string]*stratumCheck)
+	use := func(rec *HostRecord, url string, user string, password string) {
+		key := url + " " + user
+		c := index[key]
+		if c != nil && c.password == "" {
+			c.password = password
+		} else if c != nil && password != "" && password != c.password {
+			key += " " + password
+			c = index[key]
+		}
+		if c == nil {
+			c = &stratumCheck{url: url, user: user, password: password}
+			index[key] = c
+			checks = append(checks, c)
+		}
+		for _, r := range c.miners {
+			if r == rec {
+				return
+			}
+		}
+		c.miners = append(c.miners, rec)
+	}
+	for i := range records {
+		rec := &records[i]
+		for _, p := range sortedByPriority(rec.Pools) {
+			use(rec, p.URL, p.User, "")
+			// Where the miner really went, when the pool sent it somewhere else.
+			if p.StratumURL != "" && stratumAddr(p.StratumURL) != stratumAddr(p.URL) {
+				use(rec, stratumScheme(p.URL)+p.StratumURL, p.User, "")
+			}
+		}
+		if g := poolGroupFor(groups, *rec); g != nil {
+			for _, w := range poolsFor(g, *rec, racks) {
+				use(rec, w.URL, w.User, w.Password)
+			}
+		}
+	}
+	if len(checks) == 0 {
+		fmt.Println("No pools to check.")
+		return 0
+	}
+
+	fmt.Printf("\nChecking %d pool(s) ...\n", len(checks))
+	sem := make(chan struct{}, pools_parallel)
+	var wg sync.WaitGroup
+	for _, c := range checks {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(c *stratumCheck) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			c.run()
+		}(c)
+	}
+	wg.Wait()
+
+	failed := 0
+	for _, c := range checks {
+		if c.result != "ok" && c.result != "skipped" {
+			failed++
+		}
+	}
+
+	if !writeRecords(stratumCheckRecords(checks)) {
+		printStratumChecks(checks)
+		fmt.Printf("\n%d pool(s) checked, %d not ok.\n", len(checks), failed)
+	}
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+/////////////////////////////////////////////////////////////
+// run
+// Connect, subscribe, authorize - stop at the first thing
+// that goes wrong.
+/////////////////////////////////////////////////////////////
+func (c *stratumCheck) run() {
+	addr, useTLS, err := parseStratumURL(c.url)
+	if err == errStratumV2 {
+		c.result, c.detail = "skipped", err.Error()
+		return
+	}
+	if err != nil {
+		c.result, c.detail = "bad-url", err.Error()
+		return
+	}
+
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", addr, pools_check_wait)
+	if err != nil {
+		c.result, c.detail = "dead", classifyDial(err)+": "+err.Error()
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(pools_check_wait))
+	if useTLS {
+		host, _, _ := net.SplitHostPort(addr)
+		t := tls.Client(conn, &tls.Config{ServerName: host})
+		if err := t.Handshake(); err != nil {
+			c.result, c.detail = "dead", "tls: "+err.Error()
+			return
+		}
+		conn = t
+	}
+	c.connect = time.Since(start)
+
+	start = time.Now()
+	rpc := &stratumConn{conn: conn, in: bufio.NewReader(conn)}
+	if _, err := rpc.call("mining.subscribe", "horus/"+strings.TrimPrefix(Horus_Version, "Version ")); err != nil {
+		c.result, c.detail = "not-stratum", "mining.subscribe: "+err.Error()
+		return
+	}
+	c.handshake = time.Since(start)
+
+	password := c.password
+	if password == "" {
+		password = "x"
+	}
+	result, err := rpc.call("mining.authorize", c.user, password)
+	if err != nil {
+		c.result, c.detail = "bad-worker", "mining.authorize: "+err.Error()
+		return
+	}
+	var ok bool
+	if json.Unmarshal(result, &ok) != nil || !ok {
+		c.result, c.detail = "bad-worker", "mining.authorize: "+string(result)
+		return
+	}
+	c.result = "ok"
+}
+
+// Stratum v1: one json-rpc message per line, notifications mixed in with the replies.
+type stratumConn struct {
+	conn net.Conn
+	in   *bufio.Reader
+	id   int
+}
+
+func (s *stratumConn) call(method string, params ...interface{}) (json.RawMessage, error) {
+	s.id++
+	req, _ := json.Marshal(map[string]interface{}{"id": s.id, "method": method, "params": params})
+	if _, err := s.conn.Write(append(req, '\n')); err != nil {
+		return nil, err
+	}
+
+	for {
+		line, err := s.in.ReadBytes('\n')
+		if err != nil {
+			if len(line) == 0 {
+				return nil, err
+			}
+		}
+		var reply struct {
+			ID     *int            `json:"id"`
+			Result json.RawMessage `json:"result"`
+			Error  json.RawMessage `json:"error"`
+		}
+		if json.Unmarshal(line, &reply) != nil {
+			return nil, fmt.Errorf("not a stratum reply: %.60q", strings.TrimSpace(string(line)))
+		}
+		if reply.ID == nil || *reply.ID != s.id {
+			continue // mining.notify, mining.set_difficulty ...
+		}
+		if len(reply.Error) > 0 && string(reply.Error) != "null" {
+			return nil, fmt.Errorf("%s", stratumError(reply.Error))
+		}
+		return reply.Result, nil
+	}
+}
+
+// Pools send [code, "message", data] - or anything else.
+func stratumError(raw json.RawMessage) string {
+	var list []interface{}
+	if json.Unmarshal(raw, &list) == nil && len(list) >= 2 {
+		return fmt.Sprintf("%v (%v)", list[1], list[0])
+	}
+	return string(raw)
+}
+
+/////////////////////////////////////////////////////////////
+// parseStratumURL
+// stratum+tcp://host:port (or no scheme) is plain tcp,
+// stratum+ssl:// and stratum+tls:// are tls.
+/////////////////////////////////////////////////////////////
+func parseStratumURL(url string) (string, bool, error) {
+	useTLS := false
+	if i := strings.Index(url, "://"); i >= 0 {
+		switch scheme := strings.ToLower(url[:i]); scheme {
+		case "stratum+tcp", "stratum", "tcp":
+		case "stratum+ssl", "stratum+tls", "ssl", "tls":
+			useTLS = true
+		case "stratum2+tcp", "stratum2+ssl":
+			return "", false, errStratumV2
+		default:
+			return "", false, fmt.Errorf("unknown scheme %s://", scheme)
+		}
+	}
+	addr := stratumAddr(url)
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || host == "" {
+		return "", false, fmt.Errorf("want host:port, not %s", orDash(addr))
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return "", false, fmt.Errorf("bad port %s", port)
+	}
+	return addr, useTLS, nil
+}
+
+// host:port without the scheme or a path.
+func stratumAddr(url string) string {
+	if i := strings.Index(url, "://"); i >= 0 {
+		url = url[i+3:]
+	}
+	if i := strings.Index(url, "/"); i >= 0 {
+		url = url[:i]
+	}
+	return strings.ToLower(url)
+}
+
+func stratumScheme(url string) string {
+	if i := strings.Index(url, "://"); i >= 0 {
+		return url[:i+3]
+	}
+	return ""
+}
+
+func printStratumChecks(checks []*stratumCheck) {
+	ms := func(d time.Duration) string {
+		if d == 0 {
+			return "-"
+		}
+		return fmt.Sprintf("%.0fms", float64(d)/float64(time.Millisecond))
+	}
+
+	fmt.Printf("\n%-40s  %-24s  %6s  %7s  %9s  %-11s  %s\n", "POOL", "WORKER", "MINERS", "CONNECT", "SUBSCRIBE", "RESULT", "DETAIL")
+	for _, c := range checks {
+		fmt.Printf("%-40s  %-24s  %6d  %7s  %9s  %-11s  %s\n",
+			fit(c.url, 40), fit(c.user, 24), len(c.miners), ms(c.connect), ms(c.handshake), c.result, c.detail)
+	}
+}
+
+// For -output: one record per miner and pool.
+func stratumCheckRecords(checks []*stratumCheck) []HostRecord {
+	var records []HostRecord
+	for _, c := range checks {
+		for _, m := range c.miners {
+			rec := *m
+			rec.Action = "pools check"
+			rec.Result = c.result
+			rec.Message = fmt.Sprintf("%s %s", c.url, c.user)
+			if c.detail != "" {
+				rec.Message += ": " + c.detail
+			}
+			if c.connect > 0 {
+				rec.Message += fmt.Sprintf(" (connect %.0fms, subscribe %.0fms)",
+					float64(c.connect)/float64(time.Millisecond), float64(c.handshake)/float64(time.Millisecond))
+			}
+			records = append(records, rec)
+		}
+	}
+	sortRecords(records)
+	return records
+}
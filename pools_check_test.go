@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A stratum pool on a local port.  answer gets each request and returns the
+// lines to send back (notifications first, if it wants them mixed in).
+func stratumStub(t *testing.T, answer func(method string, id int, params []interface{}) []string) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				in := bufio.NewReader(conn)
+				for {
+					line, err := in.ReadBytes('\n')
+					if err != nil {
+						return
+					}
+					var req struct {
+						ID     int           `json:"id"`
+						Method string        `json:"method"`
+						Params []interface{} `json:"params"`
+					}
+					if json.Unmarshal(line, &req) != nil {
+						return
+					}
+					for _, reply := range answer(req.Method, req.ID, req.Params) {
+						fmt.Fprintf(conn, "%s\n", reply)
+					}
+				}
+			}(conn)
+		}
+	}()
+	return "stratum+tcp://" + ln.Addr().String()
+}
+
+// A pool that takes workers named good.*, and says so after a notify or two.
+func goodWorkers(method string, id int, params []interface{}) []string {
+	switch method {
+	case "mining.subscribe":
+		return []string{fmt.Sprintf(`{"id":%d,"result":[[["mining.notify","ae6812eb4cd7735a302a8a9dd95cf71f"]],"08000002",4],"error":null}`, id)}
+	case "mining.authorize":
+		user, _ := params[0].(string)
+		return []string{
+			`{"id":null,"method":"mining.set_difficulty","params":[65536]}`,
+			`{"id":null,"method":"mining.notify","params":["bf","4d16b6f85af6e2198f44ae2a6de67f78487ae5611b77c6c0440b921e00000000","01000000","072f736c7573682f000000000","",[],"00000002","1c2ac4af","504e86b9",false]}`,
+			fmt.Sprintf(`{"id":%d,"result":%v,"error":null}`, id, strings.HasPrefix(user, "good.")),
+		}
+	}
+	return []string{fmt.Sprintf(`{"id":%d,"result":null,"error":[20,"Unknown method",null]}`, id)}
+}
+
+func TestStratumCheck(t *testing.T) {
+	pools_check_wait = 2 * time.Second
+
+	pool := stratumStub(t, goodWorkers)
+	refusing := stratumStub(t, func(method string, id int, params []interface{}) []string {
+		if method == "mining.authorize" {
+			return []string{fmt.Sprintf(`{"id":%d,"result":null,"error":[24,"Unauthorized worker",null]}`, id)}
+		}
+		return goodWorkers(method, id, params)
+	})
+	web := stratumStub(t, func(string, int, []interface{}) []string {
+		return []string{"HTTP/1.1 400 Bad Request", ""}
+	})
+
+	// A port nothing listens on.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := "stratum+tcp://" + ln.Addr().String()
+	ln.Close()
+
+	tests := []struct {
+		name   string
+		url    string
+		user   string
+		result string
+	}{
+		{"authorized", pool, "good.s9-01", "ok"},
+		{"authorize false", pool, "typo.s9-01", "bad-worker"},
+		{"authorize error", refusing, "good.s9-01", "bad-worker"},
+		{"not stratum", web, "good.s9-01", "not-stratum"},
+		{"closed port", closed, "good.s9-01", "dead"},
+		{"stratum v2", "stratum2+tcp://127.0.0.1:3336", "good.s9-01", "skipped"},
+		{"bad url", "stratum+tcp://no-port", "good.s9-01", "bad-url"},
+	}
+	for _, tt := range tests {
+		c := &stratumCheck{url: tt.url, user: tt.user, password: "x"}
+		c.run()
+		if c.result != tt.result {
+			t.Errorf("%s: got %s (%s), want %s", tt.name, c.result, c.detail, tt.result)
+		}
+	}
+}
+
+// The reply to the request, past the notifications sent before it.
+func TestStratumCallSkipsNotifications(t *testing.T) {
+	pool := stratumStub(t, goodWorkers)
+	conn, err := net.Dial("tcp", strings.TrimPrefix(pool, "stratum+tcp://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	rpc := &stratumConn{conn: conn, in: bufio.NewReader(conn)}
+	if _, err := rpc.call("mining.subscribe", "horus/test"); err != nil {
+		t.Fatalf("subscribe: %s", err)
+	}
+	result, err := rpc.call("mining.authorize", "good.s9-01", "x")
+	if err != nil {
+		t.Fatalf("authorize: %s", err)
+	}
+	if string(result) != "true" {
+		t.Errorf("authorize: got %s, want true", result)
+	}
+	if _, err := rpc.call("mining.extranonce.subscribe"); err == nil || !strings.Contains(err.Error(), "Unknown method (20)") {
+		t.Errorf("unknown method: got %v, want Unknown method (20)", err)
+	}
+}
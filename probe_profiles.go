@@ -0,0 +1,280 @@
+package main
+
+//
+// Port lists and probe profiles:
+// Every port we scan is tied to a prober that knows how to talk to it.
+//	cgminer - the miner API (4028) - asks for "version"
+//	http    - grabs the page title and auth realm, so we can spot the
+//	          Antminer / Innosilicon / Whatsminer web UIs
+//	banner  - reads the first line the server sends (ssh, ftp, telnet)
+//	tcp     - connect only
+//
+// Ports are given as a comma separated list, ranges are allowed, and any
+// entry can name its profile: 22,80,4028,8080:http,10000-10010:tcp
+//
+// A miner found with 4029:cgminer is asked everything after the scan on
+// 4029 too - the port rides along in the record's services (apiPort).
+//
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const probe_timeout = 2 * time.Second
+const probe_read_limit = 64 * 1024
+
+// Default ports to scan.  4028 finds the miners, 80 finds the ones
+// whose API has been turned off but still have their web UI up.
+const default_port_spec = "4028,80"
+
+// Well known ports and the profile we use for them when none is given.
+var default_profiles = map[int]string{
+	21:   "banner",
+	22:   "banner",
+	23:   "banner",
+	80:   "http",
+	4028: "cgminer",
+	8000: "http",
+	8080: "http",
+}
+
+type portProbe struct {
+	Port    string
+	Profile string
+}
+
+// What we found behind an open port.
+type Service struct {
+	Port    string `json:"port"`
+	Profile string `json:"profile"`
+	Detail  string `json:"detail,omitempty"` // version, page title, banner ...
+	Miner   string `json:"miner,omitempty"`  // vendor, if the probe recognised a miner
+}
+
+type prober func(conn net.Conn, ip string) (detail string, miner string)
+
+var probers = map[string]prober{
+	"cgminer": probeCGMiner,
+	"http":    probeHTTP,
+	"banner":  probeBanner,
+	"tcp":     probeTCP,
+}
+
+/////////////////////////////////////////////////////////////
+// parsePortSpec
+// "22,80,4028,8080:http,8000-8010" -> list of port/profile pairs
+/////////////////////////////////////////////////////////////
+func parsePortSpec(spec string) ([]portProbe, error) {
+	var list []portProbe
+	seen := make(map[int]bool)
+
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		profile := ""
+		if colon := strings.Index(item, ":"); colon >= 0 {
+			item, profile = item[:colon], item[colon+1:]
+			if _, ok := probers[profile]; !ok {
+				return nil, fmt.Errorf("unknown probe profile (%s) - use one of %s", profile, profileNames())
+			}
+		}
+
+		low, high, err := parsePortRange(item)
+		if err != nil {
+			return nil, err
+		}
+
+		for port := low; port <= high; port++ {
+			if seen[port] {
+				continue
+			}
+			seen[port] = true
+
+			p := profile
+			if p == "" {
+				p = default_profiles[port]
+			}
+			if p == "" {
+				p = "tcp"
+			}
+			list = append(list, portProbe{Port: strconv.Itoa(port), Profile: p})
+		}
+	}
+
+	if len(list) == 0 {
+		return nil, errors.New("no ports specified")
+	}
+	return list, nil
+}
+
+func parsePortRange(item string) (int, int, error) {
+	lowS, highS := item, item
+	if dash := strings.Index(item, "-"); dash >= 0 {
+		lowS, highS = item[:dash], item[dash+1:]
+	}
+
+	low, err := strconv.Atoi(lowS)
+	if err != nil || low < 1 || low > 65535 {
+		return 0, 0, fmt.Errorf("bad port (%s)", item)
+	}
+	high, err := strconv.Atoi(highS)
+	if err != nil || high < low || high > 65535 {
+		return 0, 0, fmt.Errorf("bad port range (%s)", item)
+	}
+	return low, high, nil
+}
+
+func profileNames() string {
+	var names []string
+	for name := range probers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+/////////////////////////////////////////////////////////////
+// probeService
+// Run the profile's prober on an open connection.
+/////////////////////////////////////////////////////////////
+func probeService(conn net.Conn, ip string, pp portProbe) Service {
+	svc := Service{Port: pp.Port, Profile: pp.Profile}
+
+	fn, ok := probers[pp.Profile]
+	if !ok {
+		return svc
+	}
+
+	conn.SetDeadline(time.Now().Add(probe_timeout))
+	svc.Detail, svc.Miner = fn(conn, ip)
+	return svc
+}
+
+// Connect only - the open port is all we know.
+func probeTCP(conn net.Conn, ip string) (string, string) {
+	return "", ""
+}
+
+// Read the first line the server volunteers (ssh, ftp, telnet ...)
+func probeBanner(conn net.Conn, ip string) (string, string) {
+	line, err := bufio.NewReader(io.LimitReader(conn, 1024)).ReadString('\n')
+	if err != nil && line == "" {
+		return "", ""
+	}
+	line = strings.TrimSpace(line)
+	return line, minerVendor(line)
+}
+
+// Ask the miner API for its version, same as:
+//
+//	echo {"command":"version"} | ncat 10.0.0.5 4028
+func probeCGMiner(conn net.Conn, ip string) (string, string) {
+	fmt.Fprintf(conn, `{"command":"version"}`)
+
+	reply, err := bufio.NewReader(io.LimitReader(conn, probe_read_limit)).ReadString('\x00')
+	if err != nil && reply == "" {
+		return "", ""
+	}
+	reply = strings.TrimRight(reply, "\x00")
+
+	var version struct {
+		Status []struct {
+			Description string
+		} `json:"STATUS"`
+		Version []map[string]interface{} `json:"VERSION"`
+	}
+	if json.Unmarshal([]byte(reply), &version) != nil {
+		return "", ""
+	}
+
+	detail := ""
+	if len(version.Status) > 0 {
+		detail = strings.TrimSpace(version.Status[0].Description)
+	}
+	if len(version.Version) > 0 {
+		if t, ok := version.Version[0]["Type"].(string); ok && t != "" {
+			detail = strings.TrimSpace(detail + " " + t)
+		}
+	}
+
+	miner := minerVendor(detail)
+	if miner == "" {
+		miner = "cgminer"
+	}
+	return detail, miner
+}
+
+var title_re = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+var realm_re = regexp.MustCompile(`(?i)realm="([^"]*)"`)
+
+// Grab the page title (or the auth realm when the page is password
+// protected - the Antminer UI uses digest auth with realm "antMiner Configuration")
+func probeHTTP(conn net.Conn, ip string) (string, string) {
+	fmt.Fprintf(conn, "GET / HTTP/1.0\r\nHost: %s\r\nUser-Agent: horus/%s\r\nConnection: close\r\n\r\n", ip, Horus_Version)
+
+	body, _ := io.ReadAll(io.LimitReader(conn, probe_read_limit))
+	if len(body) == 0 {
+		return "", ""
+	}
+	page := string(body)
+
+	var parts []string
+	if m := realm_re.FindStringSubmatch(page); m != nil {
+		parts = append(parts, "realm: "+m[1])
+	}
+	if m := title_re.FindStringSubmatch(page); m != nil {
+		parts = append(parts, "title: "+strings.Join(strings.Fields(m[1]), " "))
+	}
+	if len(parts) == 0 {
+		if eol := strings.Index(page, "\r\n"); eol > 0 {
+			parts = append(parts, page[:eol])
+		}
+	}
+
+	return strings.Join(parts, ", "), minerVendor(page)
+}
+
+/////////////////////////////////////////////////////////////
+// minerVendor
+// Look for tell-tale vendor strings in whatever a probe got back.
+/////////////////////////////////////////////////////////////
+var miner_vendors = []struct {
+	key    string
+	vendor string
+}{
+	{"antminer", "Bitmain Antminer"},
+	{"bmminer", "Bitmain Antminer"},
+	{"bitmain", "Bitmain"},
+	{"innosilicon", "Innosilicon"},
+	{"whatsminer", "MicroBT Whatsminer"},
+	{"btminer", "MicroBT Whatsminer"},
+	{"avalon", "Canaan Avalon"},
+	{"canaan", "Canaan"},
+	{"braiins", "Braiins OS"},
+	{"bosminer", "Braiins OS"},
+	{"sgminer", "sgminer"},
+	{"cgminer", "cgminer"},
+}
+
+func minerVendor(text string) string {
+	lower := strings.ToLower(text)
+	for _, v := range miner_vendors {
+		if strings.Contains(lower, v.key) {
+			return v.vendor
+		}
+	}
+	return ""
+}
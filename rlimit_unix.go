@@ -0,0 +1,32 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import "syscall"
+
+// openFileLimit returns the soft RLIMIT_NOFILE for this process.
+// We try to raise the soft limit to the hard limit first - most systems
+// ship with a soft limit of 1024 and a much higher hard limit.
+func openFileLimit() int {
+	var rl syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rl); err != nil {
+		return 1024
+	}
+
+	if rl.Cur < rl.Max {
+		want := rl
+		want.Cur = rl.Max
+		if want.Cur > maxScanWorkers+fdReserve {
+			want.Cur = maxScanWorkers + fdReserve
+		}
+		if want.Cur > rl.Cur && syscall.Setrlimit(syscall.RLIMIT_NOFILE, &want) == nil {
+			rl = want
+		}
+	}
+
+	if rl.Cur > 1<<20 {
+		return 1 << 20
+	}
+	return int(rl.Cur)
+}
@@ -0,0 +1,8 @@
+package main
+
+// openFileLimit - Windows has no RLIMIT_NOFILE.  Sockets are limited by
+// memory rather than a descriptor table, so use a conservative default
+// and let the EMFILE/timeout backoff in the scan engine do the rest.
+func openFileLimit() int {
+	return 2048
+}
@@ -0,0 +1,176 @@
+package main
+
+//
+// horus restart -rolling:
+// Restart a few miners at a time, and only start the next few once the
+// last ones are hashing again - so the breakers see a few miners spin up,
+// not a whole room.
+//
+// A miner is back when its api answers, it has been up for less time than
+// since we restarted it (so it really did restart), and its MHS 5s is at
+// least -healthy times the MHS av it had before.  If a batch is not back
+// within -wait-healthy, or any restart in it fails, we stop, and the miners
+// not restarted yet are left alone.
+//
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"cgminer-api"
+)
+
+var restart_rolling bool = false
+var restart_batch int = 10
+var restart_wait time.Duration = 5 * time.Minute
+var restart_healthy float64 = 0.9
+
+// How often to ask a restarted miner how it is doing.
+var rolling_check_every = 10 * time.Second
+
+// One miner's progress through a rolling restart.
+type rollingMiner struct {
+	rec       *HostRecord
+	before    float64 // MHS av before the restart
+	restarted time.Time
+	back      bool
+}
+
+/////////////////////////////////////////////////////////////
+// rollingRestart
+// The records get action, result (ok, failed, skipped) and
+// a message each.  Returns false when a batch did not come
+// back.
+/////////////////////////////////////////////////////////////
+func rollingRestart(records []HostRecord) bool {
+	batches := (len(records) + restart_batch - 1) / restart_batch
+	for i := range records {
+		records[i].Action = "restart"
+		records[i].Result = "skipped"
+		records[i].Message = "not reached"
+	}
+
+	for b := 0; b < batches; b++ {
+		start, end := b*restart_batch, (b+1)*restart_batch
+		if end > len(records) {
+			end = len(records)
+		}
+		fmt.Printf("%s Batch %d of %d: restarting %d miner(s)\n", time.Now().Format("15:04:05"), b+1, batches, end-start)
+
+		batch, failed := restartBatch(records[start:end])
+		if failed > 0 {
+			fmt.Printf("%s Batch %d: %d restart(s) failed - stopping (%d miner(s) not restarted)\n",
+				time.Now().Format("15:04:05"), b+1, failed, len(records)-end)
+			for i := end; i < len(records); i++ {
+				records[i].Message = fmt.Sprintf("not restarted: batch %d had a restart fail", b+1)
+			}
+			return false
+		}
+		if !waitHealthy(batch) {
+			fmt.Printf("%s Batch %d did not recover in %s - stopping (%d miner(s) not restarted)\n",
+				time.Now().Format("15:04:05"), b+1, restart_wait, len(records)-end)
+			for i := end; i < len(records); i++ {
+				records[i].Message = fmt.Sprintf("not restarted: batch %d did not recover", b+1)
+			}
+			return false
+		}
+	}
+	return true
+}
+
+// Note how each miner is doing, restart them all, return the ones that took
+// it and how many did not.
+func restartBatch(records []HostRecord) ([]*rollingMiner, int) {
+	var batch []*rollingMiner
+	failed := 0
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	for i := range records {
+		wg.Add(1)
+		go func(rec *HostRecord) {
+			defer wg.Done()
+			m := &rollingMiner{rec: rec}
+			if s, err := cgminer.New(rec.Host, apiPort(*rec)).Summary(); err == nil {
+				m.before = s.MHSav
+			}
+
+			m.restarted = time.Now()
+			if _, err := minerCommand(rec.Host, apiPort(*rec), "restart", ""); err != nil {
+				rec.Result = "failed"
+				rec.Message = ""
+				rec.Errors = append(rec.Errors, err.Error())
+				fmt.Printf(" ... IP: %s restart failed: %s\n", rec.Host, err)
+				mu.Lock()
+				failed++
+				mu.Unlock()
+				return
+			}
+			rec.Result = "restarting"
+			mu.Lock()
+			batch = append(batch, m)
+			mu.Unlock()
+		}(&records[i])
+	}
+	wg.Wait()
+	return batch, failed
+}
+
+/////////////////////////////////////////////////////////////
+// waitHealthy
+// Ask every rolling_check_every until the whole batch is back
+// or -wait-healthy is up.
+/////////////////////////////////////////////////////////////
+func waitHealthy(batch []*rollingMiner) bool {
+	deadline := time.Now().Add(restart_wait)
+	for {
+		waiting := 0
+		for _, m := range batch {
+			if !m.back {
+				m.check()
+			}
+			if !m.back {
+				waiting++
+			}
+		}
+		if waiting == 0 {
+			return true
+		}
+		if time.Now().After(deadline) {
+			for _, m := range batch {
+				if !m.back {
+					m.rec.Result = "failed"
+					m.rec.Errors = append(m.rec.Errors, "not healthy after "+restart_wait.String())
+				}
+			}
+			return false
+		}
+		fmt.Printf("%s ... waiting for %d miner(s)\n", time.Now().Format("15:04:05"), waiting)
+		time.Sleep(rolling_check_every)
+	}
+}
+
+func (m *rollingMiner) check() {
+	s, err := cgminer.New(m.rec.Host, apiPort(*m.rec)).Summary()
+	if err != nil {
+		m.rec.Message = "api not answering"
+		return
+	}
+	// Up longer than since we restarted it - it has not gone down yet.
+	since := time.Since(m.restarted)
+	if time.Duration(s.Elapsed)*time.Second > since+5*time.Second {
+		m.rec.Message = "not restarted yet"
+		return
+	}
+	want := restart_healthy * m.before
+	if s.MHS5s < want || (m.before == 0 && s.MHS5s == 0) {
+		m.rec.Message = fmt.Sprintf("%.2f MH/s of %.2f wanted", s.MHS5s, want)
+		return
+	}
+
+	m.back = true
+	m.rec.Result = "ok"
+	m.rec.Message = fmt.Sprintf("back in %s at %.2f MH/s (was %.2f av)", since.Round(time.Second), s.MHS5s, m.before)
+	fmt.Printf(" ... IP: %s %s\n", m.rec.Host, m.rec.Message)
+}
@@ -0,0 +1,347 @@
+package main
+
+//
+// Scanning engine:
+// A bounded pool of workers replaces the old one-goroutine-per-address scan
+// that was gated by a 32768 slot semaphore.  That was more than most boxes
+// allow for open files (ulimit -n) and it could flood the small switches
+// we find in the mining sheds.
+//
+// The engine:
+//	- sizes itself from RLIMIT_NOFILE (see rlimit_*.go)
+//	- optionally limits the number of dials per second (-rate)
+//	- backs off when it runs out of file descriptors (EMFILE) or when it sees
+//	  a sudden burst of timeouts, and grows back slowly when things settle.
+//	- walks cidr blocks lazily, so a /8 takes the same memory as a /32.
+//
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	fdReserve       = 64   // file descriptors left alone for stdout, logs, api calls etc.
+	maxScanWorkers  = 4096 // never run more dials than this at once
+	minScanWorkers  = 16   // timeouts alone will never push us below this
+	burstWindow     = 64   // number of dials looked at when hunting for timeout bursts
+	burstMargin     = 0.25 // timeout ratio jump (over the running average) that counts as a burst
+	emfileBackoff   = 250 * time.Millisecond
+	maxDialAttempts = 5 // retries when a dial could not get a file descriptor
+)
+
+type scanEngine struct {
+	workers int // number of worker goroutines (and the ceiling for limit)
+	rate    int // dials per second - 0 means no limit
+	tick    <-chan time.Time
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	limit    int // dials currently allowed in flight
+	ceiling  int // limit never grows past this
+	floor    int // timeout backoff never goes below this
+	inflight int // dials in flight right now
+
+	winTotal    int     // dials finished in the current window
+	winTimeouts int     // of which timed out
+	avgTimeouts float64 // running average of the timeout ratio
+	primed      bool    // avgTimeouts has seen at least one window
+}
+
+/////////////////////////////////////////////////////////////
+// newScanEngine
+// workers == 0 means size from the open file limit.
+// rate == 0 means do not limit dials per second.
+/////////////////////////////////////////////////////////////
+func newScanEngine(workers int, rate int) *scanEngine {
+	if workers <= 0 {
+		workers = autoScanWorkers()
+	}
+	if workers > maxScanWorkers {
+		workers = maxScanWorkers
+	}
+
+	e := &scanEngine{
+		workers: workers,
+		rate:    rate,
+		limit:   workers,
+		ceiling: workers,
+		floor:   workers / 16,
+	}
+	if e.floor < minScanWorkers {
+		e.floor = minScanWorkers
+	}
+	if e.floor > workers {
+		e.floor = workers
+	}
+	e.cond = sync.NewCond(&e.mu)
+
+	if debug {
+		fmt.Printf("Scan engine: %d workers, floor %d, rate %d/s\n", e.workers, e.floor, e.rate)
+	}
+	return e
+}
+
+/////////////////////////////////////////////////////////////
+// How many workers can we afford?
+// Whatever the soft open file limit allows, less a reserve.
+/////////////////////////////////////////////////////////////
+func autoScanWorkers() int {
+	n := openFileLimit() - fdReserve
+	if n < minScanWorkers {
+		n = minScanWorkers
+	}
+	if n > maxScanWorkers {
+		n = maxScanWorkers
+	}
+	return n
+}
+
+/////////////////////////////////////////////////////////////
+// run
+// Hand every address from the iterator to probe, using at most
+// e.workers goroutines.  Returns when every address has been probed.
+/////////////////////////////////////////////////////////////
+func (e *scanEngine) run(targets *targetIterator, probe func(ip string)) {
+	if e.rate > 0 {
+		interval := time.Second / time.Duration(e.rate)
+		if interval <= 0 {
+			interval = time.Nanosecond
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		e.tick = ticker.C
+	}
+
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+
+	for i := 0; i < e.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ip := range jobs {
+				probe(ip)
+				sdProgress()
+			}
+		}()
+	}
+
+	for {
+		ip, ok := targets.Next()
+		if !ok {
+			break
+		}
+		jobs <- ip
+	}
+	close(jobs)
+
+	// blocks until all the workers are done.
+	wg.Wait()
+}
+
+/////////////////////////////////////////////////////////////
+// dial
+// net.DialTimeout, but rate limited and gated by the adaptive limit.
+// Dials that fail for lack of file descriptors are retried after a
+// back off, so a host is not reported as down just because we were busy.
+// Also returns how long the dial itself took (not counting our own waiting).
+/////////////////////////////////////////////////////////////
+func (e *scanEngine) dial(network string, hostPort string) (net.Conn, time.Duration, error) {
+	var conn net.Conn
+	var err error
+	var latency time.Duration
+
+	for attempt := 0; attempt < maxDialAttempts; attempt++ {
+		if e.tick != nil {
+			<-e.tick
+		}
+
+		e.acquire()
+		start := time.Now()
+		conn, err = net.DialTimeout(network, hostPort, connection_timeout)
+		latency = time.Since(start)
+		e.release(err)
+
+		if !isTooManyFiles(err) {
+			break
+		}
+
+		if debug {
+			fmt.Fprintf(os.Stderr, "Out of file descriptors dialing %s - backing off\n", hostPort)
+		}
+		time.Sleep(emfileBackoff * time.Duration(attempt+1))
+	}
+
+	return conn, latency, err
+}
+
+// Wait until there is room under the current limit.
+func (e *scanEngine) acquire() {
+	e.mu.Lock()
+	for e.inflight >= e.limit {
+		e.cond.Wait()
+	}
+	e.inflight++
+	e.mu.Unlock()
+}
+
+// Give the slot back and adapt the limit to what the dial told us.
+func (e *scanEngine) release(err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if isTooManyFiles(err) {
+		// We hit the wall at the current inflight count - do not go back there.
+		e.ceiling = e.inflight * 3 / 4
+		if e.ceiling < 1 {
+			e.ceiling = 1
+		}
+		e.setLimit(e.limit / 2)
+		e.inflight--
+		e.cond.Broadcast()
+		return
+	}
+	e.inflight--
+
+	e.winTotal++
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		e.winTimeouts++
+	}
+
+	if e.winTotal >= burstWindow {
+		e.adapt()
+	}
+	e.cond.Broadcast()
+}
+
+// Look at the last window of dials.  A jump in timeouts over the
+// running average is a burst (probably a choking switch) so halve the
+// limit.  A calm window lets the limit grow back by an eighth.
+// A network that is mostly empty times out all the time - that is not
+// a burst, which is why we compare against the average rather than zero.
+func (e *scanEngine) adapt() {
+	ratio := float64(e.winTimeouts) / float64(e.winTotal)
+
+	if !e.primed {
+		e.avgTimeouts = ratio
+		e.primed = true
+	} else {
+		if ratio > e.avgTimeouts+burstMargin {
+			if debug {
+				fmt.Fprintf(os.Stderr, "Timeout burst (%.2f vs %.2f) - scan limit %d -> %d\n",
+					ratio, e.avgTimeouts, e.limit, e.limit/2)
+			}
+			e.setLimit(e.limit / 2)
+		} else if ratio <= e.avgTimeouts+burstMargin/4 {
+			grow := e.limit / 8
+			if grow < 1 {
+				grow = 1
+			}
+			e.setLimit(e.limit + grow)
+		}
+		e.avgTimeouts = 0.8*e.avgTimeouts + 0.2*ratio
+	}
+
+	e.winTotal = 0
+	e.winTimeouts = 0
+}
+
+// Clamp to floor/ceiling.  The ceiling wins (fd exhaustion beats everything).
+func (e *scanEngine) setLimit(n int) {
+	if n < e.floor {
+		n = e.floor
+	}
+	if n > e.ceiling {
+		n = e.ceiling
+	}
+	if n < 1 {
+		n = 1
+	}
+	e.limit = n
+}
+
+func isTooManyFiles(err error) bool {
+	return err != nil && (errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE))
+}
+
+/////////////////////////////////////////////////////////////
+// targetIterator
+// Walks a list of ip addresses and cidr blocks one address at a time.
+// Nothing is expanded up front, so memory use does not depend on the
+// size of the blocks.
+/////////////////////////////////////////////////////////////
+type targetIterator struct {
+	specs []string
+	next  int // index of the next spec to open
+
+	cur   net.IP     // next address in the open cidr block (nil when none open)
+	ipnet *net.IPNet // the open cidr block
+}
+
+func newTargetIterator(specs []string) *targetIterator {
+	return &targetIterator{specs: specs}
+}
+
+// Next returns the next address to scan, false when we are done.
+func (t *targetIterator) Next() (string, bool) {
+	for {
+		if t.cur != nil {
+			if t.ipnet.Contains(t.cur) {
+				ip := t.cur.String()
+				inc(t.cur)
+				if allZero(t.cur) {
+					// wrapped around the end of the address space
+					t.cur = nil
+				}
+				return ip, true
+			}
+			t.cur = nil
+		}
+
+		if t.next >= len(t.specs) {
+			return "", false
+		}
+		spec := t.specs[t.next]
+		t.next++
+
+		// Lets see if there is a CIDR Block or not.
+		if !strings.Contains(spec, "/") {
+			// We got an ip not a CIDR block. no prob. just hand it out.
+			if debug {
+				fmt.Println("after parsing - we have an ip, not a cidr block: ", net.ParseIP(spec))
+			}
+			return spec, true
+		}
+
+		newip, ipnet, err := net.ParseCIDR(spec)
+		if err != nil {
+			fmt.Println("Got an error back from net.Parse: ", err)
+			continue
+		}
+		if debug {
+			fmt.Println("In a CIDR Block: ip:", spec, "newip", newip, "ipnet: ", ipnet)
+		}
+
+		// walk the network block with the appropriate mask.
+		start := newip.Mask(ipnet.Mask)
+		t.cur = make(net.IP, len(start))
+		copy(t.cur, start)
+		t.ipnet = ipnet
+	}
+}
+
+func allZero(ip net.IP) bool {
+	for _, b := range ip {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,72 @@
+package main
+
+//
+// systemd notify - so horus can run as a Type=notify service:
+//
+//	[Service]
+//	Type=notify
+//	ExecStart=/usr/local/bin/horus watch -interval 60s 10.0.0.0/22
+//	WatchdogSec=300
+//
+// The protocol is one datagram per message to $NOTIFY_SOCKET - no need
+// for a library.  Without $NOTIFY_SOCKET (not under systemd, or not on
+// linux) every call does nothing.
+//
+// WATCHDOG=1 is only sent while the work moves: each address scanned and
+// each miner polled counts as progress (sdProgress), so a scan or a poll
+// that hangs stops the pings and systemd restarts us.
+//
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Bumped by the scan and the poll as they get through the addresses.
+var sd_progress int64
+
+func sdProgress() {
+	atomic.AddInt64(&sd_progress, 1)
+}
+
+// What sdProgress is up to - compare two readings to see if anything moved.
+func sdProgressCount() int64 {
+	return atomic.LoadInt64(&sd_progress)
+}
+
+/////////////////////////////////////////////////////////////
+// sdNotify
+// Send READY=1, STATUS=..., WATCHDOG=1, STOPPING=1 ...
+// Errors are ignored - systemd not listening is not our problem.
+/////////////////////////////////////////////////////////////
+func sdNotify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:] // abstract namespace
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.Write([]byte(state))
+}
+
+// How often systemd wants WATCHDOG=1 (0: no watchdog).  We ping at half that.
+func sdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0 // meant for another process
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
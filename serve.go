@@ -0,0 +1,255 @@
+package main
+
+//
+// horus serve:
+// A web dashboard for the wall - everything it needs is built in (web/).
+//
+//	/                  the dashboard: miner table, site hashrate, rack heatmap
+//	/#/miner/10.0.0.5  one miner: summary, pools, devs, config
+//	/api/fleet         the last poll, as json
+//	/api/miner?ip=     ask one miner for everything, now
+//	/events            server-sent events - "fleet" after every poll
+//
+// Racks: without -racks every /24 is a rack and the last octet is the
+// position.  A racks file puts miners where they really are, one per line:
+//
+//	# MAC or IP          rack    position
+//	b4:10:7b:01:02:03    A01     1
+//	10.0.4.23            A01     2
+//
+
+import (
+	"bufio"
+	"embed"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed web
+var web_files embed.FS
+
+var serve_listen string = ":8080"
+var serve_interval time.Duration = 30 * time.Second
+var serve_rescan time.Duration = 10 * time.Minute
+var serve_racks string = ""
+
+func serveFlags(fs *flag.FlagSet) {
+	fs.StringVar(&serve_listen, "listen", serve_listen, "Address to serve the dashboard on")
+	fs.DurationVar(&serve_interval, "interval", serve_interval, "Time between polls of the miners")
+	fs.DurationVar(&serve_rescan, "rescan", serve_rescan, "Time between scans for new miners")
+	fs.StringVar(&serve_racks, "racks", serve_racks, "File of: MAC or IP, rack, position - for the heatmap")
+}
+
+type rackSpot struct {
+	Rack     string `json:"rack"`
+	Position int    `json:"position"`
+}
+
+// What /api/fleet and the "fleet" event send.
+type fleetDoc struct {
+	Schema   int                 `json:"schema"`
+	Version  string              `json:"horus_version"`
+	Site     string              `json:"site,omitempty"`
+	Polled   time.Time           `json:"polled"`
+	Duration float64             `json:"poll_seconds"`
+	Miners   []HostRecord        `json:"miners"`
+	Racks    map[string]rackSpot `json:"racks"` // by ip
+}
+
+/////////////////////////////////////////////////////////////
+// cmdServe
+// horus serve [-listen :8080] [-interval 30s] [-rescan 10m] [-racks file] [targets]
+/////////////////////////////////////////////////////////////
+func cmdServe(args []string) int {
+	if !Test_Cmdline_IP(args) {
+		return 1
+	}
+	if serve_interval <= 0 || serve_rescan <= 0 {
+		fmt.Println("Error: -interval and -rescan must be more than zero")
+		return 1
+	}
+
+	racks, err := loadRacks(serve_racks)
+	if err != nil {
+		fmt.Printf("Error: -racks (%s): %s\n", serve_racks, err)
+		return 1
+	}
+
+	state := &fleetState{name: "Dashboard", interval: serve_interval, rescan: serve_rescan}
+	go state.loop(args)
+
+	mux := http.NewServeMux()
+	dashboardRoutes(mux, state, racks)
+
+	fmt.Printf("Serving the dashboard on %s\n", serve_listen)
+	if err := http.ListenAndServe(serve_listen, mux); err != nil {
+		fmt.Println("Error: ", err)
+		return 1
+	}
+	return 0
+}
+
+func dashboardRoutes(mux *http.ServeMux, state *fleetState, racks map[string]rackSpot) {
+	static, _ := fs.Sub(web_files, "web")
+	mux.Handle("/", http.FileServer(http.FS(static)))
+
+	mux.HandleFunc("/api/fleet", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, state.doc(racks))
+	})
+
+	mux.HandleFunc("/api/miner", func(w http.ResponseWriter, r *http.Request) {
+		ip := r.URL.Query().Get("ip")
+		if net.ParseIP(ip).To4() == nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "ip must be an IPv4 address"})
+			return
+		}
+		rec := newRecord(ip)
+		addDetails(&rec, all_details)
+		writeJSON(w, http.StatusOK, rec)
+	})
+
+	mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		serveFleetEvents(w, r, state, racks)
+	})
+}
+
+func (s *fleetState) doc(racks map[string]rackSpot) fleetDoc {
+	records, polled, duration := s.snapshot()
+	if records == nil {
+		records = []HostRecord{}
+	}
+	doc := fleetDoc{
+		Schema:   output_schema,
+		Version:  Horus_Version,
+		Site:     site_name,
+		Polled:   polled,
+		Duration: duration.Seconds(),
+		Miners:   records,
+		Racks:    make(map[string]rackSpot),
+	}
+	for _, rec := range records {
+		doc.Racks[rec.Host] = rackFor(rec, racks)
+	}
+	return doc
+}
+
+/////////////////////////////////////////////////////////////
+// serveFleetEvents
+// Server-sent events: the fleet now, then again after every
+// poll, until the browser goes away.
+/////////////////////////////////////////////////////////////
+func serveFleetEvents(w http.ResponseWriter, r *http.Request, state *fleetState, racks map[string]rackSpot) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	updates := state.subscribe()
+	defer state.unsubscribe(updates)
+
+	// A comment every so often keeps proxies from closing a quiet connection.
+	keepalive := time.NewTicker(30 * time.Second)
+	defer keepalive.Stop()
+
+	send := func() bool {
+		b, err := json.Marshal(state.doc(racks))
+		if err != nil {
+			return false
+		}
+		if _, err := fmt.Fprintf(w, "event: fleet\ndata: %s\n\n", b); err != nil {
+			return false
+		}
+		flusher.Flush()
+		return true
+	}
+
+	if !send() {
+		return
+	}
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-updates:
+			if !send() {
+				return
+			}
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+			flusher.Flush()
+		}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+/////////////////////////////////////////////////////////////
+// Racks
+/////////////////////////////////////////////////////////////
+func loadRacks(path string) (map[string]rackSpot, error) {
+	racks := make(map[string]rackSpot)
+	if path == "" {
+		return racks, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("line %d: want MAC or IP, rack, [position]", n)
+		}
+		spot := rackSpot{Rack: fields[1]}
+		if len(fields) > 2 {
+			if spot.Position, err = strconv.Atoi(fields[2]); err != nil {
+				return nil, fmt.Errorf("line %d: position (%s) is not a number", n, fields[2])
+			}
+		}
+		key := fields[0]
+		if mac := normalizeMAC(key); mac != "" {
+			key = mac
+		}
+		racks[key] = spot
+	}
+	return racks, scanner.Err()
+}
+
+// By MAC, then ip, then the /24 and last octet.
+func rackFor(rec HostRecord, racks map[string]rackSpot) rackSpot {
+	if spot, ok := racks[rec.MAC]; ok && rec.MAC != "" {
+		return spot
+	}
+	if spot, ok := racks[rec.Host]; ok {
+		return spot
+	}
+	spot := rackSpot{Rack: rec.Host}
+	if i := strings.LastIndex(rec.Host, "."); i > 0 {
+		spot.Rack = rec.Host[:i]
+		spot.Position, _ = strconv.Atoi(rec.Host[i+1:])
+	}
+	return spot
+}
@@ -0,0 +1,540 @@
+package main
+
+//
+// Time series sinks:  -sink influx=http://host:8086/write?db=miners
+//                     -sink graphite=tcp://host:2003/horus
+//
+// Every poll (watch, exporter) turns the Summary, Pools and Devs of each
+// miner into Points and hands them to every sink.  Each sink has its own
+// goroutine that batches the points, retries a failed write a few times,
+// and when the sink stays down spools the points to disk.  The spool is
+// sent first the next time a write works, so nothing is lost while the
+// database is being restarted.
+//
+// A new backend only has to implement Sink and add a case to newSink.
+//
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// One sample: measurement + tags identify the series, fields are the values.
+type Point struct {
+	Measurement string             `json:"measurement"`
+	Tags        map[string]string  `json:"tags"`
+	Key         []string           `json:"key"` // the tags that name the series, most general first (graphite path)
+	Fields      map[string]float64 `json:"fields"`
+	Time        time.Time          `json:"time"`
+}
+
+type Sink interface {
+	Name() string               // for messages and the spool file name
+	Write(points []Point) error // all or nothing - a failed write is retried whole
+}
+
+/////////////////////////////////////////////////////////////
+// sink options
+/////////////////////////////////////////////////////////////
+var sink_batch int = 500                    // points per write
+var sink_retries int = 3                    // tries before we spool
+var sink_spool_max int64 = 64 * 1024 * 1024 // stop spooling (drop points) past this size
+
+var sink_spool string = "" // spool directory ("": the user cache dir)
+
+// -sink can be given more than once.
+type sinkList []string
+
+func (s *sinkList) String() string {
+	return strings.Join(*s, " ")
+}
+
+func (s *sinkList) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+var sink_specs sinkList
+
+/////////////////////////////////////////////////////////////
+// newSink
+// influx=URL - InfluxDB line protocol over http(s).  The URL is
+// used as given; with no path we write to /write?db=horus
+// graphite=URL - Graphite plaintext over tcp:// or udp://.  The
+// path, if any, is the metric prefix (default: horus)
+/////////////////////////////////////////////////////////////
+func newSink(spec string) (Sink, error) {
+	eq := strings.Index(spec, "=")
+	if eq < 0 {
+		return nil, fmt.Errorf("%s: want kind=url (influx=http://... or graphite=tcp://...)", spec)
+	}
+	kind, raw := spec[:eq], spec[eq+1:]
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", spec, err)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("%s: no host in the url", spec)
+	}
+
+	switch kind {
+	case "influx", "influxdb":
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return nil, fmt.Errorf("%s: influx wants an http:// or https:// url", spec)
+		}
+		if u.Path == "" || u.Path == "/" {
+			u.Path = "/write"
+			if u.RawQuery == "" {
+				u.RawQuery = "db=horus"
+			}
+		}
+		return &influxSink{url: u.String(), client: &http.Client{Timeout: 30 * time.Second}}, nil
+
+	case "graphite":
+		if u.Scheme != "tcp" && u.Scheme != "udp" {
+			return nil, fmt.Errorf("%s: graphite wants a tcp:// or udp:// url", spec)
+		}
+		if u.Port() == "" {
+			u.Host = net.JoinHostPort(u.Host, "2003")
+		}
+		prefix := strings.Trim(u.Path, "/")
+		if prefix == "" {
+			prefix = "horus"
+		}
+		return &graphiteSink{network: u.Scheme, addr: u.Host, prefix: strings.Replace(prefix, "/", ".", -1)}, nil
+	}
+	return nil, fmt.Errorf("%s: unknown sink kind (%s) - influx or graphite", spec, kind)
+}
+
+/////////////////////////////////////////////////////////////
+// InfluxDB
+/////////////////////////////////////////////////////////////
+type influxSink struct {
+	url    string
+	client *http.Client
+}
+
+func (s *influxSink) Name() string {
+	return "influx " + s.url
+}
+
+func (s *influxSink) Write(points []Point) error {
+	var body bytes.Buffer
+	for _, p := range points {
+		body.WriteString(influxLine(p))
+		body.WriteString("\n")
+	}
+
+	resp, err := s.client.Post(s.url, "text/plain; charset=utf-8", &body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+var influx_key_escaper = strings.NewReplacer(",", `\,`, " ", `\ `, "=", `\=`)
+
+// measurement,tag=v,tag=v field=1,field=2 timestamp(ns)
+func influxLine(p Point) string {
+	var b strings.Builder
+	b.WriteString(influx_key_escaper.Replace(p.Measurement))
+
+	for _, k := range sortedKeys(p.Tags) {
+		if p.Tags[k] == "" {
+			continue // influx does not take empty tag values
+		}
+		b.WriteString("," + influx_key_escaper.Replace(k) + "=" + influx_key_escaper.Replace(p.Tags[k]))
+	}
+
+	sep := " "
+	for _, k := range sortedFields(p.Fields) {
+		b.WriteString(sep + influx_key_escaper.Replace(k) + "=" + strconv.FormatFloat(p.Fields[k], 'g', -1, 64))
+		sep = ","
+	}
+
+	b.WriteString(" " + strconv.FormatInt(p.Time.UnixNano(), 10))
+	return b.String()
+}
+
+/////////////////////////////////////////////////////////////
+// Graphite
+/////////////////////////////////////////////////////////////
+type graphiteSink struct {
+	network string
+	addr    string
+	prefix  string
+}
+
+func (s *graphiteSink) Name() string {
+	return "graphite " + s.network + "://" + s.addr
+}
+
+func (s *graphiteSink) Write(points []Point) error {
+	conn, err := net.DialTimeout(s.network, s.addr, connection_timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	var lines []string
+	for _, p := range points {
+		path := s.prefix + "." + graphiteName(p.Measurement)
+		for _, k := range p.Key {
+			path += "." + graphiteName(p.Tags[k])
+		}
+		for _, f := range sortedFields(p.Fields) {
+			lines = append(lines, fmt.Sprintf("%s.%s %s %d\n", path, graphiteName(f), strconv.FormatFloat(p.Fields[f], 'g', -1, 64), p.Time.Unix()))
+		}
+	}
+
+	if s.network == "udp" {
+		return writeDatagrams(conn, lines)
+	}
+	w := bufio.NewWriter(conn)
+	for _, line := range lines {
+		w.WriteString(line)
+	}
+	return w.Flush()
+}
+
+// Graphite reads each datagram on its own - a line cut in two is lost,
+// so every datagram holds whole lines and stays under one ethernet frame.
+const graphite_datagram = 1400
+
+func writeDatagrams(conn net.Conn, lines []string) error {
+	var buf []byte
+	for _, line := range lines {
+		if len(buf) > 0 && len(buf)+len(line) > graphite_datagram {
+			if _, err := conn.Write(buf); err != nil {
+				return err
+			}
+			buf = buf[:0]
+		}
+		buf = append(buf, line...)
+	}
+	if len(buf) > 0 {
+		_, err := conn.Write(buf)
+		return err
+	}
+	return nil
+}
+
+var graphite_bad_chars = regexp.MustCompile(`[^A-Za-z0-9_\-]`)
+
+// 10.0.0.5 -> 10_0_0_5 - dots are the graphite path separator.
+func graphiteName(s string) string {
+	if s == "" {
+		return "none"
+	}
+	return graphite_bad_chars.ReplaceAllString(s, "_")
+}
+
+func sortedKeys(m map[string]string) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedFields(m map[string]float64) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+/////////////////////////////////////////////////////////////
+// recordPoints
+// The time series for one polled miner:
+// horus_miner (host) - hashrate, shares, errors, uptime
+// horus_pool (host, pool) - alive, active, priority, shares
+// horus_device (host, device) - temperature, fans, hashrate
+/////////////////////////////////////////////////////////////
+func recordPoints(rec HostRecord, now time.Time) []Point {
+	model := ""
+	if rec.Version != nil {
+		model = rec.Version.Type
+	}
+	tags := func(extra ...string) map[string]string {
+		t := map[string]string{"host": rec.Host, "mac": rec.MAC, "model": model}
+		for i := 0; i+1 < len(extra); i += 2 {
+			t[extra[i]] = extra[i+1]
+		}
+		return t
+	}
+
+	var points []Point
+
+	miner := Point{Measurement: "horus_miner", Tags: tags(), Key: []string{"host"}, Time: now,
+		Fields: map[string]float64{"up": boolMetric(rec.Summary != nil)}}
+	if s := rec.Summary; s != nil {
+		miner.Fields["mhs_5s"] = s.MHS5s
+		miner.Fields["mhs_av"] = s.MHSav
+		miner.Fields["accepted"] = float64(s.Accepted)
+		miner.Fields["rejected"] = float64(s.Rejected)
+		miner.Fields["stale"] = float64(s.Stale)
+		miner.Fields["hardware_errors"] = float64(s.HardwareErrors)
+		miner.Fields["elapsed"] = float64(s.Elapsed)
+	}
+	points = append(points, miner)
+
+	for _, p := range rec.Pools {
+		points = append(points, Point{
+			Measurement: "horus_pool",
+			Tags:        tags("pool", strconv.FormatInt(p.Pool, 10), "url", p.URL, "user", p.User),
+			Key:         []string{"host", "pool"},
+			Time:        now,
+			Fields: map[string]float64{
+				"alive":          boolMetric(p.Status == "Alive"),
+				"stratum_active": boolMetric(p.StratumActive),
+				"priority":       float64(p.Priority),
+				"accepted":       float64(p.Accepted),
+				"rejected":       float64(p.Rejected),
+				"stale":          float64(p.Stale),
+			},
+		})
+	}
+
+	for i, d := range rec.Devs {
+		points = append(points, Point{
+			Measurement: "horus_device",
+			Tags:        tags("device", strconv.Itoa(i)),
+			Key:         []string{"host", "device"},
+			Time:        now,
+			Fields: map[string]float64{
+				"alive":           boolMetric(d.Status == "Alive"),
+				"temperature":     d.Temperature,
+				"fan_rpm":         float64(d.FanSpeed),
+				"fan_percent":     float64(d.FanPercent),
+				"mhs_5s":          d.MHS5s,
+				"mhs_av":          d.MHSav,
+				"hardware_errors": float64(d.HardwareErrors),
+			},
+		})
+	}
+	return points
+}
+
+/////////////////////////////////////////////////////////////
+// sinkRunner
+// One per sink: batches, retries and the spool file.
+/////////////////////////////////////////////////////////////
+type sinkRunner struct {
+	sink  Sink
+	spool string // file
+	in    chan []Point
+	done  chan struct{}
+}
+
+var sink_runners []*sinkRunner
+
+/////////////////////////////////////////////////////////////
+// startSinks
+// Check the -sink options and start a runner for each.
+/////////////////////////////////////////////////////////////
+func startSinks() error {
+	if len(sink_specs) == 0 {
+		return nil
+	}
+
+	dir := sink_spool
+	if dir == "" {
+		cache, err := os.UserCacheDir()
+		if err != nil {
+			cache = os.TempDir()
+		}
+		dir = filepath.Join(cache, "horus", "spool")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("-spool (%s): %s", dir, err)
+	}
+
+	for _, spec := range sink_specs {
+		sink, err := newSink(spec)
+		if err != nil {
+			return fmt.Errorf("-sink %s", err)
+		}
+		r := &sinkRunner{
+			sink:  sink,
+			spool: filepath.Join(dir, graphiteName(sink.Name())+".spool"),
+			in:    make(chan []Point, 16),
+			done:  make(chan struct{}),
+		}
+		go r.run()
+		sink_runners = append(sink_runners, r)
+		fmt.Printf("Writing miner stats to %s\n", sink.Name())
+	}
+	return nil
+}
+
+// Hand one poll's worth of records to every sink.  Never blocks the poll:
+// if a sink is that far behind, the points go straight to its spool.
+func sendToSinks(records []HostRecord) {
+	if len(sink_runners) == 0 {
+		return
+	}
+	now := time.Now()
+	var points []Point
+	for _, rec := range records {
+		points = append(points, recordPoints(rec, now)...)
+	}
+
+	for _, r := range sink_runners {
+		select {
+		case r.in <- points:
+		default:
+			fmt.Printf("Sink %s: falling behind, spooling %d points\n", r.sink.Name(), len(points))
+			r.spoolPoints(points)
+		}
+	}
+}
+
+// Flush what is queued (spooling what can not be sent) - call before exit.
+func stopSinks() {
+	for _, r := range sink_runners {
+		close(r.in)
+	}
+	for _, r := range sink_runners {
+		<-r.done
+	}
+	sink_runners = nil
+}
+
+var spool_mu sync.Mutex // spool files are written from the poll too (falling behind)
+
+func (r *sinkRunner) run() {
+	defer close(r.done)
+	for points := range r.in {
+		if !r.replaySpool() {
+			r.spoolPoints(points)
+			continue
+		}
+		for len(points) > 0 {
+			n := len(points)
+			if n > sink_batch {
+				n = sink_batch
+			}
+			if !r.write(points[:n]) {
+				r.spoolPoints(points)
+				break
+			}
+			points = points[n:]
+		}
+	}
+}
+
+// Write one batch, trying sink_retries times (1s, 2s, 4s ... apart).
+func (r *sinkRunner) write(batch []Point) bool {
+	wait := time.Second
+	for try := 1; ; try++ {
+		err := r.sink.Write(batch)
+		if err == nil {
+			return true
+		}
+		fmt.Printf("Sink %s: write of %d points failed (try %d of %d): %s\n", r.sink.Name(), len(batch), try, sink_retries, err)
+		if try >= sink_retries {
+			return false
+		}
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+/////////////////////////////////////////////////////////////
+// spoolPoints
+// Append to the spool file, one json point per line.
+/////////////////////////////////////////////////////////////
+func (r *sinkRunner) spoolPoints(points []Point) {
+	spool_mu.Lock()
+	defer spool_mu.Unlock()
+
+	if fi, err := os.Stat(r.spool); err == nil && fi.Size() > sink_spool_max {
+		fmt.Printf("Sink %s: spool %s is full, dropping %d points\n", r.sink.Name(), r.spool, len(points))
+		return
+	}
+
+	f, err := os.OpenFile(r.spool, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		fmt.Printf("Sink %s: can not spool (%s), dropping %d points\n", r.sink.Name(), err, len(points))
+		return
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, p := range points {
+		enc.Encode(p)
+	}
+	if err := w.Flush(); err != nil {
+		fmt.Printf("Sink %s: spool write failed: %s\n", r.sink.Name(), err)
+	}
+}
+
+/////////////////////////////////////////////////////////////
+// replaySpool
+// Send whatever is in the spool, oldest first.  What could not
+// be sent is written back.  True if the spool is now empty.
+/////////////////////////////////////////////////////////////
+func (r *sinkRunner) replaySpool() bool {
+	spool_mu.Lock()
+	data, err := ioutil.ReadFile(r.spool)
+	if err == nil {
+		os.Remove(r.spool)
+	}
+	spool_mu.Unlock()
+	if err != nil || len(data) == 0 {
+		return true
+	}
+
+	var points []Point
+	dec := json.NewDecoder(bytes.NewReader(data))
+	for {
+		var p Point
+		if dec.Decode(&p) != nil {
+			break // end of file, or a line cut short by a crash
+		}
+		points = append(points, p)
+	}
+	if len(points) > 0 {
+		fmt.Printf("Sink %s: sending %d spooled points\n", r.sink.Name(), len(points))
+	}
+
+	for len(points) > 0 {
+		n := len(points)
+		if n > sink_batch {
+			n = sink_batch
+		}
+		if !r.write(points[:n]) {
+			r.spoolPoints(points)
+			return false
+		}
+		points = points[n:]
+	}
+	return true
+}
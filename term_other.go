@@ -0,0 +1,17 @@
+//go:build !linux && !windows && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly
+// +build !linux,!windows,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+func rawTerminal(in *os.File, out *os.File) (func(), error) {
+	return nil, errors.New("no raw terminal mode on this system")
+}
+
+func terminalSize(out *os.File) (int, int) {
+	return 80, 24
+}
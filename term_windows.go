@@ -0,0 +1,70 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// Console modes - the syscall package does not name these.
+const (
+	enableProcessedInput            = 0x0001
+	enableLineInput                 = 0x0002
+	enableEchoInput                 = 0x0004
+	enableVirtualTerminalInput      = 0x0200
+	enableVirtualTerminalProcessing = 0x0004
+)
+
+var kernel32 = syscall.NewLazyDLL("kernel32.dll")
+var procSetConsoleMode = kernel32.NewProc("SetConsoleMode")
+var procGetConsoleScreenBufferInfo = kernel32.NewProc("GetConsoleScreenBufferInfo")
+
+func setConsoleMode(h syscall.Handle, mode uint32) error {
+	if r, _, err := procSetConsoleMode.Call(uintptr(h), uintptr(mode)); r == 0 {
+		return err
+	}
+	return nil
+}
+
+// rawTerminal puts the console in raw mode with vt100 keys and escape codes
+// (Windows 10 and later) and returns the function that puts it back.
+func rawTerminal(in *os.File, out *os.File) (func(), error) {
+	hin, hout := syscall.Handle(in.Fd()), syscall.Handle(out.Fd())
+
+	var oldIn, oldOut uint32
+	if err := syscall.GetConsoleMode(hin, &oldIn); err != nil {
+		return nil, err
+	}
+	if err := syscall.GetConsoleMode(hout, &oldOut); err != nil {
+		return nil, err
+	}
+
+	rawIn := oldIn&^(enableProcessedInput|enableLineInput|enableEchoInput) | enableVirtualTerminalInput
+	if err := setConsoleMode(hin, rawIn); err != nil {
+		return nil, err
+	}
+	if err := setConsoleMode(hout, oldOut|enableVirtualTerminalProcessing); err != nil {
+		setConsoleMode(hin, oldIn)
+		return nil, err
+	}
+
+	return func() {
+		setConsoleMode(hin, oldIn)
+		setConsoleMode(hout, oldOut)
+	}, nil
+}
+
+// terminalSize in columns and rows - 80x24 if the console will not say.
+func terminalSize(out *os.File) (int, int) {
+	var info struct {
+		size, cursor             struct{ x, y int16 }
+		attributes               uint16
+		left, top, right, bottom int16
+		max                      struct{ x, y int16 }
+	}
+	r, _, _ := procGetConsoleScreenBufferInfo.Call(out.Fd(), uintptr(unsafe.Pointer(&info)))
+	if r == 0 {
+		return 80, 24
+	}
+	return int(info.right-info.left) + 1, int(info.bottom-info.top) + 1
+}
@@ -0,0 +1,794 @@
+package main
+
+//
+// horus top:
+// The miners on one screen, refreshed every poll - for a terminal, or a
+// terminal over ssh on a jump box.  Nothing but escape codes: see term_*.go
+// for raw mode on each system.
+//
+// The list:        up/down pgup/pgdn  select        enter   the miner's pools and devices
+//                  s   next sort (hashrate, temp, rejects, hw errors, ip)
+//                  o   reverse the sort             /       filter
+//                  r   restart the miner            q       quit
+// A miner:         tab pools or devices             up/down select
+//                  p   switch to the pool           e d     enable or disable the device
+//                  r   restart the miner            esc     back to the list
+//
+// Everything that changes a miner asks first.  A filter is words that must
+// all match: a CIDR block (10.0.1.0/24), tag:name, model:name, or any text in
+// the ip, model, pool or tags.  Tags come from -tags, one miner per line:
+//
+//	# MAC or IP          tags
+//	b4:10:7b:01:02:03    room2 s9 loaner
+//
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"cgminer-api"
+)
+
+var top_interval time.Duration = 10 * time.Second
+var top_rescan time.Duration = 10 * time.Minute
+var top_sort string = "hashrate"
+var top_filter string = ""
+var top_tags string = ""
+
+var top_sorts = []string{"hashrate", "temp", "rejects", "hw", "ip"}
+
+func topFlags(fs *flag.FlagSet) {
+	fs.DurationVar(&top_interval, "interval", top_interval, "Time between polls of the miners")
+	fs.DurationVar(&top_rescan, "rescan", top_rescan, "Time between scans for new miners")
+	fs.StringVar(&top_sort, "sort", top_sort, "Sort by: "+strings.Join(top_sorts, "|"))
+	fs.StringVar(&top_filter, "filter", top_filter, "Show only the miners that match (CIDR block, tag:name, model:name or text)")
+	fs.StringVar(&top_tags, "tags", top_tags, "File of: MAC or IP, then its tags - for filtering")
+}
+
+// One line of the list.
+type topRow struct {
+	rec     HostRecord
+	model   string
+	mhs5s   float64
+	mhsav   float64
+	temp    float64
+	rejects float64 // percent
+	hw      int64
+	pool    string
+	uptime  int64
+	tags    []string
+	down    bool
+}
+
+type topUI struct {
+	term  *os.File // the real stdout
+	fleet *fleetState
+	tags  map[string][]string
+
+	sortBy  int
+	reverse bool
+	filter  string
+	polled  time.Time
+	all     []topRow
+	rows    []topRow // filtered and sorted
+	sel     int
+	scroll  int
+
+	miner   string // ip - the miner page, "" for the list
+	section int    // on the miner page: 0 pools, 1 devices
+	item    int
+
+	prompt  string // typing a filter
+	input   string
+	confirm string // a y/N question
+	onYes   func() string
+	status  string // the answer to the last thing done
+	log     string // the last line the rest of horus printed
+	results chan string
+}
+
+/////////////////////////////////////////////////////////////
+// cmdTop
+// horus top [-interval 10s] [-sort hashrate] [-filter ...] [-tags file] [targets]
+/////////////////////////////////////////////////////////////
+func cmdTop(args []string) int {
+	if !Test_Cmdline_IP(args) {
+		return 1
+	}
+	if machineOutput() {
+		fmt.Println("Error: top is for a terminal - -output is not supported")
+		return 1
+	}
+	if top_interval <= 0 || top_rescan <= 0 {
+		fmt.Println("Error: -interval and -rescan must be more than zero")
+		return 1
+	}
+	ui := &topUI{filter: top_filter, sortBy: -1, results: make(chan string, 4)}
+	for i, s := range top_sorts {
+		if s == top_sort {
+			ui.sortBy = i
+		}
+	}
+	if ui.sortBy < 0 {
+		fmt.Printf("Error: -sort (%s) must be one of %s\n", top_sort, strings.Join(top_sorts, ", "))
+		return 1
+	}
+	tags, err := loadTags(top_tags)
+	if err != nil {
+		fmt.Printf("Error: -tags (%s): %s\n", top_tags, err)
+		return 1
+	}
+	ui.tags = tags
+
+	restore, err := rawTerminal(os.Stdin, os.Stdout)
+	if err != nil {
+		fmt.Println("Error: top needs a terminal: ", err)
+		return 1
+	}
+	defer restore()
+
+	// Whatever the scans and alerts print goes to the bottom line, not all over the screen.
+	ui.term = os.Stdout
+	logs := make(chan string, 16)
+	if r, w, err := os.Pipe(); err == nil {
+		os.Stdout = w
+		defer func() { os.Stdout = ui.term }()
+		go func() {
+			scanner := bufio.NewScanner(r)
+			for scanner.Scan() {
+				select {
+				case logs <- scanner.Text():
+				default:
+				}
+			}
+		}()
+	}
+
+	fmt.Fprint(ui.term, "\x1b[?1049h\x1b[?25l") // own screen, no cursor
+	defer fmt.Fprint(ui.term, "\x1b[?25h\x1b[?1049l")
+
+	ui.fleet = &fleetState{name: "Top", interval: top_interval, rescan: top_rescan}
+	polls := ui.fleet.subscribe()
+	go ui.fleet.loop(args)
+
+	keys := make(chan string, 16)
+	go readKeys(os.Stdin, keys)
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(stop)
+
+	// Redraw every second anyway - the terminal may have changed size.
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+
+	ui.status = "Looking for miners ..."
+	for {
+		ui.draw()
+		select {
+		case <-stop:
+			return 0
+		case <-polls:
+			ui.refresh()
+		case line := <-logs:
+			ui.log = strings.TrimSpace(line)
+		case msg := <-ui.results:
+			ui.status = msg
+		case <-tick.C:
+		case k := <-keys:
+			if !ui.key(k) {
+				return 0
+			}
+		}
+	}
+}
+
+/////////////////////////////////////////////////////////////
+// readKeys
+// Bytes from the terminal as key names: "up", "enter", "x" ...
+/////////////////////////////////////////////////////////////
+func readKeys(in *os.File, keys chan<- string) {
+	names := map[string]string{
+		"\x1b[A": "up", "\x1b[B": "down", "\x1b[C": "right", "\x1b[D": "left",
+		"\x1bOA": "up", "\x1bOB": "down", "\x1b[5~": "pgup", "\x1b[6~": "pgdn",
+		"\x1b[H": "home", "\x1b[F": "end", "\r": "enter", "\n": "enter", "\t": "tab",
+		"\x1b": "esc", "\x7f": "backspace", "\b": "backspace", "\x03": "ctrl-c",
+	}
+	buf := make([]byte, 64)
+	for {
+		n, err := in.Read(buf)
+		if err != nil {
+			close(keys)
+			return
+		}
+		s := string(buf[:n])
+		for s != "" {
+			// The longest name that matches - so "\x1b[A" is up, not esc then "[A".
+			k, size := "", 1
+			for seq, name := range names {
+				if strings.HasPrefix(s, seq) && len(seq) >= size {
+					k, size = name, len(seq)
+				}
+			}
+			if k == "" {
+				k = s[:1]
+			}
+			keys <- k
+			s = s[size:]
+		}
+	}
+}
+
+// Returns false to quit.
+func (ui *topUI) key(k string) bool {
+	if k == "ctrl-c" || k == "" {
+		return false
+	}
+
+	if ui.confirm != "" {
+		if k == "y" || k == "Y" {
+			do := ui.onYes
+			ui.status = ui.confirm + " ..."
+			go func() { ui.results <- do() }()
+		} else {
+			ui.status = "Nothing done."
+		}
+		ui.confirm, ui.onYes = "", nil
+		return true
+	}
+
+	if ui.prompt != "" {
+		switch k {
+		case "enter":
+			ui.filter = strings.TrimSpace(ui.input)
+			ui.prompt = ""
+			ui.sel, ui.scroll = 0, 0
+			ui.apply()
+		case "esc":
+			ui.prompt = ""
+		case "backspace":
+			if ui.input != "" {
+				ui.input = ui.input[:len(ui.input)-1]
+			}
+		default:
+			if len(k) == 1 && k[0] >= ' ' {
+				ui.input += k
+			}
+		}
+		return true
+	}
+
+	if ui.miner != "" {
+		return ui.minerKey(k)
+	}
+
+	switch k {
+	case "q":
+		return false
+	case "up", "k":
+		ui.sel--
+	case "down", "j":
+		ui.sel++
+	case "pgup":
+		ui.sel -= 10
+	case "pgdn":
+		ui.sel += 10
+	case "home":
+		ui.sel = 0
+	case "end":
+		ui.sel = len(ui.rows) - 1
+	case "s":
+		ui.sortBy = (ui.sortBy + 1) % len(top_sorts)
+		ui.apply()
+	case "o":
+		ui.reverse = !ui.reverse
+		ui.apply()
+	case "/":
+		ui.prompt = "Filter (CIDR, tag:x, model:x or text - empty for all): "
+		ui.input = ui.filter
+	case "enter", "right":
+		if r := ui.selected(); r != nil {
+			ui.miner, ui.section, ui.item = r.rec.Host, 0, 0
+		}
+	case "r":
+		if r := ui.selected(); r != nil {
+			ui.askRestart(r.rec.Host)
+		}
+	}
+	ui.clamp()
+	return true
+}
+
+func (ui *topUI) minerKey(k string) bool {
+	rec := ui.record(ui.miner)
+	switch k {
+	case "q", "esc", "left", "backspace":
+		ui.miner = ""
+	case "tab":
+		ui.section = 1 - ui.section
+		ui.item = 0
+	case "up", "k":
+		ui.item--
+	case "down", "j":
+		ui.item++
+	case "r":
+		ui.askRestart(ui.miner)
+	case "p":
+		if rec != nil && ui.section == 0 && ui.item < len(rec.Pools) {
+			ip, port, pool := ui.miner, apiPort(*rec), rec.Pools[ui.item]
+			ui.ask(fmt.Sprintf("Switch %s to pool %d (%s)?", ip, pool.Pool, pool.URL), func() string {
+				return actionResult(ip, "switchpool", fmt.Sprintf("pool %d", pool.Pool), func() (string, error) {
+					return minerCommand(ip, port, "switchpool", strconv.FormatInt(pool.Pool, 10))
+				})
+			})
+		}
+	case "e", "d":
+		if rec != nil && ui.section == 1 && ui.item < len(rec.Devs) {
+			ip, port, index, dev, enable := ui.miner, apiPort(*rec), ui.item, rec.Devs[ui.item], k == "e"
+			what := map[bool]string{true: "Enable", false: "Disable"}[enable]
+			ui.ask(fmt.Sprintf("%s device %d on %s?", what, index, ip), func() string {
+				return actionResult(ip, strings.ToLower(what), fmt.Sprintf("device %d", index), func() (string, error) {
+					return deviceCommand(ip, port, index, dev, enable)
+				})
+			})
+		}
+	}
+
+	n := 0
+	if rec != nil {
+		n = len(rec.Pools)
+		if ui.section == 1 {
+			n = len(rec.Devs)
+		}
+	}
+	if ui.item >= n {
+		ui.item = n - 1
+	}
+	if ui.item < 0 {
+		ui.item = 0
+	}
+	return true
+}
+
+func (ui *topUI) ask(question string, yes func() string) {
+	ui.confirm, ui.onYes = question, yes
+}
+
+func (ui *topUI) askRestart(ip string) {
+	port := int64(4028)
+	if rec := ui.record(ip); rec != nil {
+		port = apiPort(*rec)
+	}
+	ui.ask(fmt.Sprintf("Restart %s?", ip), func() string {
+		return actionResult(ip, "restart", "", func() (string, error) {
+			return minerCommand(ip, port, "restart", "")
+		})
+	})
+}
+
+// The status line after an action - and the same in the log.
+func actionResult(ip string, action string, detail string, run func() (string, error)) string {
+	msg, err := run()
+	result := "ok"
+	if err != nil {
+		result = "failed: " + err.Error()
+	} else if msg != "" {
+		result = "ok: " + msg
+	}
+	if detail != "" {
+		action += " " + detail
+	}
+	return fmt.Sprintf("%s %s on %s: %s", time.Now().Format("15:04:05"), action, ip, result)
+}
+
+// Enable or disable one device - ascenable, pgaenable or gpuenable, by what the miner has.
+func deviceCommand(ip string, port int64, index int, dev cgminer.Devs, enable bool) (string, error) {
+	c, err := cgminer.New(ip, port).Config()
+	if err != nil {
+		return "", err
+	}
+	kind, id := "gpu", dev.GPU
+	switch {
+	case c.ASCCount > 0:
+		kind, id = "asc", dev.ASC
+	case c.PGACount > 0:
+		kind, id = "pga", int64(index)
+	}
+	verb := "disable"
+	if enable {
+		verb = "enable"
+	}
+	return minerCommand(ip, port, kind+verb, strconv.FormatInt(id, 10))
+}
+
+/////////////////////////////////////////////////////////////
+// The rows
+/////////////////////////////////////////////////////////////
+
+// After every poll.
+func (ui *topUI) refresh() {
+	records, polled, _ := ui.fleet.snapshot()
+	ui.polled = polled
+	ui.all = ui.all[:0]
+	for _, rec := range records {
+		ui.all = append(ui.all, topRowFor(rec, ui.tags))
+	}
+	if ui.status == "Looking for miners ..." {
+		ui.status = ""
+	}
+	ui.apply()
+}
+
+func topRowFor(rec HostRecord, tags map[string][]string) topRow {
+	r := topRow{rec: rec, down: rec.Summary == nil || len(rec.Errors) > 0}
+	if rec.Version != nil {
+		r.model = rec.Version.Type
+	}
+	if r.model == "" {
+		r.model = rec.Dialect
+	}
+	if s := rec.Summary; s != nil {
+		r.mhs5s, r.mhsav, r.hw, r.uptime = s.MHS5s, s.MHSav, s.HardwareErrors, s.Elapsed
+		if shares := s.Accepted + s.Rejected; shares > 0 {
+			r.rejects = 100 * float64(s.Rejected) / float64(shares)
+		}
+	}
+	for _, d := range rec.Devs {
+		if d.Temperature > r.temp {
+			r.temp = d.Temperature
+		}
+	}
+	for _, p := range rec.Pools {
+		if p.StratumActive || (r.pool == "" && p.Status == "Alive") {
+			r.pool = p.URL
+		}
+	}
+	if rec.MAC != "" {
+		r.tags = tags[rec.MAC]
+	}
+	r.tags = append(r.tags, tags[rec.Host]...)
+	return r
+}
+
+// Filter and sort - keeping the same miner selected.
+func (ui *topUI) apply() {
+	keep := ""
+	if r := ui.selected(); r != nil {
+		keep = r.rec.Host
+	}
+
+	ui.rows = ui.rows[:0]
+	for _, r := range ui.all {
+		if topMatch(r, ui.filter) {
+			ui.rows = append(ui.rows, r)
+		}
+	}
+
+	by := top_sorts[ui.sortBy]
+	sort.SliceStable(ui.rows, func(i, j int) bool {
+		a, b := ui.rows[i], ui.rows[j]
+		// Reversed is the same order with the rows swapped - not !less,
+		// which says equal rows go both ways and makes them jump about.
+		if ui.reverse {
+			a, b = b, a
+		}
+		switch by {
+		case "hashrate":
+			return a.mhs5s > b.mhs5s
+		case "temp":
+			return a.temp > b.temp
+		case "rejects":
+			return a.rejects > b.rejects
+		case "hw":
+			return a.hw > b.hw
+		}
+		return ipLess(a.rec.Host, b.rec.Host)
+	})
+
+	for i, r := range ui.rows {
+		if r.rec.Host == keep {
+			ui.sel = i
+		}
+	}
+	ui.clamp()
+}
+
+func ipLess(a, b string) bool {
+	x, y := net.ParseIP(a).To4(), net.ParseIP(b).To4()
+	if x == nil || y == nil {
+		return a < b
+	}
+	for i := range x {
+		if x[i] != y[i] {
+			return x[i] < y[i]
+		}
+	}
+	return false
+}
+
+// Every word must match.
+func topMatch(r topRow, filter string) bool {
+	for _, word := range strings.Fields(strings.ToLower(filter)) {
+		switch {
+		case strings.Contains(word, "/"):
+			_, block, err := net.ParseCIDR(word)
+			if err != nil || !block.Contains(net.ParseIP(r.rec.Host)) {
+				return false
+			}
+		case strings.HasPrefix(word, "tag:"):
+			found := false
+			for _, t := range r.tags {
+				found = found || strings.ToLower(t) == word[4:]
+			}
+			if !found {
+				return false
+			}
+		case strings.HasPrefix(word, "model:"):
+			if !strings.Contains(strings.ToLower(r.model), word[6:]) {
+				return false
+			}
+		default:
+			text := strings.ToLower(strings.Join(append([]string{r.rec.Host, r.model, r.pool}, r.tags...), " "))
+			if !strings.Contains(text, word) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (ui *topUI) selected() *topRow {
+	if ui.sel < 0 || ui.sel >= len(ui.rows) {
+		return nil
+	}
+	return &ui.rows[ui.sel]
+}
+
+func (ui *topUI) record(ip string) *HostRecord {
+	for i := range ui.all {
+		if ui.all[i].rec.Host == ip {
+			return &ui.all[i].rec
+		}
+	}
+	return nil
+}
+
+func (ui *topUI) clamp() {
+	if ui.sel >= len(ui.rows) {
+		ui.sel = len(ui.rows) - 1
+	}
+	if ui.sel < 0 {
+		ui.sel = 0
+	}
+}
+
+func loadTags(path string) (map[string][]string, error) {
+	tags := make(map[string][]string)
+	if path == "" {
+		return tags, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("line %d: want MAC or IP, then tags", n)
+		}
+		key := fields[0]
+		if mac := normalizeMAC(key); mac != "" {
+			key = mac
+		}
+		tags[key] = append(tags[key], fields[1:]...)
+	}
+	return tags, scanner.Err()
+}
+
+/////////////////////////////////////////////////////////////
+// draw
+// The whole screen, every time - it is a few kilobytes.
+/////////////////////////////////////////////////////////////
+func (ui *topUI) draw() {
+	cols, lines := terminalSize(ui.term)
+	var out []string
+
+	var up int
+	var mhs5s, hottest float64
+	for _, r := range ui.all {
+		if !r.down {
+			up++
+		}
+		mhs5s += r.mhs5s
+		if r.temp > hottest {
+			hottest = r.temp
+		}
+	}
+	when := "-"
+	if !ui.polled.IsZero() {
+		when = ui.polled.Format("15:04:05")
+	}
+	head := "horus top  "
+	if site_name != "" {
+		head += site_name + "  "
+	}
+	head += fmt.Sprintf("%d miners (%d up)  %s  hottest %.1f  polled %s  sort %s",
+		len(ui.all), up, formatHashrate(mhs5s), hottest, when, top_sorts[ui.sortBy])
+	if ui.reverse {
+		head += " (reversed)"
+	}
+	if ui.filter != "" {
+		head += "  filter: " + ui.filter
+	}
+	out = append(out, "\x1b[1m"+fit(head, cols)+"\x1b[0m", "")
+
+	body := lines - 5 // heading, blank, column names ... status, keys
+	if ui.miner != "" {
+		out = append(out, ui.drawMiner(cols, body+1)...)
+	} else {
+		out = append(out, ui.drawList(cols, body+1)...)
+	}
+	for len(out) < lines-2 {
+		out = append(out, "")
+	}
+	out = out[:lines-2]
+
+	status := fit(ui.status, cols)
+	switch {
+	case ui.confirm != "":
+		status = "\x1b[1;33m" + fit(ui.confirm+" [y/N]", cols) + "\x1b[0m"
+	case ui.prompt != "":
+		status = fit(ui.prompt+ui.input+"_", cols)
+	case ui.status == "":
+		status = fit(ui.log, cols)
+	}
+	keys := "up/down select  enter miner  s sort  o reverse  / filter  r restart  q quit"
+	if ui.miner != "" {
+		keys = "tab pools/devices  up/down select  p switch pool  e/d enable/disable device  r restart  esc back"
+	}
+	out = append(out, status, "\x1b[7m"+fit(keys, cols)+"\x1b[0m")
+
+	var b strings.Builder
+	b.WriteString("\x1b[H")
+	for i, line := range out {
+		b.WriteString(line)
+		b.WriteString("\x1b[K")
+		if i < len(out)-1 {
+			b.WriteString("\r\n")
+		}
+	}
+	fmt.Fprint(ui.term, b.String())
+}
+
+func (ui *topUI) drawList(cols int, height int) []string {
+	out := []string{fit(fmt.Sprintf("  %-15s %-16s %10s %10s %6s %6s %7s %-9s %s",
+		"IP", "MODEL", "MH/s 5s", "MH/s av", "TEMP", "REJ%", "HW", "UPTIME", "POOL / TAGS"), cols)}
+
+	height--
+	if ui.sel < ui.scroll {
+		ui.scroll = ui.sel
+	}
+	if ui.sel >= ui.scroll+height {
+		ui.scroll = ui.sel - height + 1
+	}
+	if len(ui.rows) == 0 && len(ui.all) > 0 {
+		out = append(out, "  (nothing matches the filter)")
+	}
+	for i := ui.scroll; i < len(ui.rows) && i < ui.scroll+height; i++ {
+		r := ui.rows[i]
+		temp := "-"
+		if r.temp > 0 {
+			temp = fmt.Sprintf("%.1f", r.temp)
+		}
+		pool := r.pool
+		if len(r.tags) > 0 {
+			pool += "  [" + strings.Join(r.tags, " ") + "]"
+		}
+		line := fit(fmt.Sprintf("  %-15s %-16.16s %10.2f %10.2f %6s %6.2f %7d %-9s %s",
+			r.rec.Host, r.model, r.mhs5s, r.mhsav, temp, r.rejects, r.hw, shortDuration(r.uptime), pool), cols)
+		switch {
+		case i == ui.sel:
+			line = "\x1b[7m" + line + "\x1b[0m"
+		case r.down:
+			line = "\x1b[31m" + line + "\x1b[0m"
+		case r.temp >= 90:
+			line = "\x1b[1;31m" + line + "\x1b[0m"
+		case r.temp >= 80:
+			line = "\x1b[33m" + line + "\x1b[0m"
+		}
+		out = append(out, line)
+	}
+	return out
+}
+
+func (ui *topUI) drawMiner(cols int, height int) []string {
+	rec := ui.record(ui.miner)
+	if rec == nil {
+		return []string{ui.miner + " is not in the last poll"}
+	}
+	r := topRowFor(*rec, ui.tags)
+	out := []string{
+		fit(fmt.Sprintf("%s  %s  %s  MAC %s", rec.Host, r.model, rec.Dialect, orDash(rec.MAC)), cols),
+		fit(fmt.Sprintf("%.2f MH/s 5s  %.2f MH/s av  rejects %.2f%%  hw errors %d  up %s  tags %s",
+			r.mhs5s, r.mhsav, r.rejects, r.hw, shortDuration(r.uptime), orDash(strings.Join(r.tags, " "))), cols),
+	}
+	for _, e := range rec.Errors {
+		out = append(out, "\x1b[31m"+fit(e, cols)+"\x1b[0m")
+	}
+
+	mark := func(section int, i int, line string) string {
+		line = fit(line, cols)
+		if section == ui.section && i == ui.item {
+			return "\x1b[7m" + line + "\x1b[0m"
+		}
+		return line
+	}
+
+	out = append(out, "", "\x1b[1mPools\x1b[0m"+map[bool]string{true: "  <", false: ""}[ui.section == 0])
+	out = append(out, fit(fmt.Sprintf("  %4s %-40s %-20s %-8s %8s %8s %7s", "POOL", "URL", "USER", "STATUS", "ACCEPTED", "REJECTED", "ACTIVE"), cols))
+	for i, p := range rec.Pools {
+		active := ""
+		if p.StratumActive {
+			active = "yes"
+		}
+		out = append(out, mark(0, i, fmt.Sprintf("  %4d %-40.40s %-20.20s %-8s %8d %8d %7s", p.Pool, p.URL, p.User, p.Status, p.Accepted, p.Rejected, active)))
+	}
+
+	out = append(out, "", "\x1b[1mDevices\x1b[0m"+map[bool]string{true: "  <", false: ""}[ui.section == 1])
+	out = append(out, fit(fmt.Sprintf("  %4s %-8s %-8s %6s %6s %10s %10s %8s %8s", "DEV", "ENABLED", "STATUS", "TEMP", "FAN", "MH/s 5s", "MH/s av", "REJECTED", "HW"), cols))
+	for i, d := range rec.Devs {
+		out = append(out, mark(1, i, fmt.Sprintf("  %4d %-8s %-8s %6.1f %6d %10.2f %10.2f %8d %8d",
+			i, d.Enabled, d.Status, d.Temperature, d.FanSpeed, d.MHS5s, d.MHSav, d.Rejected, d.HardwareErrors)))
+	}
+
+	if len(out) > height {
+		out = out[:height]
+	}
+	return out
+}
+
+// Cut (or pad) to the width of the screen.
+func fit(s string, cols int) string {
+	if len(s) > cols {
+		return s[:cols]
+	}
+	return s
+}
+
+// 1234.5 MH/s -> "1.23 GH/s"
+func formatHashrate(mhs float64) string {
+	units := []string{"MH/s", "GH/s", "TH/s", "PH/s", "EH/s"}
+	i := 0
+	for mhs >= 1000 && i < len(units)-1 {
+		mhs /= 1000
+		i++
+	}
+	return fmt.Sprintf("%.2f %s", mhs, units[i])
+}
+
+func shortDuration(secs int64) string {
+	switch {
+	case secs <= 0:
+		return "-"
+	case secs >= 86400:
+		return fmt.Sprintf("%dd%dh", secs/86400, secs%86400/3600)
+	case secs >= 3600:
+		return fmt.Sprintf("%dh%dm", secs/3600, secs%3600/60)
+	}
+	return fmt.Sprintf("%dm", secs/60)
+}
@@ -0,0 +1,387 @@
+package main
+
+//
+// horus triage:
+// A health score for every miner found - 100 is nothing wrong, 0 is dead -
+// and the worst of them first, each with why, so whoever walks the floor
+// goes to the right rack first.
+//
+// Points come off for:
+//	hashing below its own average (MHS 5m / 1m / 5s against MHS av - or
+//	  GHS 5s against GHS av on Antminers, which cgminer-api turns into MH/s)
+//	an average below what the model should do (-models, or the table below)
+//	dead or disabled devices (Status not Alive, Enabled N)
+//	dead hash chains, missing or bad chips, a chain running hot (see chains.go)
+//	hardware errors, rejects (Device Hardware%, Device Rejected%)
+//	stale shares (Pool Stale%)
+//	running close to -max-temp
+//	a stopped fan (when the devices report fans at all)
+//	rebooting more than once in the last 24h (from the boots in the inventory)
+//
+// A miner whose api does not answer scores 0.
+//
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var triage_racks string = ""
+var triage_models string = ""
+var triage_max_temp float64 = 85
+var triage_top int = 20
+
+func triageFlags(fs *flag.FlagSet) {
+	fs.StringVar(&triage_racks, "racks", triage_racks, "File of: MAC or IP, rack, position - to say where each miner is")
+	fs.StringVar(&triage_models, "models", triage_models, "File of: model, nominal hashrate (13.5T, 504M ...) - added to the ones horus knows")
+	fs.Float64Var(&triage_max_temp, "max-temp", triage_max_temp, "Hottest a device should run, in C")
+	fs.Float64Var(&chains_max_spread, "max-spread", chains_max_spread, "Most a hash chain may run above the coolest chain of the same miner, in C")
+	fs.IntVar(&triage_top, "top", triage_top, "Show the worst N miners (0: all of them)")
+}
+
+// What each model should hash at, in MH/s.  Longest name that matches wins.
+var nominal_rates = map[string]float64{
+	"Antminer S9":       13.5e6,
+	"Antminer S9i":      14e6,
+	"Antminer S9j":      14.5e6,
+	"Antminer T9+":      10.5e6,
+	"Antminer S17":      56e6,
+	"Antminer S17 Pro":  53e6,
+	"Antminer T17":      40e6,
+	"Antminer S19":      95e6,
+	"Antminer S19 Pro":  110e6,
+	"Antminer S19j Pro": 100e6,
+	"Antminer L3+":      504,
+	"Antminer D3":       19.3e3,
+	"Antminer DR3":      7.8e6,
+	"Antminer DR5":      34e6,
+	"Whatsminer M20S":   68e6,
+	"Whatsminer M30S":   86e6,
+	"AvalonMiner 1246":  90e6,
+}
+
+type healthPenalty struct {
+	points float64
+	reason string
+}
+
+/////////////////////////////////////////////////////////////
+// cmdTriage
+// horus triage [-racks file] [-models file] [-max-temp 85]
+//
+//	[-max-spread 10] [-top 20] [IP OR CIDR_BLOCK ...]
+//
+/////////////////////////////////////////////////////////////
+func cmdTriage(args []string) int {
+	racks, err := loadRacks(triage_racks)
+	if err != nil {
+		fmt.Printf("Error: -racks (%s): %s\n", triage_racks, err)
+		return 1
+	}
+	rates, err := loadNominalRates(triage_models)
+	if err != nil {
+		fmt.Printf("Error: -models (%s): %s\n", triage_models, err)
+		return 1
+	}
+	if triage_top < 0 {
+		fmt.Println("Error: -top can not be negative")
+		return 1
+	}
+
+	m := scanTargets(args)
+	if m == nil {
+		return 1
+	}
+	records := minerRecords(m, detailSet{version: true, summary: true, pools: true, devs: true, stats: true})
+
+	// The scan has just brought the inventory up to date - it has the boots.
+	boots := make(map[string][]time.Time)
+	if inventoryEnabled() {
+		if inv, err := loadInventory(); err == nil {
+			for _, rec := range records {
+				if e := inv.find(rec); e != nil {
+					boots[rec.Host] = e.Boots
+				}
+			}
+		}
+	}
+
+	now := time.Now()
+	for i := range records {
+		rec := &records[i]
+		score, reasons := healthScore(*rec, rates, boots[rec.Host], now)
+		rec.Action = "triage"
+		rec.Score = &score
+		rec.Message = strings.Join(reasons, "; ")
+		switch {
+		case score >= 90:
+			rec.Result = "healthy"
+		case score >= 60:
+			rec.Result = "degraded"
+		default:
+			rec.Result = "bad"
+		}
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		if *records[i].Score != *records[j].Score {
+			return *records[i].Score < *records[j].Score
+		}
+		return ipLess(records[i].Host, records[j].Host)
+	})
+
+	shown := records
+	if triage_top > 0 && len(shown) > triage_top {
+		shown = shown[:triage_top]
+	}
+	if writeRecords(shown) {
+		return 0
+	}
+
+	fmt.Printf("\n%5s  %-15s  %-17s  %-10s  %-18s  %s\n", "SCORE", "IP", "MAC", "WHERE", "MODEL", "WHY")
+	for _, rec := range shown {
+		where := "-"
+		if spot := rackFor(rec, racks); triage_racks != "" && spot.Rack != "" {
+			where = fmt.Sprintf("%s/%d", spot.Rack, spot.Position)
+		}
+		model := "-"
+		if rec.Version != nil && rec.Version.Type != "" {
+			model = rec.Version.Type
+		}
+		fmt.Printf("%5d  %-15s  %-17s  %-10s  %-18s  %s\n", *rec.Score, rec.Host, orDash(rec.MAC), fit(where, 10), fit(model, 18), orDash(rec.Message))
+	}
+
+	counts := make(map[string]int)
+	for _, rec := range records {
+		counts[rec.Result]++
+	}
+	fmt.Printf("\n%d miner(s): %d healthy, %d degraded, %d bad", len(records), counts["healthy"], counts["degraded"], counts["bad"])
+	if len(shown) < len(records) {
+		fmt.Printf(" - the worst %d shown (-top)", len(shown))
+	}
+	fmt.Println(".")
+	return 0
+}
+
+/////////////////////////////////////////////////////////////
+// healthScore
+// 100 less the penalties (never below 0), and the reasons -
+// biggest penalty first.
+/////////////////////////////////////////////////////////////
+func healthScore(rec HostRecord, rates map[string]float64, boots []time.Time, now time.Time) (int, []string) {
+	if rec.Summary == nil {
+		reason := "api not answering"
+		if len(rec.Errors) > 0 {
+			reason += ": " + rec.Errors[0]
+		}
+		return 0, []string{reason}
+	}
+
+	var penalties []healthPenalty
+	penalty := func(points float64, max float64, format string, a ...interface{}) {
+		if points > max {
+			points = max
+		}
+		if points > 0 {
+			penalties = append(penalties, healthPenalty{points, fmt.Sprintf(format, a...)})
+		}
+	}
+	s := rec.Summary
+
+	// Now against its own average - the longest recent figure the miner gives.
+	current := s.MHS5s
+	for _, r := range []float64{s.MHS1m, s.MHS5m} {
+		if r > 0 {
+			current = r
+		}
+	}
+	switch {
+	case s.MHSav > 0 && current == 0:
+		penalty(40, 40, "not hashing")
+	case s.MHSav > 0 && current < 0.9*s.MHSav:
+		ratio := current / s.MHSav
+		penalty((0.9-ratio)*100, 30, "hashing at %.0f%% of its average (%s)", ratio*100, formatHashrate(current))
+	}
+
+	if rec.Version != nil {
+		if model, nominal := nominalRate(rec.Version.Type, rates); nominal > 0 && s.MHSav > 0 && s.MHSav < 0.9*nominal {
+			ratio := s.MHSav / nominal
+			penalty((0.9-ratio)*100, 25, "average %s is %.0f%% of the %s's %s", formatHashrate(s.MHSav), ratio*100, model, formatHashrate(nominal))
+		}
+	}
+
+	var dead []string
+	hottest, worstHW, worstRej := 0.0, 0.0, 0.0
+	hwDev, rejDev := int64(0), int64(0)
+	fans, stopped := false, 0
+	for _, d := range rec.Devs {
+		if d.Status != "Alive" || d.Enabled == "N" {
+			state := d.Status
+			if d.Enabled == "N" {
+				state += ", disabled"
+			}
+			dead = append(dead, fmt.Sprintf("%d (%s)", d.ID, state))
+		}
+		if d.Temperature > hottest {
+			hottest = d.Temperature
+		}
+		if d.DeviceHardwarePCT > worstHW {
+			worstHW, hwDev = d.DeviceHardwarePCT, d.ID
+		}
+		if d.DeviceRejectedPCT > worstRej {
+			worstRej, rejDev = d.DeviceRejectedPCT, d.ID
+		}
+		if d.FanSpeed > 0 || d.FanPercent > 0 {
+			fans = true
+		} else {
+			stopped++
+		}
+	}
+	if len(dead) > 0 {
+		penalty(40*float64(len(dead))/float64(len(rec.Devs))+15, 50, "%d of %d devices down: %s", len(dead), len(rec.Devs), strings.Join(dead, ", "))
+	}
+
+	deadChains, chips := 0, 0
+	hotChain := ChainStat{}
+	for _, c := range rec.Chains {
+		if c.Dead {
+			deadChains++
+			continue
+		}
+		chips += c.Missing + c.Bad
+		if c.TempDelta > hotChain.TempDelta {
+			hotChain = c
+		}
+	}
+	if deadChains > 0 {
+		penalty(40*float64(deadChains)/float64(len(rec.Chains))+15, 50, "%d of %d chains dead", deadChains, len(rec.Chains))
+	}
+	if chips > 0 {
+		penalty(float64(chips), 15, "%d chip(s) missing or bad", chips)
+	}
+	if hotChain.TempDelta > chains_max_spread {
+		penalty(hotChain.TempDelta-chains_max_spread, 10, "chain %d %.0fC above the coolest chain", hotChain.Chain, hotChain.TempDelta)
+	}
+
+	if worstHW > 1 {
+		penalty(worstHW*3, 15, "hardware errors %.1f%% on device %d", worstHW, hwDev)
+	}
+	if worstRej > 2 {
+		penalty(worstRej*2, 10, "rejects %.1f%% on device %d", worstRej, rejDev)
+	}
+	if s.PoolStalePercentage > 2 {
+		penalty(s.PoolStalePercentage*2, 10, "stale shares %.1f%%", s.PoolStalePercentage)
+	}
+
+	if margin := triage_max_temp - hottest; hottest > 0 && margin < 10 {
+		if margin <= 0 {
+			penalty(25, 25, "%.0fC - over the %.0fC limit", hottest, triage_max_temp)
+		} else {
+			penalty((10-margin)*2.5, 25, "%.0fC - %.0fC below the %.0fC limit", hottest, margin, triage_max_temp)
+		}
+	}
+	// Antminers report their fans in stats, not devs - only trust devs that report any fans.
+	if fans && stopped > 0 {
+		penalty(20, 20, "%d device(s) with a stopped fan", stopped)
+	}
+
+	recent := 0
+	for _, b := range boots {
+		if now.Sub(b) < 24*time.Hour {
+			recent++
+		}
+	}
+	if recent >= 2 {
+		penalty(float64(recent)*5, 20, "rebooted %d times in 24h", recent)
+	}
+
+	sort.SliceStable(penalties, func(i, j int) bool { return penalties[i].points > penalties[j].points })
+	score := 100.0
+	var reasons []string
+	for _, p := range penalties {
+		score -= p.points
+		reasons = append(reasons, p.reason)
+	}
+	if score < 0 {
+		score = 0
+	}
+	return int(score + 0.5), reasons
+}
+
+// The longest known model name in the miner's model - "Antminer S9j" before "Antminer S9".
+func nominalRate(model string, rates map[string]float64) (string, float64) {
+	best, rate := "", 0.0
+	lower := strings.ToLower(model)
+	for name, r := range rates {
+		if strings.Contains(lower, strings.ToLower(name)) && len(name) > len(best) {
+			best, rate = name, r
+		}
+	}
+	return best, rate
+}
+
+/////////////////////////////////////////////////////////////
+// loadNominalRates
+// horus's table plus -models: "model name  rate" - the rate
+// last, in MH/s or with a unit (504M, 19.3G, 13.5T, 1.2P).
+/////////////////////////////////////////////////////////////
+func loadNominalRates(path string) (map[string]float64, error) {
+	rates := make(map[string]float64)
+	for name, r := range nominal_rates {
+		rates[name] = r
+	}
+	if path == "" {
+		return rates, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("line %d: want: model rate", n)
+		}
+		rate, err := parseHashrate(fields[len(fields)-1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", n, err)
+		}
+		rates[strings.Join(fields[:len(fields)-1], " ")] = rate
+	}
+	return rates, scanner.Err()
+}
+
+// "13.5T", "504M", "19.3GH/s" or plain MH/s.
+func parseHashrate(s string) (float64, error) {
+	text := strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(s), "/S"), "H")
+	scale := 1.0
+	if n := len(text); n > 0 {
+		switch text[n-1] {
+		case 'M':
+			text = text[:n-1]
+		case 'G':
+			scale, text = 1e3, text[:n-1]
+		case 'T':
+			scale, text = 1e6, text[:n-1]
+		case 'P':
+			scale, text = 1e9, text[:n-1]
+		}
+	}
+	v, err := strconv.ParseFloat(text, 64)
+	if err != nil || v <= 0 {
+		return 0, fmt.Errorf("%s is not a hashrate (13.5T, 504M ...)", s)
+	}
+	return v * scale, nil
+}
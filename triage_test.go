@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A miner api on a local port that answers version and summary the way
+// bmminer does on an Antminer: GH/s, often as strings with commas.
+func bmminerStub(t *testing.T, model string, ghs5s string, ghsAv string) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	replies := map[string]string{
+		"version": fmt.Sprintf(`{"STATUS":[{"STATUS":"S","When":1700000000,"Code":22,"Msg":"CGMiner versions","Description":"cgminer 4.9.0"}],`+
+			`"VERSION":[{"CGMiner":"4.9.0","API":"3.1","Miner":"uart_trans.1.3","CompileTime":"Tue Jul 21 2020","Type":"%s"}],"id":1}`, model),
+		"summary": fmt.Sprintf(`{"STATUS":[{"STATUS":"S","When":1700000000,"Code":11,"Msg":"Summary","Description":"cgminer 4.9.0"}],`+
+			`"SUMMARY":[{"Elapsed":86400,"GHS 5s":%s,"GHS av":%s,"Found Blocks":0,"Getworks":5000,"Accepted":40000,"Rejected":20,`+
+			`"Hardware Errors":50,"Utility":27.7,"Discarded":10000,"Stale":0,"Get Failures":0,"Local Work":1000000,"Remote Failures":0,`+
+			`"Network Blocks":150,"Total MH":8.2e12,"Work Utility":1.3e6,"Difficulty Accepted":1.6e9,"Difficulty Rejected":8e5,`+
+			`"Difficulty Stale":0,"Best Share":2.1e8,"Device Hardware%%":0.0001,"Device Rejected%%":0.05,"Pool Rejected%%":0.05,`+
+			`"Pool Stale%%":0,"Last getwork":1700000000}],"id":1}`, ghs5s, ghsAv),
+	}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			buf := make([]byte, 1024)
+			n, _ := conn.Read(buf)
+			reply := `{"STATUS":[{"STATUS":"E","Code":14,"Msg":"Invalid command"}],"id":1}`
+			for command, r := range replies {
+				if strings.Contains(string(buf[:n]), `"`+command+`"`) {
+					reply = r
+				}
+			}
+			conn.Write(append([]byte(reply), 0))
+			conn.Close()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestHealthScoreBMMiner(t *testing.T) {
+	tests := []struct {
+		name   string
+		model  string
+		ghs5s  string
+		ghsAv  string
+		score  int
+		reason string
+	}{
+		{"healthy s19", "Antminer S19", `"95,120.50"`, `95000.12`, 100, ""},
+		{"half the chains gone", "Antminer S19", `"47,500.00"`, `"94,800.00"`, 70, "hashing at 50% of its average"},
+		{"slow since boot", "Antminer S19", `60000`, `"60,000"`, 75, "63% of the Antminer S19's"},
+		{"not hashing", "Antminer S19 Pro", `"0.00"`, `"109,000.00"`, 60, "not hashing"},
+		{"s9 numbers", "Antminer S9", `13520.45`, `13480.10`, 100, ""},
+	}
+	for _, tt := range tests {
+		ip, port, _ := net.SplitHostPort(bmminerStub(t, tt.model, tt.ghs5s, tt.ghsAv))
+		rec := newRecord(ip)
+		rec.Services = []Service{{Port: port, Profile: "cgminer", Detail: "cgminer 4.9.0 " + tt.model}}
+		addDetails(&rec, detailSet{version: true, summary: true})
+		if len(rec.Errors) > 0 {
+			t.Fatalf("%s: %v", tt.name, rec.Errors)
+		}
+
+		score, reasons := healthScore(rec, nominal_rates, nil, time.Now())
+		if score != tt.score {
+			t.Errorf("%s: score %d, want %d (%q)", tt.name, score, tt.score, reasons)
+		}
+		why := strings.Join(reasons, "; ")
+		if tt.reason == "" && why != "" || !strings.Contains(why, tt.reason) {
+			t.Errorf("%s: reasons %q, want %q", tt.name, why, tt.reason)
+		}
+	}
+}
@@ -0,0 +1,365 @@
+package main
+
+//
+// Wallet addresses in pool workers:
+// Most pools are told where to pay by the worker name - the wallet address,
+// then a dot and the name of the miner.  A typo there and the hashrate is
+// paid to nobody, so horus checks every worker it is about to send (do
+// addpool, the api's addpool, pools plan / apply) and every worker audit
+// finds:
+//
+//	btc   1... 3... bc1...        base58check (double sha256), bech32 / bech32m
+//	ltc   L... M... ltc1...
+//	dcr   Ds.. Dc.. Dk.. De.. DS.. base58 with a double blake256 checksum
+//
+// and tbtc, tltc, tdcr for the test networks.  A worker that does not start
+// with something that looks like one of these (an account name at the pool)
+// is left alone.  -wallet-coins says which coins are expected - a good
+// address for any other coin is flagged too.
+//
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"math/bits"
+	"strings"
+)
+
+var wallet_coins string = "btc,ltc,dcr"
+
+const base58_alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+const bech32_charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+// bech32 human readable part -> coin
+var bech32_coins = map[string]string{"bc": "btc", "tb": "tbtc", "ltc": "ltc", "tltc": "tltc"}
+
+// base58check version byte -> coin
+var base58_versions = map[byte]string{0x00: "btc", 0x05: "btc", 0x30: "ltc", 0x32: "ltc", 0x6f: "tbtc", 0xc4: "tbtc"}
+
+// Decred network id (first two letters) -> coin
+var decred_prefixes = map[string]string{
+	"Dk": "dcr", "Ds": "dcr", "De": "dcr", "DS": "dcr", "Dc": "dcr",
+	"Tk": "tdcr", "Ts": "tdcr", "Te": "tdcr", "TS": "tdcr", "Tc": "tdcr",
+}
+
+/////////////////////////////////////////////////////////////
+// checkPoolUser
+// nil when the worker is fine, or does not start with a
+// wallet address at all.
+/////////////////////////////////////////////////////////////
+func checkPoolUser(user string) error {
+	addr, coin, err := walletAddress(user)
+	if err != nil {
+		return err
+	}
+	if addr != "" && !walletCoinExpected(coin) {
+		return fmt.Errorf("%s is a %s address - -wallet-coins is %s", addr, coin, wallet_coins)
+	}
+	return nil
+}
+
+func walletCoinExpected(coin string) bool {
+	for _, c := range strings.Split(wallet_coins, ",") {
+		if strings.EqualFold(strings.TrimSpace(c), coin) {
+			return true
+		}
+	}
+	return false
+}
+
+func checkWalletCoins() error {
+	known := map[string]bool{"btc": true, "ltc": true, "dcr": true, "tbtc": true, "tltc": true, "tdcr": true}
+	for _, c := range strings.Split(wallet_coins, ",") {
+		if c = strings.ToLower(strings.TrimSpace(c)); c != "" && !known[c] {
+			return fmt.Errorf("-wallet-coins: %s? - btc, ltc, dcr, tbtc, tltc or tdcr", c)
+		}
+	}
+	return nil
+}
+
+/////////////////////////////////////////////////////////////
+// walletAddress
+// The address at the front of a worker ("addr.rig1"), the coin
+// it is for, and what is wrong with it.  addr is "" when the
+// worker does not look like it starts with an address.
+/////////////////////////////////////////////////////////////
+func walletAddress(user string) (string, string, error) {
+	addr := user
+	if i := strings.IndexAny(user, "._+/:"); i >= 0 {
+		addr = user[:i]
+	}
+
+	lower := strings.ToLower(addr)
+	for hrp, coin := range bech32_coins {
+		if strings.HasPrefix(lower, hrp+"1") && len(addr) >= 14 && len(addr) <= 90 {
+			if err := checkSegwit(addr, hrp); err != nil {
+				return addr, coin, fmt.Errorf("%s is not a %s address: %s", addr, coin, err)
+			}
+			return addr, coin, nil
+		}
+	}
+
+	if len(addr) < 25 || len(addr) > 36 || strings.Trim(addr, base58_alphabet) != "" {
+		return "", "", nil
+	}
+	if coin, ok := decred_prefixes[addr[:2]]; ok {
+		if err := checkDecred(addr); err != nil {
+			return addr, coin, fmt.Errorf("%s is not a %s address: %s", addr, coin, err)
+		}
+		return addr, coin, nil
+	}
+	switch addr[0] {
+	case '1', '3', 'L', 'M', 'm', 'n', '2':
+		coin, err := checkBase58(addr)
+		if err != nil {
+			return addr, coin, fmt.Errorf("%s is not a valid address: %s", addr, err)
+		}
+		return addr, coin, nil
+	}
+	return "", "", nil
+}
+
+func base58Decode(s string) ([]byte, error) {
+	n := new(big.Int)
+	for _, r := range s {
+		i := strings.IndexRune(base58_alphabet, r)
+		if i < 0 {
+			return nil, fmt.Errorf("%c is not base58", r)
+		}
+		n.Mul(n, big.NewInt(58))
+		n.Add(n, big.NewInt(int64(i)))
+	}
+	out := n.Bytes()
+	// Each leading 1 is a zero byte.
+	for i := 0; i < len(s) && s[i] == '1'; i++ {
+		out = append([]byte{0}, out...)
+	}
+	return out, nil
+}
+
+// Bitcoin style: version byte, 20 byte hash, first 4 bytes of sha256(sha256(those)).
+func checkBase58(addr string) (string, error) {
+	b, err := base58Decode(addr)
+	if err != nil {
+		return "", err
+	}
+	if len(b) != 25 {
+		return "", fmt.Errorf("%d bytes, want 25", len(b))
+	}
+	first := sha256.Sum256(b[:21])
+	sum := sha256.Sum256(first[:])
+	if string(sum[:4]) != string(b[21:]) {
+		return "", fmt.Errorf("bad checksum (a typo?)")
+	}
+	coin, ok := base58_versions[b[0]]
+	if !ok {
+		return "", fmt.Errorf("unknown version byte %#02x", b[0])
+	}
+	return coin, nil
+}
+
+// Decred: 2 byte network id, 20 byte hash, first 4 bytes of blake256(blake256(those)).
+func checkDecred(addr string) error {
+	b, err := base58Decode(addr)
+	if err != nil {
+		return err
+	}
+	if len(b) != 26 {
+		return fmt.Errorf("%d bytes, want 26", len(b))
+	}
+	first := blake256(b[:22])
+	sum := blake256(first[:])
+	if string(sum[:4]) != string(b[22:]) {
+		return fmt.Errorf("bad checksum (a typo?)")
+	}
+	return nil
+}
+
+/////////////////////////////////////////////////////////////
+// checkSegwit
+// bech32 (witness version 0) or bech32m (1 and up) - BIP 173
+// and BIP 350.
+/////////////////////////////////////////////////////////////
+func checkSegwit(addr string, hrp string) error {
+	if addr != strings.ToLower(addr) && addr != strings.ToUpper(addr) {
+		return fmt.Errorf("mixed case")
+	}
+	addr = strings.ToLower(addr)
+	sep := strings.LastIndex(addr, "1")
+	if sep != len(hrp) || len(addr)-sep-1 < 7 {
+		return fmt.Errorf("too short")
+	}
+
+	var data []int
+	for _, r := range addr[sep+1:] {
+		i := strings.IndexRune(bech32_charset, r)
+		if i < 0 {
+			return fmt.Errorf("%c is not bech32", r)
+		}
+		data = append(data, i)
+	}
+
+	values := bech32ExpandHRP(hrp)
+	values = append(values, data...)
+	check := bech32Polymod(values)
+	version := data[0]
+	switch {
+	case version == 0 && check != 1:
+		return fmt.Errorf("bad checksum (a typo?)")
+	case version > 0 && check != 0x2bc830a3:
+		return fmt.Errorf("bad checksum (a typo?)")
+	case version > 16:
+		return fmt.Errorf("witness version %d", version)
+	}
+
+	// The program: the 5 bit groups (less the version and checksum) as bytes.
+	acc, nbits, length := 0, 0, 0
+	for _, v := range data[1 : len(data)-6] {
+		acc = acc<<5 | v
+		nbits += 5
+		for nbits >= 8 {
+			nbits -= 8
+			length++
+		}
+		acc &= (1 << uint(nbits)) - 1
+	}
+	if nbits >= 5 || acc != 0 {
+		return fmt.Errorf("bad padding")
+	}
+	if length < 2 || length > 40 || (version == 0 && length != 20 && length != 32) {
+		return fmt.Errorf("%d byte witness program", length)
+	}
+	return nil
+}
+
+func bech32ExpandHRP(hrp string) []int {
+	var out []int
+	for _, c := range hrp {
+		out = append(out, int(c)>>5)
+	}
+	out = append(out, 0)
+	for _, c := range hrp {
+		out = append(out, int(c)&31)
+	}
+	return out
+}
+
+func bech32Polymod(values []int) int {
+	gen := []int{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+	chk := 1
+	for _, v := range values {
+		top := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ v
+		for i := 0; i < 5; i++ {
+			if (top>>uint(i))&1 == 1 {
+				chk ^= gen[i]
+			}
+		}
+	}
+	return chk
+}
+
+/////////////////////////////////////////////////////////////
+// blake256
+// BLAKE-256 (14 rounds, no salt) - the hash Decred uses.  Not
+// in the standard library, and only needed for checksums.
+/////////////////////////////////////////////////////////////
+var blake256_iv = [8]uint32{
+	0x6a09e667, 0xbb67ae85, 0x3c6ef372, 0xa54ff53a, 0x510e527f, 0x9b05688c, 0x1f83d9ab, 0x5be0cd19,
+}
+
+var blake256_c = [16]uint32{
+	0x243f6a88, 0x85a308d3, 0x13198a2e, 0x03707344, 0xa4093822, 0x299f31d0, 0x082efa98, 0xec4e6c89,
+	0x452821e6, 0x38d01377, 0xbe5466cf, 0x34e90c6c, 0xc0ac29b7, 0xc97c50dd, 0x3f84d5b5, 0xb5470917,
+}
+
+var blake256_sigma = [10][16]int{
+	{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15},
+	{14, 10, 4, 8, 9, 15, 13, 6, 1, 12, 0, 2, 11, 7, 5, 3},
+	{11, 8, 12, 0, 5, 2, 15, 13, 10, 14, 3, 6, 7, 1, 9, 4},
+	{7, 9, 3, 1, 13, 12, 11, 14, 2, 6, 5, 10, 4, 0, 15, 8},
+	{9, 0, 5, 7, 2, 4, 10, 15, 14, 1, 11, 12, 6, 8, 3, 13},
+	{2, 12, 6, 10, 0, 11, 8, 3, 4, 13, 7, 5, 15, 14, 1, 9},
+	{12, 5, 1, 15, 14, 13, 4, 10, 0, 7, 6, 3, 9, 2, 8, 11},
+	{13, 11, 7, 14, 12, 1, 3, 9, 5, 0, 15, 4, 8, 6, 2, 10},
+	{6, 15, 14, 9, 11, 3, 0, 8, 12, 2, 13, 7, 1, 4, 10, 5},
+	{10, 2, 8, 4, 7, 6, 1, 5, 15, 11, 9, 14, 3, 12, 13, 0},
+}
+
+func blake256(msg []byte) [32]byte {
+	h := blake256_iv
+	bitlen := uint64(len(msg)) * 8
+
+	// Pad: a 1 bit, zeros, a 1 bit, then the length - to a whole number of blocks.
+	padded := append([]byte(nil), msg...)
+	padded = append(padded, 0x80)
+	for len(padded)%64 != 56 {
+		padded = append(padded, 0)
+	}
+	padded[len(padded)-1] |= 0x01
+	var length [8]byte
+	binary.BigEndian.PutUint64(length[:], bitlen)
+	padded = append(padded, length[:]...)
+
+	for off := 0; off < len(padded); off += 64 {
+		// The counter is the message bits up to the end of this block - 0
+		// for a block that is all padding.
+		counter := uint64(off+64) * 8
+		if counter > bitlen {
+			counter = bitlen
+		}
+		if uint64(off)*8 >= bitlen {
+			counter = 0
+		}
+		blake256Block(&h, padded[off:off+64], counter)
+	}
+
+	var out [32]byte
+	for i, v := range h {
+		binary.BigEndian.PutUint32(out[i*4:], v)
+	}
+	return out
+}
+
+func blake256Block(h *[8]uint32, block []byte, counter uint64) {
+	var m [16]uint32
+	for i := range m {
+		m[i] = binary.BigEndian.Uint32(block[i*4:])
+	}
+
+	var v [16]uint32
+	copy(v[:8], h[:])
+	copy(v[8:], blake256_c[:8])
+	v[12] ^= uint32(counter)
+	v[13] ^= uint32(counter)
+	v[14] ^= uint32(counter >> 32)
+	v[15] ^= uint32(counter >> 32)
+
+	g := func(s *[16]int, i int, a, b, c, d int) {
+		v[a] += v[b] + (m[s[2*i]] ^ blake256_c[s[2*i+1]])
+		v[d] = bits.RotateLeft32(v[d]^v[a], -16)
+		v[c] += v[d]
+		v[b] = bits.RotateLeft32(v[b]^v[c], -12)
+		v[a] += v[b] + (m[s[2*i+1]] ^ blake256_c[s[2*i]])
+		v[d] = bits.RotateLeft32(v[d]^v[a], -8)
+		v[c] += v[d]
+		v[b] = bits.RotateLeft32(v[b]^v[c], -7)
+	}
+	for r := 0; r < 14; r++ {
+		s := &blake256_sigma[r%10]
+		g(s, 0, 0, 4, 8, 12)
+		g(s, 1, 1, 5, 9, 13)
+		g(s, 2, 2, 6, 10, 14)
+		g(s, 3, 3, 7, 11, 15)
+		g(s, 4, 0, 5, 10, 15)
+		g(s, 5, 1, 6, 11, 12)
+		g(s, 6, 2, 7, 8, 13)
+		g(s, 7, 3, 4, 9, 14)
+	}
+
+	for i := range h {
+		h[i] ^= v[i] ^ v[i+8]
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+//
+// horus watch:
+// Scan and poll the miners every -interval and say what changed:
+//
+//	appeared       a miner we did not have before (every miner, the first time)
+//	disappeared    not found for -missed scans in a row
+//	ip-changed     same MAC, new address (DHCP)
+//	pool-changed   the pool list (urls, in priority order) is not what it was
+//	rebooted       Summary.Elapsed went backwards
+//	device-down    a device that was Alive is not (or is not Alive when first seen)
+//	device-up      ... and is Alive again
+//
+// With -rules, alerts starting to fire or being resolved are events too.
+//
+// Table output prints one line per event.  The other -output formats write
+// each event as a HostRecord with "event" set - one batch per scan.
+//
+// Runs until SIGINT / SIGTERM, and talks to systemd (see sdnotify.go).
+//
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"cgminer-api"
+)
+
+var watch_interval time.Duration = 60 * time.Second
+var watch_missed int = 2
+
+func watchFlags(fs *flag.FlagSet) {
+	fs.DurationVar(&watch_interval, "interval", watch_interval, "Time between scans")
+	fs.IntVar(&watch_missed, "missed", watch_missed, "Scans a miner must be missing from before it has disappeared")
+}
+
+// What we remember about a miner between scans.
+type watchedMiner struct {
+	rec     HostRecord
+	pools   string   // urls in priority order
+	devices []string // status of each device
+	missed  int      // scans in a row we did not find it
+	gone    bool     // disappeared already reported
+}
+
+type watchState struct {
+	miners map[string]*watchedMiner // by MAC, or "ip:" + address
+}
+
+/////////////////////////////////////////////////////////////
+// cmdWatch
+// horus watch [-interval 60s] [-missed 2] [IP OR CIDR_BLOCK ...]
+/////////////////////////////////////////////////////////////
+func cmdWatch(args []string) int {
+	if !Test_Cmdline_IP(args) {
+		return 1
+	}
+	if watch_interval <= 0 || watch_missed < 1 {
+		fmt.Println("Error: -interval and -missed must be more than zero")
+		return 1
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+
+	var watchdog <-chan time.Time
+	if every := sdWatchdogInterval(); every > 0 {
+		ticker := time.NewTicker(every)
+		defer ticker.Stop()
+		watchdog = ticker.C
+	}
+
+	state := &watchState{miners: make(map[string]*watchedMiner)}
+	first := true
+
+	for {
+		// The scan runs on its own so a signal (or the watchdog) is not held up by it.
+		fmt.Printf("\n%s Scanning ...\n", time.Now().Format("Mon Jan 02 2006 at 15:04:05"))
+		done := make(chan []HostRecord, 1)
+		go func() {
+			done <- watchPoll(args)
+		}()
+
+		// Ping the watchdog only while the scan and the poll get somewhere -
+		// a hung scan must let systemd's WatchdogSec run out.
+		var records []HostRecord
+		seen := sdProgressCount()
+	scanning:
+		for {
+			select {
+			case records = <-done:
+				break scanning
+			case <-watchdog:
+				if now := sdProgressCount(); now != seen {
+					seen = now
+					sdNotify("WATCHDOG=1")
+				}
+			case sig := <-stop:
+				return stopWatch(sig)
+			}
+		}
+
+		now := time.Now()
+		events := state.update(records, now)
+		events = append(events, checkPoolGuard(records, now)...)
+		events = append(events, checkAlerts(records, now)...)
+		reportEvents(events)
+		notifyEvents(events)
+		sendToSinks(records)
+
+		status := fmt.Sprintf("STATUS=%d miner(s), %d event(s) at %s", len(records), len(events), time.Now().Format("15:04:05"))
+		if first {
+			sdNotify("READY=1\n" + status)
+			first = false
+		} else {
+			sdNotify(status)
+		}
+		if watchdog != nil {
+			sdNotify("WATCHDOG=1") // a whole poll done
+		}
+
+		next := time.After(watch_interval)
+	waiting:
+		for {
+			select {
+			case <-next:
+				break waiting
+			case <-watchdog:
+				sdNotify("WATCHDOG=1")
+			case sig := <-stop:
+				return stopWatch(sig)
+			}
+		}
+	}
+}
+
+func stopWatch(sig os.Signal) int {
+	sdNotify("STOPPING=1")
+	fmt.Printf("\nStopped (%s).\n", sig)
+	return 0
+}
+
+// One scan, then ask every miner found for its details.
+func watchPoll(targets []string) []HostRecord {
+	m := scanNetwork(targets)
+	fmt.Printf("Miners found: %d %v\n", len(m.AvailableIPs), m.AvailableIPs)
+
+	records := minerRecords(m, detailSet{})
+	pollRecords(records, detailSet{version: true, summary: true, pools: true, devs: true, stats: true})
+	return records
+}
+
+func watchKey(rec HostRecord) string {
+	if rec.MAC != "" {
+		return rec.MAC
+	}
+	return "ip:" + rec.Host
+}
+
+/////////////////////////////////////////////////////////////
+// update
+// Compare this scan with what we knew, return the events.
+/////////////////////////////////////////////////////////////
+func (s *watchState) update(records []HostRecord, now time.Time) []HostRecord {
+	var events []HostRecord
+	event := func(rec HostRecord, name string, previous string, detail string) {
+		ev := rec
+		ev.Time = now.Format(time.RFC3339)
+		ev.Event = name
+		ev.Previous = previous
+		ev.EventDetail = detail
+		events = append(events, ev)
+	}
+
+	seen := make(map[string]bool)
+	for _, rec := range records {
+		key := watchKey(rec)
+		seen[key] = true
+
+		cur := &watchedMiner{rec: rec, pools: poolURLs(rec), devices: deviceStates(rec)}
+		old, known := s.miners[key]
+		s.miners[key] = cur
+
+		if !known || old.gone {
+			event(rec, "appeared", "", "")
+			for i, st := range cur.devices {
+				if st != "Alive" {
+					event(rec, "device-down", "", fmt.Sprintf("device %d: %s", i, st))
+				}
+			}
+			continue
+		}
+
+		if old.rec.Host != rec.Host {
+			event(rec, "ip-changed", old.rec.Host, rec.Host)
+		}
+
+		// A miner that did not answer a command this time is not a change.
+		if rec.Pools != nil && old.rec.Pools != nil && old.pools != cur.pools {
+			event(rec, "pool-changed", old.pools, cur.pools)
+		}
+		if rec.Summary != nil && old.rec.Summary != nil && rec.Summary.Elapsed < old.rec.Summary.Elapsed {
+			event(rec, "rebooted", fmt.Sprintf("up %ds", old.rec.Summary.Elapsed), fmt.Sprintf("up %ds", rec.Summary.Elapsed))
+		}
+
+		if rec.Devs == nil {
+			cur.devices = old.devices
+			continue
+		}
+		for i, st := range cur.devices {
+			was := "Alive"
+			if i < len(old.devices) {
+				was = old.devices[i]
+			}
+			switch {
+			case was == "Alive" && st != "Alive":
+				event(rec, "device-down", was, fmt.Sprintf("device %d: %s", i, st))
+			case was != "Alive" && st == "Alive":
+				event(rec, "device-up", was, fmt.Sprintf("device %d: %s", i, st))
+			}
+		}
+	}
+
+	for key, old := range s.miners {
+		if seen[key] || old.gone {
+			continue
+		}
+		old.missed++
+		if old.missed >= watch_missed {
+			old.gone = true
+			event(old.rec, "disappeared", old.rec.Host, fmt.Sprintf("missing from %d scans", old.missed))
+		}
+	}
+	return events
+}
+
+func poolURLs(rec HostRecord) string {
+	// Pools come back in POOL order - we want priority order.
+	pools := append([]cgminer.Pool(nil), rec.Pools...)
+	sort.SliceStable(pools, func(i, j int) bool { return pools[i].Priority < pools[j].Priority })
+
+	urls := make([]string, len(pools))
+	for i, p := range pools {
+		urls[i] = p.URL
+	}
+	return strings.Join(urls, " ")
+}
+
+func deviceStates(rec HostRecord) []string {
+	states := make([]string, len(rec.Devs))
+	for i, d := range rec.Devs {
+		states[i] = d.Status
+	}
+	return states
+}
+
+// One line per event for the table output, a batch of records for the rest.
+func reportEvents(events []HostRecord) {
+	if len(events) == 0 {
+		fmt.Println("No changes.")
+		return
+	}
+	if writeRecords(events) {
+		return
+	}
+	for _, ev := range events {
+		if ev.Alert != nil {
+			fmt.Println(alertLine(ev.Alert))
+			continue
+		}
+		fmt.Println(eventLine(ev))
+	}
+}
+
+func eventLine(ev HostRecord) string {
+	line := fmt.Sprintf("%s %-12s %-15s %s", time.Now().Format("15:04:05"), ev.Event, ev.Host, ev.MAC)
+	if ev.Previous != "" || ev.EventDetail != "" {
+		line += fmt.Sprintf("  %s -> %s", orDash(ev.Previous), orDash(ev.EventDetail))
+	}
+	return line
+}
@@ -0,0 +1,227 @@
+// Horus dashboard - no build step, no libraries.
+// The fleet arrives from /events (server-sent events) after every poll;
+// a miner page asks /api/miner for everything, now.
+"use strict";
+
+var fleet = null;
+var sortKey = "host";
+var sortAsc = true;
+var filterText = "";
+
+var HOT = 80;      // degrees - orange
+var CRITICAL = 90; // degrees - red
+
+function $(id) { return document.getElementById(id); }
+
+function esc(s) {
+  return String(s === undefined || s === null ? "" : s)
+    .replace(/&/g, "&amp;").replace(/</g, "&lt;").replace(/>/g, "&gt;").replace(/"/g, "&quot;");
+}
+
+// 1234.5 MH/s -> "1.23 GH/s"
+function hashrate(mhs) {
+  var units = ["MH/s", "GH/s", "TH/s", "PH/s", "EH/s"];
+  var i = 0;
+  while (mhs >= 1000 && i < units.length - 1) { mhs /= 1000; i++; }
+  return mhs.toFixed(mhs < 10 ? 2 : 1) + " " + units[i];
+}
+
+function duration(secs) {
+  if (!secs) return "-";
+  var d = Math.floor(secs / 86400), h = Math.floor(secs % 86400 / 3600), m = Math.floor(secs % 3600 / 60);
+  if (d) return d + "d " + h + "h";
+  if (h) return h + "h " + m + "m";
+  return m + "m";
+}
+
+function ipNumber(ip) {
+  return ip.split(".").reduce(function (n, o) { return n * 256 + Number(o); }, 0);
+}
+
+// One row's worth of numbers from a HostRecord.
+function row(rec) {
+  var s = rec.summary || {};
+  var v = rec.version || {};
+  var temp = 0;
+  (rec.devs || []).forEach(function (d) { if (d.Temperature > temp) temp = d.Temperature; });
+  var pool = "";
+  (rec.pools || []).some(function (p) {
+    if (p["Stratum Active"] || p.Status === "Alive") { pool = p["Stratum URL"] || p.URL; return true; }
+    return false;
+  });
+  return {
+    host: rec.host,
+    model: v.Type || rec.dialect || "",
+    mhs5s: s["MHS 5s"] || 0,
+    mhsav: s["MHS av"] || 0,
+    temp: temp,
+    devs: (rec.devs || []).length,
+    pool: pool,
+    uptime: s.Elapsed || 0,
+    firmware: v.Miner || v.CGMiner || v.BMMiner || v.SGMiner || "",
+    down: !rec.summary || (rec.errors || []).length > 0
+  };
+}
+
+function tempClass(t) {
+  if (t >= CRITICAL) return "critical";
+  if (t >= HOT) return "hot";
+  return "";
+}
+
+// Blue when cool, through yellow, to red at CRITICAL.
+function tempColour(t) {
+  if (!t) return "#2c333d";
+  var f = Math.max(0, Math.min(1, (t - 40) / (CRITICAL - 40)));
+  return "hsl(" + Math.round(210 - f * 210) + ", 70%, 45%)";
+}
+
+/////////////////////////////////////////////////////////////
+// The fleet page
+/////////////////////////////////////////////////////////////
+function renderFleet() {
+  if (!fleet) return;
+  var rows = fleet.miners.map(row);
+
+  var up = 0, mhs5s = 0, mhsav = 0, hottest = 0;
+  rows.forEach(function (r) {
+    if (!r.down) up++;
+    mhs5s += r.mhs5s;
+    mhsav += r.mhsav;
+    if (r.temp > hottest) hottest = r.temp;
+  });
+  $("site").textContent = fleet.site || "";
+  $("t-miners").textContent = rows.length;
+  $("t-up").textContent = up;
+  $("t-mhs5s").textContent = hashrate(mhs5s);
+  $("t-mhsav").textContent = hashrate(mhsav);
+  $("t-temp").textContent = hottest ? hottest.toFixed(1) + "°" : "-";
+  $("version").textContent = fleet.horus_version;
+
+  renderHeatmap(rows);
+
+  var shown = rows.filter(function (r) {
+    if (!filterText) return true;
+    return [r.host, r.model, r.pool, r.firmware].join(" ").toLowerCase().indexOf(filterText) >= 0;
+  });
+  shown.sort(function (a, b) {
+    var x = a[sortKey], y = b[sortKey];
+    if (sortKey === "host") { x = ipNumber(x); y = ipNumber(y); }
+    var c = x < y ? -1 : x > y ? 1 : 0;
+    return sortAsc ? c : -c;
+  });
+
+  $("miners").querySelector("tbody").innerHTML = shown.map(function (r) {
+    return "<tr data-host=\"" + esc(r.host) + "\"" + (r.down ? " class=\"down\"" : "") + ">" +
+      "<td>" + esc(r.host) + "</td>" +
+      "<td>" + esc(r.model) + "</td>" +
+      "<td class=\"num\">" + r.mhs5s.toFixed(2) + "</td>" +
+      "<td class=\"num\">" + r.mhsav.toFixed(2) + "</td>" +
+      "<td class=\"num " + tempClass(r.temp) + "\">" + (r.temp ? r.temp.toFixed(1) : "-") + "</td>" +
+      "<td class=\"num\">" + r.devs + "</td>" +
+      "<td>" + esc(r.pool) + "</td>" +
+      "<td class=\"num\">" + duration(r.uptime) + "</td>" +
+      "<td>" + esc(r.firmware) + "</td></tr>";
+  }).join("");
+
+  document.querySelectorAll("#miners th").forEach(function (th) {
+    th.classList.toggle("sorted", th.dataset.key === sortKey);
+    th.classList.toggle("asc", th.dataset.key === sortKey && sortAsc);
+  });
+}
+
+function renderHeatmap(rows) {
+  var racks = {};
+  rows.forEach(function (r) {
+    var spot = fleet.racks[r.host] || { rack: "?", position: 0 };
+    (racks[spot.rack] = racks[spot.rack] || []).push({ pos: spot.position, row: r });
+  });
+  $("heatmap").innerHTML = Object.keys(racks).sort().map(function (name) {
+    var cells = racks[name].sort(function (a, b) { return a.pos - b.pos; });
+    return "<div class=\"rack\"><h3>" + esc(name) + "</h3><div class=\"cells\">" +
+      cells.map(function (c) {
+        var title = c.row.host + " - " + (c.row.temp ? c.row.temp.toFixed(1) + "°" : "no temperature") +
+          " - " + hashrate(c.row.mhs5s);
+        return "<div class=\"cell\" style=\"background:" + tempColour(c.row.temp) + "\" title=\"" + esc(title) + "\">" +
+          "<a href=\"#/miner/" + esc(c.row.host) + "\"></a></div>";
+      }).join("") + "</div></div>";
+  }).join("");
+}
+
+/////////////////////////////////////////////////////////////
+// The miner page
+/////////////////////////////////////////////////////////////
+function card(title, obj) {
+  if (!obj) return "";
+  return "<div class=\"card\"><h3>" + esc(title) + "</h3><dl>" +
+    Object.keys(obj).map(function (k) {
+      var v = obj[k];
+      if (typeof v === "object" && v !== null) v = JSON.stringify(v);
+      return "<dt>" + esc(k) + "</dt><dd>" + esc(v) + "</dd>";
+    }).join("") + "</dl></div>";
+}
+
+function renderMiner(ip) {
+  $("miner-title").textContent = ip;
+  $("miner-body").textContent = "loading...";
+  fetch("api/miner?ip=" + encodeURIComponent(ip))
+    .then(function (r) { return r.json(); })
+    .then(function (rec) {
+      if (location.hash !== "#/miner/" + ip) return;
+      var html = "";
+      if (rec.errors) html += "<p class=\"status stale\">" + rec.errors.map(esc).join("<br>") + "</p>";
+      html += "<h2>Summary</h2><div class=\"cards\">" + card("Version", rec.version) + card("Summary", rec.summary) + "</div>";
+      html += "<h2>Pools</h2><div class=\"cards\">" + (rec.pools || []).map(function (p, i) { return card("Pool " + i, p); }).join("") + "</div>";
+      html += "<h2>Devices</h2><div class=\"cards\">" + (rec.devs || []).map(function (d, i) { return card("Device " + i, d); }).join("") + "</div>";
+      html += "<h2>Config</h2><div class=\"cards\">" + card("Config", rec.config) + "</div>";
+      $("miner-body").innerHTML = html;
+    })
+    .catch(function (e) { $("miner-body").textContent = "Error: " + e; });
+}
+
+function route() {
+  var m = location.hash.match(/^#\/miner\/([0-9.]+)$/);
+  $("fleet").hidden = !!m;
+  $("miner").hidden = !m;
+  if (m) renderMiner(m[1]);
+  else renderFleet();
+}
+
+/////////////////////////////////////////////////////////////
+// Wiring
+/////////////////////////////////////////////////////////////
+document.querySelectorAll("#miners th").forEach(function (th) {
+  th.addEventListener("click", function () {
+    if (sortKey === th.dataset.key) sortAsc = !sortAsc;
+    else { sortKey = th.dataset.key; sortAsc = th.classList.contains("num") ? false : true; }
+    renderFleet();
+  });
+});
+
+$("miners").querySelector("tbody").addEventListener("click", function (e) {
+  var tr = e.target.closest("tr");
+  if (tr) location.hash = "#/miner/" + tr.dataset.host;
+});
+
+$("filter").addEventListener("input", function (e) {
+  filterText = e.target.value.toLowerCase();
+  renderFleet();
+});
+
+window.addEventListener("hashchange", route);
+
+// The browser reconnects by itself if the connection drops.
+var events = new EventSource("events");
+events.addEventListener("fleet", function (e) {
+  fleet = JSON.parse(e.data);
+  var when = fleet.polled && fleet.polled.indexOf("0001") !== 0 ? new Date(fleet.polled).toLocaleTimeString() : "not yet";
+  $("status").textContent = "polled " + when;
+  $("status").classList.remove("stale");
+  if ($("miner").hidden) renderFleet();
+});
+events.addEventListener("error", function () {
+  $("status").textContent = "disconnected - retrying";
+  $("status").classList.add("stale");
+});
+
+route();